@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Type of the authentication events
+type EventType string
+
+const (
+	EventSignin             EventType = "signin"
+	EventSigninFailed       EventType = "signin-failed"
+	EventLogin              EventType = "login"
+	EventLoginFailed        EventType = "login-failed"
+	EventRefreshToken       EventType = "refresh-token"
+	EventRefreshTokenFailed EventType = "refresh-token-failed"
+)
+
+// Authentication event, the log sets the Seq, the Time when it is empty, and the hashes
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Type   EventType `json:"type"`
+	UserId string    `json:"user_id,omitempty"`
+	// the email used in the request, the only trace of the logins of unknown users
+	Email      string `json:"email,omitempty"`
+	TenantId   string `json:"tenant_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// why the request failed
+	Reason string `json:"reason,omitempty"`
+
+	// hash of the previous event, empty in the first one
+	PrevHash string `json:"prev_hash"`
+	// hash of the event with the hash of the previous one, so an event
+	// can not be changed or removed without changing all the next ones.
+	// An HMAC when the log has a key, so only the holders of the key can
+	// compute the hashes of the changed events
+	Hash string `json:"hash"`
+}
+
+// Filter of the events, the empty fields match all the events
+type Query struct {
+	UserId string
+	Types  []EventType
+	// the events from this time, included
+	From time.Time
+	// the events until this time, not included
+	To time.Time
+	// the maximum number of events, 0 is no limit
+	Limit int
+}
+
+// Log of the authentication events
+type Log interface {
+	Record(ctx context.Context, event Event) error
+	// The events that match the query, in the order they were recorded
+	Query(q Query) ([]Event, error)
+}
+
+// The chain of events is broken, an event was changed, removed or added
+type TamperError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *TamperError) Error() string {
+	return fmt.Sprintf("Audit log tampered at event %d: %s", e.Seq, e.Reason)
+}
+
+func (q Query) match(e Event) bool {
+	if q.UserId != "" && q.UserId != e.UserId {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// The hash of the event is the HMAC-SHA-256 with the key of the event in JSON without its hash,
+// or its SHA-256 without a key
+func hashEvent(e Event, key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Chains the event to the previous one
+func chainEvent(e *Event, seq uint64, prevHash string, key []byte) error {
+	e.Seq = seq
+	e.PrevHash = prevHash
+	// in UTC the time is the same after a round trip through JSON, and so the hash
+	e.Time = e.Time.UTC()
+	hash, err := hashEvent(*e, key)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	return nil
+}
+
+// Checks that the event is the next one in the chain
+func checkEvent(e Event, seq uint64, prevHash string, key []byte) error {
+	if e.Seq != seq {
+		return &TamperError{Seq: seq, Reason: fmt.Sprintf("found event %d", e.Seq)}
+	}
+	if e.PrevHash != prevHash {
+		return &TamperError{Seq: seq, Reason: "the previous hash does not match"}
+	}
+	hash, err := hashEvent(e, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+		return &TamperError{Seq: seq, Reason: "the hash does not match"}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var headKey = []byte("head")
+
+// Log of the events in a Bolt bucket, the events are hash-chained, so the
+// changes to the stored events are found with Verify. The last event is kept
+// apart as the head of the chain, so removing the last events is found too.
+// Without a key the hashes are SHA-256, anyone with access to the database can
+// compute the chain of the changed events again, so they only find accidental
+// corruption. Set the Key of the options to find the changes made on purpose too.
+// Keep the hash of the head somewhere else to find a log rewritten entirely.
+type BoltLog struct {
+	db         *bolt.DB
+	bucket     []byte
+	headBucket []byte
+	key        []byte
+	now        func() time.Time
+}
+
+type BoltLogOptions struct {
+	// The key of the HMAC-SHA-256 of the hashes of the events, keep it outside of the database.
+	// A log recorded with a key is only verified with the same key
+	Key []byte
+}
+
+// The events are stored in the bucket, and the head in <bucket>.head
+func NewBoltLog(db *bolt.DB, bucket string) (*BoltLog, error) {
+	return NewBoltLogWithOptions(db, bucket, BoltLogOptions{})
+}
+
+func NewBoltLogWithOptions(db *bolt.DB, bucket string, opt BoltLogOptions) (*BoltLog, error) {
+	bl := &BoltLog{
+		db:         db,
+		bucket:     []byte(bucket),
+		headBucket: []byte(bucket + ".head"),
+		key:        opt.Key,
+		now:        time.Now,
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bl.bucket, bl.headBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("Creating bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	return bl, err
+}
+
+func (bl *BoltLog) Record(ctx context.Context, event Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if event.Time.IsZero() {
+		event.Time = bl.now()
+	}
+
+	return bl.db.Update(func(tx *bolt.Tx) error {
+		head, err := getHead(tx.Bucket(bl.headBucket))
+		if err != nil {
+			return err
+		}
+		err = chainEvent(&event, head.Seq+1, head.Hash, bl.key)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bl.bucket).Put(seqKey(event.Seq), data)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bl.headBucket).Put(headKey, data)
+	})
+}
+
+// The events are scanned in order, the time range does not use an index
+func (bl *BoltLog) Query(q Query) ([]Event, error) {
+	events := make([]Event, 0)
+	err := bl.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bl.bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var event Event
+			err := json.Unmarshal(v, &event)
+			if err != nil {
+				return err
+			}
+			if !q.match(event) {
+				continue
+			}
+			events = append(events, event)
+			if q.Limit > 0 && len(events) == q.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// The last event recorded, an empty event when there are no events.
+// Keep its hash out of the database to check the log later
+func (bl *BoltLog) Head() (Event, error) {
+	var head Event
+	err := bl.db.View(func(tx *bolt.Tx) error {
+		var err error
+		head, err = getHead(tx.Bucket(bl.headBucket))
+		return err
+	})
+	return head, err
+}
+
+// Checks the hash chain of all the events, a *TamperError when it is broken
+func (bl *BoltLog) Verify() error {
+	return bl.db.View(func(tx *bolt.Tx) error {
+		var prev Event
+		c := tx.Bucket(bl.bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			seq := prev.Seq + 1
+			var event Event
+			err := json.Unmarshal(v, &event)
+			if err != nil {
+				return &TamperError{Seq: seq, Reason: err.Error()}
+			}
+			if len(k) != 8 || binary.BigEndian.Uint64(k) != event.Seq {
+				return &TamperError{Seq: seq, Reason: "the key does not match the event"}
+			}
+			err = checkEvent(event, seq, prev.Hash, bl.key)
+			if err != nil {
+				return err
+			}
+			prev = event
+		}
+
+		head, err := getHead(tx.Bucket(bl.headBucket))
+		if err != nil {
+			return &TamperError{Seq: prev.Seq + 1, Reason: err.Error()}
+		}
+		if head.Seq != prev.Seq || head.Hash != prev.Hash {
+			return &TamperError{Seq: prev.Seq + 1, Reason: fmt.Sprintf("the head is the event %d", head.Seq)}
+		}
+		return nil
+	})
+}
+
+func getHead(b *bolt.Bucket) (Event, error) {
+	var head Event
+	data := b.Get(headKey)
+	if data == nil {
+		return head, nil
+	}
+	err := json.Unmarshal(data, &head)
+	return head, err
+}
+
+// The keys are big endian, so the events are in order in the bucket
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newLog(t *testing.T) (*bolt.DB, *BoltLog) {
+	db, err := bolt.Open("testAudit.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"audit", "audit.head", "keyed", "keyed.head"} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				t.Errorf("Deleting bucket: %s", err)
+				return err
+			}
+		}
+		return nil
+	})
+
+	bl, err := NewBoltLog(db, "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, bl
+}
+
+func TestBoltLog(t *testing.T) {
+	Convey("The events are recorded in a hash chain", t, func() {
+		db, bl := newLog(t)
+		defer db.Close()
+
+		start := time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC)
+		events := []Event{
+			{Type: EventSignin, UserId: "user1", Email: "user1@test.com", Time: start},
+			{Type: EventLoginFailed, Email: "user1@test.com", Reason: "Wrong password", Time: start.Add(time.Minute)},
+			{Type: EventLogin, UserId: "user1", Email: "user1@test.com", Time: start.Add(2 * time.Minute)},
+			{Type: EventSignin, UserId: "user2", Email: "user2@test.com", Time: start.Add(3 * time.Minute)},
+			{Type: EventRefreshToken, UserId: "user1", Time: start.Add(4 * time.Minute)},
+		}
+		for _, event := range events {
+			So(bl.Record(context.Background(), event), ShouldBeNil)
+		}
+
+		all, err := bl.Query(Query{})
+		So(err, ShouldBeNil)
+		So(len(all), ShouldEqual, 5)
+		So(all[0].Seq, ShouldEqual, 1)
+		So(all[0].PrevHash, ShouldBeEmpty)
+		for i := 1; i < len(all); i++ {
+			So(all[i].PrevHash, ShouldEqual, all[i-1].Hash)
+		}
+
+		head, err := bl.Head()
+		So(err, ShouldBeNil)
+		So(head.Seq, ShouldEqual, 5)
+		So(head.Hash, ShouldEqual, all[4].Hash)
+
+		So(bl.Verify(), ShouldBeNil)
+
+		Convey("The events are queried by user, type and time", func() {
+			found, err := bl.Query(Query{UserId: "user1"})
+			So(err, ShouldBeNil)
+			So(len(found), ShouldEqual, 3)
+
+			found, err = bl.Query(Query{Types: []EventType{EventLogin, EventLoginFailed}})
+			So(err, ShouldBeNil)
+			So(len(found), ShouldEqual, 2)
+			So(found[0].Type, ShouldEqual, EventLoginFailed)
+			So(found[0].Reason, ShouldEqual, "Wrong password")
+
+			found, err = bl.Query(Query{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)})
+			So(err, ShouldBeNil)
+			So(len(found), ShouldEqual, 2)
+			So(found[0].Seq, ShouldEqual, 2)
+			So(found[1].Seq, ShouldEqual, 3)
+
+			found, err = bl.Query(Query{Types: []EventType{EventSignin}, Limit: 1})
+			So(err, ShouldBeNil)
+			So(len(found), ShouldEqual, 1)
+			So(found[0].UserId, ShouldEqual, "user1")
+
+			found, err = bl.Query(Query{UserId: "nobody"})
+			So(err, ShouldBeNil)
+			So(found, ShouldBeEmpty)
+		})
+
+		Convey("A changed event is found", func() {
+			err := db.Update(func(tx *bolt.Tx) error {
+				var event Event
+				b := tx.Bucket([]byte("audit"))
+				json.Unmarshal(b.Get(seqKey(2)), &event)
+				event.Type = EventLogin
+				data, _ := json.Marshal(event)
+				return b.Put(seqKey(2), data)
+			})
+			So(err, ShouldBeNil)
+
+			err = bl.Verify()
+			So(err, ShouldHaveSameTypeAs, &TamperError{})
+			So(err.(*TamperError).Seq, ShouldEqual, 2)
+		})
+
+		Convey("A removed event is found", func() {
+			err := db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("audit")).Delete(seqKey(3))
+			})
+			So(err, ShouldBeNil)
+
+			err = bl.Verify()
+			So(err, ShouldHaveSameTypeAs, &TamperError{})
+			So(err.(*TamperError).Seq, ShouldEqual, 3)
+		})
+
+		Convey("A removed last event is found", func() {
+			err := db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("audit")).Delete(seqKey(5))
+			})
+			So(err, ShouldBeNil)
+
+			err = bl.Verify()
+			So(err, ShouldHaveSameTypeAs, &TamperError{})
+			So(err.(*TamperError).Seq, ShouldEqual, 5)
+		})
+
+		Convey("A rewritten chain is found with the key of the log", func() {
+			keyed, err := NewBoltLogWithOptions(db, "keyed", BoltLogOptions{Key: []byte("audit key")})
+			So(err, ShouldBeNil)
+			for _, event := range events {
+				So(keyed.Record(context.Background(), event), ShouldBeNil)
+			}
+			So(keyed.Verify(), ShouldBeNil)
+
+			// the events after the changed one are chained again, without the key of the log
+			err = db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("keyed"))
+				var prev Event
+				json.Unmarshal(b.Get(seqKey(1)), &prev)
+				for seq := uint64(2); seq <= 5; seq++ {
+					var event Event
+					json.Unmarshal(b.Get(seqKey(seq)), &event)
+					if seq == 2 {
+						event.Type = EventLogin
+					}
+					chainEvent(&event, seq, prev.Hash, []byte("other key"))
+					data, _ := json.Marshal(event)
+					b.Put(seqKey(seq), data)
+					prev = event
+				}
+				data, _ := json.Marshal(prev)
+				return tx.Bucket([]byte("keyed.head")).Put(headKey, data)
+			})
+			So(err, ShouldBeNil)
+
+			err = keyed.Verify()
+			So(err, ShouldHaveSameTypeAs, &TamperError{})
+			So(err.(*TamperError).Seq, ShouldEqual, 2)
+		})
+
+		Convey("The events are not recorded when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(bl.Record(ctx, Event{Type: EventLogin}), ShouldEqual, context.Canceled)
+
+			head, err := bl.Head()
+			So(err, ShouldBeNil)
+			So(head.Seq, ShouldEqual, 5)
+		})
+	})
+}
@@ -1,34 +1,188 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/gorilla/context"
+	gcontext "github.com/gorilla/context"
+	"golang.org/x/net/idna"
 
+	"github.com/dahernan/auth/audit"
 	"github.com/dahernan/auth/jwt"
 	"github.com/dahernan/auth/store"
 )
 
 const (
-	TokenKey = "token"
-	UserKey  = "user"
+	TokenKey  = "token"
+	UserKey   = "user"
+	TenantKey = "tenant"
+)
+
+var (
+	ErrNoTenant         = errors.New("The request has no tenant")
+	ErrTokenOtherTenant = errors.New("The token is for another tenant")
 )
 
 type AuthRoute struct {
-	userStore store.UserRepository
+	userStore store.ContextUserRepository
 	options   jwt.Options
+
+	// the routes of tenants have the store of the tenant of every request
+	tenants store.TenantRepository
+	resolve TenantResolver
+
+	// the passwords of the signins of all the stores are checked against it
+	policy store.PasswordPolicy
+
+	auditLog audit.Log
+}
+
+// The route checks the passwords of the signins against the default store.PasswordPolicy,
+// see SetPasswordPolicy
+func NewAuthRoute(userStore store.UserRepository, opt jwt.Options) *AuthRoute {
+	return NewAuthRouteContext(store.WithContext(userStore), opt)
 }
 
-func NewAuthRoute(store store.UserRepository, opt jwt.Options) *AuthRoute {
+// The route with a store that only has the context operations,
+// the context of the requests is passed to the store
+func NewAuthRouteContext(userStore store.ContextUserRepository, opt jwt.Options) *AuthRoute {
 	return &AuthRoute{
-		userStore: store,
+		userStore: userStore,
 		options:   opt,
 	}
 }
 
+// The route for the users of several tenants, the tenant of every request is resolved
+// with resolve and the request uses the store of the tenant. The tokens have the tenant
+// and they are only valid in the requests of the same tenant.
+func NewTenantAuthRoute(tenants store.TenantRepository, resolve TenantResolver, opt jwt.Options) *AuthRoute {
+	return &AuthRoute{
+		tenants: tenants,
+		resolve: resolve,
+		options: opt,
+	}
+}
+
+// The policy of the passwords of the signins, in every store of the route, the default store.PasswordPolicy
+// if it is not set. The stores wrapped in a store.PolicyStore check their own policy too.
+// The passwords of the logins are normalized like the ones of the signins
+func (a *AuthRoute) SetPasswordPolicy(policy store.PasswordPolicy) {
+	a.policy = policy
+}
+
+// Records the signins, logins and token refreshes in the log, the ones that fail too.
+// An event that can not be recorded is logged, the request is not stopped
+func (a *AuthRoute) SetAuditLog(auditLog audit.Log) {
+	a.auditLog = auditLog
+}
+
+func (a *AuthRoute) record(req *http.Request, event audit.Event, err error) {
+	if a.auditLog == nil {
+		return
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	event.RemoteAddr = req.RemoteAddr
+	err = a.auditLog.Record(req.Context(), event)
+	if err != nil {
+		log.Printf("ERROR: Recording audit event %s: %v\n", event.Type, err)
+	}
+}
+
+// Resolves the tenant of a request
+type TenantResolver func(r *http.Request) (string, error)
+
+// The tenant is the subdomain of the host, "acme" in "acme.example.com" with the suffix ".example.com".
+// The host is compared without case, and the subdomains with Unicode are the tenants of their punycode
+func TenantFromHost(suffix string) TenantResolver {
+	if domain, err := idna.Lookup.ToASCII(strings.TrimPrefix(suffix, ".")); err == nil {
+		suffix = strings.TrimSuffix(suffix, strings.TrimPrefix(suffix, ".")) + domain
+	}
+	return func(r *http.Request) (string, error) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+		if err != nil {
+			return "", ErrNoTenant
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return "", ErrNoTenant
+		}
+		return validTenant(strings.TrimSuffix(host, suffix))
+	}
+}
+
+// The tenant is the value of the header
+func TenantFromHeader(name string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		return validTenant(r.Header.Get(name))
+	}
+}
+
+// The tenant is the first segment of the path, "acme" in "/acme/login"
+func TenantFromPathPrefix() TenantResolver {
+	return func(r *http.Request) (string, error) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		if i := strings.Index(path, "/"); i >= 0 {
+			path = path[:i]
+		}
+		return validTenant(path)
+	}
+}
+
+func validTenant(tenantId string) (string, error) {
+	if tenantId == "" || strings.Contains(tenantId, ".") {
+		return "", ErrNoTenant
+	}
+	return tenantId, nil
+}
+
+// The store of the request and its tenant, the tenant is empty in the routes without tenants.
+// Writes the error in the response when there is no store for the request.
+func (a *AuthRoute) storeFor(w http.ResponseWriter, req *http.Request) (store.ContextUserRepository, string, bool) {
+	if a.tenants == nil {
+		return store.NewPolicyStoreContext(a.userStore, a.policy), "", true
+	}
+
+	tenantId, err := a.resolve(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	repo, err := a.tenants.ForTenant(tenantId)
+	if err == store.ErrTenantNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return store.NewPolicyStore(repo, a.policy), tenantId, true
+}
+
+func (a *AuthRoute) generateToken(req *http.Request, userId, tenantId string) (string, error) {
+	if a.tenants == nil {
+		return jwt.GenerateJWTTokenContext(req.Context(), userId, a.options)
+	}
+	return jwt.GenerateTenantJWTTokenContext(req.Context(), userId, tenantId, a.options)
+}
+
 func (a *AuthRoute) Login(w http.ResponseWriter, req *http.Request) {
+	userStore, tenantId, ok := a.storeFor(w, req)
+	if !ok {
+		return
+	}
+
 	var authForm map[string]string
 
 	err := RequestToJsonObject(req, &authForm)
@@ -40,17 +194,27 @@ func (a *AuthRoute) Login(w http.ResponseWriter, req *http.Request) {
 	email := authForm["email"]
 	pass := authForm["password"]
 
-	userId, err := a.userStore.Login(email, pass)
+	userId, err := userStore.LoginContext(req.Context(), email, pass)
 	if err != nil {
-		http.Error(w, "Username or Password Invalid", http.StatusUnauthorized)
+		a.record(req, audit.Event{Type: audit.EventLoginFailed, Email: email, TenantId: tenantId}, err)
+		switch {
+		case err == store.ErrAccountDisabled, err == store.ErrAccountLocked, err == store.ErrAccountPendingDeletion:
+			// the password is right, so the user can know the status of the account
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case contextError(err):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "Username or Password Invalid", http.StatusUnauthorized)
+		}
 		return
 	}
 
-	token, err := jwt.GenerateJWTToken(userId, a.options)
+	token, err := a.generateToken(req, userId, tenantId)
 	if err != nil {
 		http.Error(w, "Error while Signing Token :S", http.StatusInternalServerError)
 		return
 	}
+	a.record(req, audit.Event{Type: audit.EventLogin, UserId: userId, Email: email, TenantId: tenantId}, nil)
 
 	jtoken, err := json.Marshal(map[string]string{"token": token})
 	if err != nil {
@@ -63,17 +227,41 @@ func (a *AuthRoute) Login(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *AuthRoute) RefreshToken(w http.ResponseWriter, req *http.Request) {
-	userId, _, err := a.authenticate(w, req)
+	userStore, tenantId, ok := a.storeFor(w, req)
+	if !ok {
+		return
+	}
+
+	userId, _, err := a.authenticate(w, req, tenantId)
 	if err != nil {
+		a.record(req, audit.Event{Type: audit.EventRefreshTokenFailed, TenantId: tenantId}, err)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	token, err := jwt.GenerateJWTToken(userId, a.options)
+	// the account can be disabled or deleted after the token was issued
+	user, err := userStore.UserByIdContext(req.Context(), userId)
+	if err == nil {
+		err = user.CheckStatus(time.Now())
+	}
+	if err != nil {
+		a.record(req, audit.Event{Type: audit.EventRefreshTokenFailed, UserId: userId, TenantId: tenantId}, err)
+	}
+	if contextError(err) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := a.generateToken(req, userId, tenantId)
 	if err != nil {
 		http.Error(w, "Error while Signing Token :S", http.StatusInternalServerError)
 		return
 	}
+	a.record(req, audit.Event{Type: audit.EventRefreshToken, UserId: userId, TenantId: tenantId}, nil)
 
 	jtoken, err := json.Marshal(map[string]string{"token": token})
 	if err != nil {
@@ -85,19 +273,45 @@ func (a *AuthRoute) RefreshToken(w http.ResponseWriter, req *http.Request) {
 	w.Write(jtoken)
 }
 
+// The body of the Signin request, the attributes are optional
+type signinForm struct {
+	Email      string           `json:"email"`
+	Password   string           `json:"password"`
+	Attributes store.Attributes `json:"attributes"`
+}
+
 func (a *AuthRoute) Signin(w http.ResponseWriter, req *http.Request) {
-	var authForm map[string]string
+	userStore, tenantId, ok := a.storeFor(w, req)
+	if !ok {
+		return
+	}
 
-	err := RequestToJsonObject(req, &authForm)
+	var signin signinForm
+
+	err := RequestToJsonObject(req, &signin)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	email := authForm["email"]
-	pass := authForm["password"]
-
-	userId, err := a.userStore.Signin(email, pass)
+	userId, err := userStore.SigninWithAttributesContext(req.Context(), signin.Email, signin.Password, signin.Attributes)
+	if err != nil {
+		a.record(req, audit.Event{Type: audit.EventSigninFailed, Email: signin.Email, TenantId: tenantId}, err)
+	} else {
+		a.record(req, audit.Event{Type: audit.EventSignin, UserId: userId, Email: signin.Email, TenantId: tenantId}, nil)
+	}
+	if contextError(err) || err == store.ErrBreachCheckFailed {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err == store.ErrReadOnly {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if policyErr, ok := err.(*store.PolicyError); ok {
+		policyError(w, policyErr)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -114,56 +328,113 @@ func (a *AuthRoute) Signin(w http.ResponseWriter, req *http.Request) {
 	w.Write(juser)
 }
 
-func (a *AuthRoute) authenticate(w http.ResponseWriter, r *http.Request) (string, string, error) {
+// The body of the responses of the passwords that do not follow the policy,
+// with the field and the code of every rule the password breaks
+type policyErrorResponse struct {
+	Error  string                  `json:"error"`
+	Errors []store.PolicyViolation `json:"errors"`
+}
+
+func policyError(w http.ResponseWriter, err *store.PolicyError) {
+	body, jerr := json.Marshal(policyErrorResponse{Error: err.Error(), Errors: err.Violations})
+	if jerr != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(body)
+}
+
+// Validates the token of the request, in the routes of tenants the token has to be for the tenant of the request
+func (a *AuthRoute) authenticate(w http.ResponseWriter, r *http.Request, tenantId string) (string, string, error) {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
 		return "", "", errors.New("Error no token is provided")
 	}
-	userId, token, err := jwt.ValidateToken(r, a.options.PublicKey)
+	if a.tenants == nil {
+		return jwt.ValidateTokenContext(r.Context(), r, a.options.PublicKey)
+	}
+
+	userId, tokenTenant, token, err := jwt.ValidateTenantTokenContext(r.Context(), r, a.options.PublicKey)
 	if err != nil {
 		return "", "", err
 	}
+	if tokenTenant != tenantId {
+		return "", "", ErrTokenOtherTenant
+	}
 	return userId, token, nil
 }
 
+// The tenant of the request in the routes of tenants
+func (a *AuthRoute) tenantOf(r *http.Request) (string, error) {
+	if a.tenants == nil {
+		return "", nil
+	}
+	return a.resolve(r)
+}
+
+// The request is cancelled or its deadline is over
+func contextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
 // Get User from the context
 func GetUserId(r *http.Request) string {
-	return context.Get(r, UserKey).(string)
+	return gcontext.Get(r, UserKey).(string)
 }
 
 // Get Token from the context
 func GetToken(r *http.Request) string {
-	return context.Get(r, TokenKey).(string)
+	return gcontext.Get(r, TokenKey).(string)
+}
+
+// Get the tenant from the context, empty in the routes without tenants
+func GetTenantId(r *http.Request) string {
+	tenantId, _ := gcontext.Get(r, TenantKey).(string)
+	return tenantId
 }
 
 // Auth middleware for negroni
 func (a *AuthRoute) AuthMiddleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	userId, token, err := a.authenticate(w, r)
+	tenantId, err := a.tenantOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userId, token, err := a.authenticate(w, r, tenantId)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	context.Set(r, TokenKey, token)
-	context.Set(r, UserKey, userId)
+	gcontext.Set(r, TokenKey, token)
+	gcontext.Set(r, UserKey, userId)
+	gcontext.Set(r, TenantKey, tenantId)
 	next(w, r)
-	context.Clear(r)
+	gcontext.Clear(r)
 
 }
 
 // Auth Handler for net/http
 func (a *AuthRoute) AuthHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userId, token, err := a.authenticate(w, r)
+		tenantId, err := a.tenantOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		userId, token, err := a.authenticate(w, r, tenantId)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		context.Set(r, TokenKey, token)
-		context.Set(r, UserKey, userId)
+		gcontext.Set(r, TokenKey, token)
+		gcontext.Set(r, UserKey, userId)
+		gcontext.Set(r, TenantKey, tenantId)
 		h.ServeHTTP(w, r)
-		context.Clear(r)
+		gcontext.Clear(r)
 	})
 }
 
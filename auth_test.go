@@ -2,15 +2,20 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/dahernan/auth/audit"
 	"github.com/dahernan/auth/jwt"
 	"github.com/dahernan/auth/store"
 
@@ -33,7 +38,7 @@ func TestSignIn(t *testing.T) {
 		route := NewAuthRoute(bs, options)
 
 		email := "ddhhpp@test.com"
-		pass := "123456"
+		pass := "12345678"
 
 		req, err := httpRequest("POST", "http://testserver", map[string]string{
 			"email":    email,
@@ -51,8 +56,198 @@ func TestSignIn(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(code, ShouldEqual, http.StatusCreated)
 
-		So(response["id"], ShouldEqual, email)
+		So(response["id"], ShouldNotBeEmpty)
+		So(response["id"], ShouldNotEqual, email)
+
+	})
+}
+
+func TestSignInWithAttributes(t *testing.T) {
+	Convey("Singin with a http request stores the attributes of the user", t, func() {
+		db := newDB(t, "testHttpUsers.db")
+		defer db.Close()
+
+		bucket := "testBucket"
+		deleteBucket(t, db, bucket)
+		bs, err := store.NewBoltStoreWithOptions(db, bucket, store.BoltOptions{
+			AttributeSchema: store.AttributeSchema{
+				"name":   {Type: store.StringAttribute, Required: true},
+				"locale": {Type: store.StringAttribute, MaxLength: 5},
+				"age":    {Type: store.NumberAttribute},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		route := NewAuthRoute(bs, options)
+
+		req, err := httpRequest("POST", "http://testserver", map[string]interface{}{
+			"email":    "ddhhpp@test.com",
+			"password": "12345678",
+			"attributes": map[string]interface{}{
+				"name":   "David",
+				"locale": "en-GB",
+				"age":    33,
+			},
+		})
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		route.Signin(w, req)
+
+		var response map[string]string
+		code, err := responseToJson(w, &response)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusCreated)
+
+		user, err := bs.UserById(response["id"])
+		So(err, ShouldBeNil)
+		name, _ := user.Attributes.String("name")
+		So(name, ShouldEqual, "David")
+		age, _ := user.Attributes.Int("age")
+		So(age, ShouldEqual, 33)
+
+		req, err = httpRequest("POST", "http://testserver", map[string]interface{}{
+			"email":      "other@test.com",
+			"password":   "12345678",
+			"attributes": map[string]interface{}{"name": 1},
+		})
+		So(err, ShouldBeNil)
+
+		w = httptest.NewRecorder()
+		route.Signin(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		So(w.Body.String(), ShouldContainSubstring, `Invalid attribute "name"`)
+
+	})
+}
+
+func TestSignInReadOnlyStore(t *testing.T) {
+	Convey("Singin in a read-only store is forbidden", t, func() {
+		path := filepath.Join(os.TempDir(), "testHttpUsers.htpasswd")
+		err := ioutil.WriteFile(path, []byte("admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+		So(err, ShouldBeNil)
+		defer os.Remove(path)
+
+		fs, err := store.NewFileStore(path, store.HtpasswdFile)
+		So(err, ShouldBeNil)
+		route := NewAuthRoute(fs, options)
+
+		req, err := httpRequest("POST", "http://testserver", map[string]string{
+			"email":    "ddhhpp@test.com",
+			"password": "12345678",
+		})
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		route.Signin(w, req)
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+		So(w.Body.String(), ShouldContainSubstring, store.ErrReadOnly.Error())
+
+		token := loginRequest(t, route, "admin", "password")
+		So(token, ShouldNotBeEmpty)
+	})
+}
+
+func TestSignInPasswordPolicy(t *testing.T) {
+	Convey("Singin with a password that does not follow the policy returns the violations", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+		route.SetPasswordPolicy(store.PasswordPolicy{MinEntropy: 30})
+
+		req, err := httpRequest("POST", "http://testserver", map[string]interface{}{
+			"email":      "ddhhpp@test.com",
+			"password":   "david",
+			"attributes": map[string]interface{}{"name": "David"},
+		})
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		route.Signin(w, req)
+
+		var response struct {
+			Error  string
+			Errors []store.PolicyViolation
+		}
+		code, err := responseToJson(w, &response)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusBadRequest)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		So(response.Error, ShouldContainSubstring, "The password does not follow the policy")
+		So(response.Errors, ShouldHaveLength, 3)
+		So(response.Errors[0], ShouldResemble, store.PolicyViolation{
+			Field: "password", Code: store.PasswordTooShort, Message: "it is shorter than 8 characters",
+		})
+		So(response.Errors[1].Code, ShouldEqual, store.PasswordHasName)
+		So(response.Errors[2].Code, ShouldEqual, store.PasswordLowEntropy)
+
+		req, err = httpRequest("POST", "http://testserver", map[string]string{
+			"email":    "ddhhpp@test.com",
+			"password": "correct horse battery",
+		})
+		So(err, ShouldBeNil)
+
+		w = httptest.NewRecorder()
+		route.Signin(w, req)
+		So(w.Code, ShouldEqual, http.StatusCreated)
+	})
+}
+
+func TestSignInDefaultPasswordPolicy(t *testing.T) {
+	Convey("Singin checks the passwords against the default policy", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+		signin := func(pass string) int {
+			req, err := httpRequest("POST", "http://testserver", map[string]string{
+				"email":    "ddhhpp@test.com",
+				"password": pass,
+			})
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			route.Signin(w, req)
+			return w.Code
+		}
+
+		So(signin(""), ShouldEqual, http.StatusBadRequest)
+		So(signin("123456"), ShouldEqual, http.StatusBadRequest)
+		_, err := bs.UserByEmail("ddhhpp@test.com")
+		So(err, ShouldEqual, store.ErrUserNotFound)
 
+		Convey("The policy of the route can be changed", func() {
+			route.SetPasswordPolicy(store.PasswordPolicy{MinLength: 6})
+			So(signin("123456"), ShouldEqual, http.StatusCreated)
+		})
+	})
+}
+
+// The breached passwords can not be checked
+type failingBreachChecker struct{}
+
+func (failingBreachChecker) Breached(ctx context.Context, pass string) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+func TestSignInBreachCheckFailed(t *testing.T) {
+	Convey("Singin fails when the breached passwords can not be checked", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(store.NewPolicyStore(bs, store.PasswordPolicy{Breached: failingBreachChecker{}}), options)
+
+		req, err := httpRequest("POST", "http://testserver", map[string]string{
+			"email":    "ddhhpp@test.com",
+			"password": "correct horse battery",
+		})
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		route.Signin(w, req)
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(w.Body.String(), ShouldContainSubstring, store.ErrBreachCheckFailed.Error())
 	})
 }
 
@@ -62,7 +257,7 @@ func TestSignInDuplicateUser(t *testing.T) {
 		defer db.Close()
 
 		email := "ddhhpp@test.com"
-		pass := "123456"
+		pass := "12345678"
 
 		id, err := bs.Signin(email, pass)
 		So(err, ShouldBeNil)
@@ -179,6 +374,97 @@ func TestLoginWrongPass(t *testing.T) {
 	})
 }
 
+func TestLoginDisabledUser(t *testing.T) {
+	Convey("Login of a disabled or locked user is forbidden", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+
+		id, err := bs.Signin(email, pass)
+		So(err, ShouldBeNil)
+
+		err = store.DisableUser(bs, id)
+		So(err, ShouldBeNil)
+
+		req, err := httpRequest("POST", "http://testserver", map[string]string{
+			"email":    email,
+			"password": pass,
+		})
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		route.Login(w, req)
+
+		t.Logf("%d - %s", w.Code, w.Body.String())
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+		So(w.Body.String(), ShouldContainSubstring, "The account is disabled")
+
+		err = store.LockUser(bs, id, time.Now().Add(time.Hour))
+		So(err, ShouldBeNil)
+
+		req, err = httpRequest("POST", "http://testserver", map[string]string{
+			"email":    email,
+			"password": pass,
+		})
+		So(err, ShouldBeNil)
+
+		w = httptest.NewRecorder()
+		route.Login(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+		So(w.Body.String(), ShouldContainSubstring, "The account is locked")
+
+		// the status is not told without the right password
+		req, err = httpRequest("POST", "http://testserver", map[string]string{
+			"email":    email,
+			"password": "xyz",
+		})
+		So(err, ShouldBeNil)
+
+		w = httptest.NewRecorder()
+		route.Login(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		So(w.Body.String(), ShouldContainSubstring, "Username or Password Invalid")
+
+	})
+}
+
+func TestLoginCancelledRequest(t *testing.T) {
+	Convey("Login of a cancelled request does not get to the store", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+
+		_, err := bs.Signin(email, pass)
+		So(err, ShouldBeNil)
+
+		req, err := httpRequest("POST", "http://testserver", map[string]string{
+			"email":    email,
+			"password": pass,
+		})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(req.Context())
+		cancel()
+
+		w := httptest.NewRecorder()
+		route.Login(w, req.WithContext(ctx))
+
+		t.Logf("%d - %s", w.Code, w.Body.String())
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+
+	})
+}
+
 func TestAuthMiddleware(t *testing.T) {
 	Convey("AuthMiddleware works with the right credentials", t, func() {
 		db, bs := initBoltStore(t)
@@ -245,6 +531,34 @@ func TestAuthMiddlewareNoHeader(t *testing.T) {
 	})
 }
 
+func TestAuthMiddlewareTenantToken(t *testing.T) {
+	Convey("AuthMiddleware unauthorized with the token of a tenant in a route without tenants", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+
+		id, err := bs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		token, err := jwt.GenerateTenantJWTTokenContext(context.Background(), id, "acme", options)
+		So(err, ShouldBeNil)
+
+		req, err := httpRequest("POST", "http://auth", nil)
+		So(err, ShouldBeNil)
+		req.Header.Add("Authorization", "Bearer "+token)
+
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		w := httptest.NewRecorder()
+		route.AuthMiddleware(w, req, handler)
+
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		So(w.Body.String(), ShouldContainSubstring, jwt.ErrTenantToken.Error())
+	})
+}
+
 func TestAuthMiddlewareInvalidToken(t *testing.T) {
 	Convey("AuthMiddleware unauthorized with expired token", t, func() {
 		db, bs := initBoltStore(t)
@@ -316,6 +630,38 @@ func TestRefreshToken(t *testing.T) {
 	})
 }
 
+func TestRefreshTokenDisabledUser(t *testing.T) {
+	Convey("Refresh token fails when the user is disabled after the login", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		route := NewAuthRoute(bs, options)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+
+		id, err := bs.Signin(email, pass)
+		So(err, ShouldBeNil)
+
+		token := loginRequest(t, route, email, pass)
+
+		err = store.DisableUser(bs, id)
+		So(err, ShouldBeNil)
+
+		req, err := httpRequest("POST", "http://refresh", nil)
+		So(err, ShouldBeNil)
+		req.Header.Add("Authorization", strings.Join([]string{"Bearer", token}, " "))
+
+		w := httptest.NewRecorder()
+		route.RefreshToken(w, req)
+
+		t.Logf("%d - %s", w.Code, w.Body.String())
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		So(w.Body.String(), ShouldContainSubstring, "The account is disabled")
+
+	})
+}
+
 func TestRefreshInvalidToken(t *testing.T) {
 	Convey("Refresh token generates a new valid token", t, func() {
 		db, bs := initBoltStore(t)
@@ -346,6 +692,194 @@ func TestRefreshInvalidToken(t *testing.T) {
 	})
 }
 
+func TestTenantResolvers(t *testing.T) {
+	Convey("The tenant is resolved from the host, a header or the path", t, func() {
+		req, err := http.NewRequest("POST", "http://acme.example.com:8080/login", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("X-Tenant", "globex")
+
+		tenantId, err := TenantFromHost(".example.com")(req)
+		So(err, ShouldBeNil)
+		So(tenantId, ShouldEqual, "acme")
+
+		tenantId, err = TenantFromHeader("X-Tenant")(req)
+		So(err, ShouldBeNil)
+		So(tenantId, ShouldEqual, "globex")
+
+		_, err = TenantFromPathPrefix()(req)
+		So(err, ShouldBeNil)
+
+		req, err = http.NewRequest("POST", "http://example.com/initech/login", nil)
+		So(err, ShouldBeNil)
+
+		tenantId, err = TenantFromPathPrefix()(req)
+		So(err, ShouldBeNil)
+		So(tenantId, ShouldEqual, "initech")
+
+		_, err = TenantFromHost(".example.com")(req)
+		So(err, ShouldEqual, ErrNoTenant)
+		_, err = TenantFromHeader("X-Tenant")(req)
+		So(err, ShouldEqual, ErrNoTenant)
+
+		// the host has no case
+		req, err = http.NewRequest("POST", "http://ACME.Example.COM/login", nil)
+		So(err, ShouldBeNil)
+		tenantId, err = TenantFromHost(".example.com")(req)
+		So(err, ShouldBeNil)
+		So(tenantId, ShouldEqual, "acme")
+		tenantId, err = TenantFromHost(".EXAMPLE.com")(req)
+		So(err, ShouldBeNil)
+		So(tenantId, ShouldEqual, "acme")
+	})
+}
+
+func TestTenantAuthRoute(t *testing.T) {
+	Convey("The requests use the store of their tenant", t, func() {
+		db := newDB(t, "testHttpUsers.db")
+		defer db.Close()
+		deleteBucket(t, db, "tenants")
+
+		tenants, err := store.NewTenantBoltStore(db, "tenants", store.BoltOptions{})
+		So(err, ShouldBeNil)
+		acme, err := tenants.CreateTenant("acme")
+		So(err, ShouldBeNil)
+		globex, err := tenants.CreateTenant("globex")
+		So(err, ShouldBeNil)
+
+		_, err = acme.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		_, err = globex.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		route := NewTenantAuthRoute(tenants, TenantFromHeader("X-Tenant"), options)
+
+		tenantRequest := func(tenantId string, body interface{}) *http.Request {
+			req, err := httpRequest("POST", "http://testserver", body)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-Tenant", tenantId)
+			return req
+		}
+		credentials := map[string]string{"email": "ddhhpp@test.com", "password": "123456"}
+
+		w := httptest.NewRecorder()
+		route.Login(w, tenantRequest("acme", credentials))
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		var response map[string]string
+		_, err = responseToJson(w, &response)
+		So(err, ShouldBeNil)
+		token := response["token"]
+
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			So(GetTenantId(r), ShouldEqual, "acme")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		Convey("The token is valid for its tenant", func() {
+			req := tenantRequest("acme", nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			route.AuthMiddleware(w, req, handler)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("The token is not valid for other tenants", func() {
+			req := tenantRequest("globex", nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			route.AuthMiddleware(w, req, handler)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			req = tenantRequest("globex", nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			w = httptest.NewRecorder()
+			route.RefreshToken(w, req)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("An unknown tenant is not found", func() {
+			w := httptest.NewRecorder()
+			route.Login(w, tenantRequest("initech", credentials))
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+
+			w = httptest.NewRecorder()
+			route.Signin(w, tenantRequest("initech", credentials))
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("A request without tenant is a bad request", func() {
+			w := httptest.NewRecorder()
+			route.Login(w, tenantRequest("", credentials))
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	Convey("The route records the signins, logins and refreshes in the audit log", t, func() {
+		db, bs := initBoltStore(t)
+		defer db.Close()
+
+		db.Update(func(tx *bolt.Tx) error {
+			tx.DeleteBucket([]byte("audit"))
+			tx.DeleteBucket([]byte("audit.head"))
+			return nil
+		})
+		auditLog, err := audit.NewBoltLog(db, "audit")
+		So(err, ShouldBeNil)
+
+		route := NewAuthRoute(bs, options)
+		route.SetAuditLog(auditLog)
+
+		credentials := map[string]string{"email": "ddhhpp@test.com", "password": "12345678"}
+		req, err := httpRequest("POST", "http://testserver", credentials)
+		So(err, ShouldBeNil)
+		w := httptest.NewRecorder()
+		route.Signin(w, req)
+		So(w.Code, ShouldEqual, http.StatusCreated)
+
+		req, err = httpRequest("POST", "http://testserver", credentials)
+		So(err, ShouldBeNil)
+		w = httptest.NewRecorder()
+		route.Signin(w, req)
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+		req, err = httpRequest("POST", "http://login", map[string]string{"email": "ddhhpp@test.com", "password": "wrong"})
+		So(err, ShouldBeNil)
+		w = httptest.NewRecorder()
+		route.Login(w, req)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+		token := loginRequest(t, route, "ddhhpp@test.com", "12345678")
+
+		req, err = httpRequest("POST", "http://refresh", nil)
+		So(err, ShouldBeNil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		route.RefreshToken(w, req)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		events, err := auditLog.Query(audit.Query{})
+		So(err, ShouldBeNil)
+		So(len(events), ShouldEqual, 5)
+		So(events[0].Type, ShouldEqual, audit.EventSignin)
+		So(events[0].UserId, ShouldNotBeEmpty)
+		So(events[1].Type, ShouldEqual, audit.EventSigninFailed)
+		So(events[1].Reason, ShouldEqual, store.ErrEmailDuplication.Error())
+		So(events[2].Type, ShouldEqual, audit.EventLoginFailed)
+		So(events[2].Email, ShouldEqual, "ddhhpp@test.com")
+		So(events[3].Type, ShouldEqual, audit.EventLogin)
+		So(events[3].UserId, ShouldEqual, events[0].UserId)
+		So(events[4].Type, ShouldEqual, audit.EventRefreshToken)
+		So(events[4].UserId, ShouldEqual, events[0].UserId)
+
+		So(auditLog.Verify(), ShouldBeNil)
+	})
+}
+
 func loginRequest(t *testing.T, route *AuthRoute, email string, pass string) string {
 	w := httptest.NewRecorder()
 	req, err := httpRequest("POST", "http://login", map[string]string{
@@ -389,10 +923,12 @@ func initBoltStore(t *testing.T) (*bolt.DB, store.UserRepository) {
 
 func deleteBucket(t *testing.T, db *bolt.DB, bucket string) {
 	db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket([]byte(bucket))
-		if err != nil {
-			t.Errorf("Deleting bucket: %s", err)
-			return err
+		for _, name := range []string{bucket, bucket + ".email"} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				t.Errorf("Deleting bucket: %s", err)
+				return err
+			}
 		}
 		return nil
 	})
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The minimum scrypt parameters of the calibration, the ones of HashPassword
+const (
+	MinScryptN = 1 << 14
+	MinScryptR = 8
+	MinScryptP = 1
+)
+
+// The calibration does not go over this parallelization
+const maxScryptP = 16
+
+var ErrBelowFloor = errors.New("The parameters are below the minimum scrypt parameters")
+
+// The scrypt parameters found by CalibrateScrypt, they can be stored in the configuration
+// as JSON and used as the Hasher of the stores after checking them with Validate
+type ScryptCalibration struct {
+	Hasher ScryptHasher `json:"hasher"`
+	// The time of a hash with the parameters in the host of the calibration
+	Duration time.Duration `json:"duration"`
+}
+
+// Bytes of memory of a hash
+func (h ScryptHasher) Memory() int64 {
+	return scryptMemory(int64(h.N), int64(h.R), int64(h.P))
+}
+
+// Checks that the parameters are not below the minimum ones, for the parameters read from a configuration
+func (h ScryptHasher) Validate() error {
+	if h.N < 2 || h.N&(h.N-1) != 0 {
+		return fmt.Errorf("The scrypt N %d is not a power of 2", h.N)
+	}
+	if h.N < MinScryptN || h.R < MinScryptR || h.P < MinScryptP || h.keyLen() < 32 {
+		return ErrBelowFloor
+	}
+	return nil
+}
+
+// Finds the scrypt parameters of the hashes that take the target time in this host and use up to maxMemory bytes.
+// N grows in powers of 2 up to the target time or the memory, then the parallelization grows up to the target time.
+// The parameters are never below the minimum ones, even if the hashes take longer than the target time,
+// and it is an error when the memory of the minimum parameters is over maxMemory
+func CalibrateScrypt(target time.Duration, maxMemory int64) (ScryptCalibration, error) {
+	return calibrateScrypt(target, maxMemory, measureScrypt)
+}
+
+func calibrateScrypt(target time.Duration, maxMemory int64, measure func(ScryptHasher) (time.Duration, error)) (ScryptCalibration, error) {
+	// the hashes over the maximum memory are invalid
+	if maxMemory > maxScryptMemory {
+		maxMemory = maxScryptMemory
+	}
+	h := ScryptHasher{N: MinScryptN, R: MinScryptR, P: MinScryptP}
+	if h.Memory() > maxMemory {
+		return ScryptCalibration{}, fmt.Errorf("The memory of the minimum scrypt parameters is %d bytes, over %d", h.Memory(), maxMemory)
+	}
+	d, err := measure(h)
+	if err != nil {
+		return ScryptCalibration{}, err
+	}
+
+	for {
+		next := h
+		next.N *= 2
+		// the time grows linearly with N, so the hashes that would take too long are not measured
+		if next.Memory() > maxMemory || 2*d > target {
+			break
+		}
+		nd, err := measure(next)
+		if err != nil {
+			return ScryptCalibration{}, err
+		}
+		if nd > target {
+			break
+		}
+		h, d = next, nd
+	}
+
+	// the memory is the limit, the rest of the time is for more passes with the same memory.
+	// A hash faster than the clock takes no time, and any parallelization is in the target time
+	p := maxScryptP
+	if d > 0 && target/d < maxScryptP {
+		p = int(target / d)
+	}
+	if p > 1 {
+		next := h
+		next.P = p
+		if next.Memory() <= maxMemory {
+			nd, err := measure(next)
+			if err != nil {
+				return ScryptCalibration{}, err
+			}
+			if nd <= target {
+				h, d = next, nd
+			}
+		}
+	}
+	return ScryptCalibration{Hasher: h, Duration: d}, nil
+}
+
+// The fastest of a few hashes with the parameters
+func measureScrypt(h ScryptHasher) (time.Duration, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return 0, err
+	}
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		_, err := scrypt.Key([]byte("calibration"), salt, h.N, h.R, h.P, h.keyLen())
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Since(start); i == 0 || d < best {
+			best = d
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"encoding/json"
+	"math/bits"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A host where a hash takes a microsecond for every 1024 blocks of N, r and p
+func fakeMeasure(h ScryptHasher) (time.Duration, error) {
+	return time.Duration(h.N*h.R*h.P/1024) * time.Microsecond, nil
+}
+
+func TestCalibrateScrypt(t *testing.T) {
+	Convey("The calibration finds the parameters of the target time and memory", t, func() {
+		// N = 2^14 takes 128µs and 16MiB
+		c, err := calibrateScrypt(1024*time.Microsecond, 1<<30, fakeMeasure)
+		So(err, ShouldBeNil)
+		So(c.Hasher, ShouldResemble, ScryptHasher{N: 1 << 17, R: 8, P: 1})
+		So(c.Duration, ShouldEqual, 1024*time.Microsecond)
+
+		Convey("The memory limits N and the parallelization uses the rest of the time", func() {
+			c, err := calibrateScrypt(1024*time.Microsecond, 40<<20, fakeMeasure)
+			So(err, ShouldBeNil)
+			So(c.Hasher, ShouldResemble, ScryptHasher{N: 1 << 15, R: 8, P: 4})
+			So(c.Hasher.Memory(), ShouldBeLessThanOrEqualTo, 40<<20)
+			So(c.Duration, ShouldEqual, 1024*time.Microsecond)
+		})
+
+		Convey("The parameters are never below the minimum ones", func() {
+			c, err := calibrateScrypt(time.Microsecond, 1<<30, fakeMeasure)
+			So(err, ShouldBeNil)
+			So(c.Hasher, ShouldResemble, ScryptHasher{N: MinScryptN, R: MinScryptR, P: MinScryptP})
+			So(c.Hasher.Validate(), ShouldBeNil)
+
+			_, err = calibrateScrypt(1024*time.Microsecond, 1<<20, fakeMeasure)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The hashes faster than the clock are limited by the memory", func() {
+			zero := func(ScryptHasher) (time.Duration, error) { return 0, nil }
+			c, err := calibrateScrypt(time.Millisecond, 40<<20, zero)
+			So(err, ShouldBeNil)
+			So(c.Hasher, ShouldResemble, ScryptHasher{N: 1 << 15, R: 8, P: maxScryptP})
+			So(c.Duration, ShouldEqual, 0)
+		})
+
+		Convey("The parameters of the maximum memory are accepted by the hashes", func() {
+			zero := func(ScryptHasher) (time.Duration, error) { return 0, nil }
+			c, err := calibrateScrypt(time.Millisecond, 1<<40, zero)
+			So(err, ShouldBeNil)
+			So(c.Hasher.Memory(), ShouldBeLessThanOrEqualTo, maxScryptMemory)
+
+			p := phcHash{id: scryptId, params: map[string]string{
+				"ln": strconv.Itoa(bits.Len(uint(c.Hasher.N)) - 1),
+				"r":  strconv.Itoa(c.Hasher.R),
+				"p":  strconv.Itoa(c.Hasher.P),
+			}}
+			So(p.overMax(c.Hasher.keyLen()), ShouldBeFalse)
+			p.params["ln"] = strconv.Itoa(bits.Len(uint(c.Hasher.N)))
+			So(p.overMax(c.Hasher.keyLen()), ShouldBeTrue)
+		})
+	})
+
+	Convey("The calibration is stored as JSON and checked when it is read", t, func() {
+		c, err := CalibrateScrypt(time.Millisecond, 64<<20)
+		So(err, ShouldBeNil)
+		So(c.Hasher.Validate(), ShouldBeNil)
+
+		data, err := json.Marshal(c)
+		So(err, ShouldBeNil)
+		var read ScryptCalibration
+		So(json.Unmarshal(data, &read), ShouldBeNil)
+		So(read, ShouldResemble, c)
+
+		So(json.Unmarshal([]byte(`{"hasher": {"n": 1024, "r": 8, "p": 1}}`), &read), ShouldBeNil)
+		So(read.Hasher.Validate(), ShouldEqual, ErrBelowFloor)
+		So(ScryptHasher{N: 3000, R: 8, P: 1}.Validate(), ShouldNotBeNil)
+	})
+}
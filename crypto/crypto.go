@@ -8,6 +8,8 @@ import (
 	"golang.org/x/crypto/scrypt"
 )
 
+// The scrypt hash of the users stored before the PHC hashes of the Hashers,
+// the salt is kept apart and the parameters are always the same
 func HashPassword(pass string, salt []byte) ([]byte, error) {
 	return scrypt.Key([]byte(pass), salt, 16384, 8, 1, 128)
 }
@@ -0,0 +1,227 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPasswordMismatch = errors.New("The password does not match the hash")
+	ErrUnknownHash      = errors.New("Unknown password hash format")
+	ErrInvalidHash      = errors.New("The parameters of the password hash are over the maximum ones")
+)
+
+// Hashes the passwords with an algorithm and its parameters. The hashes are PHC strings,
+// $<algorithm>$<parameters>$<salt>$<hash>, so the parameters of every hash travel with it
+// and a hash is verified with its own parameters when the ones of the Hasher change.
+type Hasher interface {
+	// The hash of the password with a new random salt
+	Hash(pass string) (string, error)
+	// Checks the password against a hash of the algorithm of the Hasher,
+	// returns ErrPasswordMismatch when it is not the password of the hash
+	Verify(hash, pass string) error
+	// Whether the hash is weaker than the hashes of the Hasher: of another algorithm,
+	// with lower parameters or a shorter key. The stronger ones are kept
+	NeedsRehash(hash string) bool
+}
+
+// The Hasher of the new hashes when the stores have none, scrypt with the parameters of HashPassword
+var DefaultHasher Hasher = ScryptHasher{N: 16384, R: 8, P: 1}
+
+// The random salt of every hash
+const saltLength = 16
+
+// Checks the password against a hash of any of the supported algorithms:
+// scrypt, bcrypt, argon2id and PBKDF2-SHA256. The peppered hashes return ErrPepperedHash,
+// they are checked with the PepperedHasher of their pepper
+func VerifyPassword(hash, pass string) error {
+	h, err := hasherOf(hash)
+	if err != nil {
+		return err
+	}
+	return h.Verify(hash, pass)
+}
+
+// The algorithm of the hash, like "argon2id", empty when it is not a supported one.
+// The algorithm of a peppered hash is the one of the hash with the pepper
+func HashAlgorithm(hash string) string {
+	if _, inner, ok := splitPeppered(hash); ok {
+		hash = inner
+	}
+	if IsBcrypt(hash) {
+		return "bcrypt"
+	}
+	if _, err := hasherOf(hash); err != nil {
+		return ""
+	}
+	return strings.SplitN(hash[1:], "$", 2)[0]
+}
+
+// The Hasher of the algorithm of the hash, the parameters are the ones of the hash
+func hasherOf(hash string) (Hasher, error) {
+	if IsBcrypt(hash) {
+		return BcryptHasher{}, nil
+	}
+	if !strings.HasPrefix(hash, "$") {
+		return nil, ErrUnknownHash
+	}
+	switch strings.SplitN(hash[1:], "$", 2)[0] {
+	case scryptId:
+		return ScryptHasher{}, nil
+	case argon2Id:
+		return Argon2Hasher{}, nil
+	case pbkdf2Id:
+		return PBKDF2Hasher{}, nil
+	case "peppered":
+		return nil, ErrPepperedHash
+	}
+	return nil, ErrUnknownHash
+}
+
+// A hash in the PHC string format
+type phcHash struct {
+	id      string
+	version int
+	params  map[string]string
+	salt    []byte
+	hash    []byte
+}
+
+// The salt and the hash are in base64 without padding
+var phcEncoding = base64.RawStdEncoding
+
+func (p phcHash) String() string {
+	parts := []string{"", p.id}
+	if p.version != 0 {
+		parts = append(parts, "v="+strconv.Itoa(p.version))
+	}
+	var params []string
+	for _, name := range phcParams[p.id] {
+		params = append(params, name+"="+p.params[name])
+	}
+	parts = append(parts, strings.Join(params, ","), phcEncoding.EncodeToString(p.salt), phcEncoding.EncodeToString(p.hash))
+	return strings.Join(parts, "$")
+}
+
+// The parameters of the algorithms in the order they are written
+var phcParams = map[string][]string{
+	scryptId: {"ln", "r", "p"},
+	argon2Id: {"m", "t", "p"},
+	pbkdf2Id: {"i"},
+}
+
+// The maximum parameters of the hashes, the hashes over them are invalid,
+// so a stored hash can not make a login use all the memory or the CPU of the host
+var phcMaxParams = map[string]map[string]int{
+	scryptId: {"ln": 20, "r": 32, "p": maxScryptP},
+	argon2Id: {"m": 1 << 20, "t": 64, "p": 255},
+	pbkdf2Id: {"i": 10000000},
+}
+
+const (
+	// Bytes of the hashes
+	maxHashLength = 128
+	// Bytes of memory of the scrypt hashes, see scryptMemory
+	maxScryptMemory = 1 << 30
+)
+
+// Bytes of memory of a scrypt hash, the 128 * r * N of its table and the blocks of the p lanes
+func scryptMemory(n, r, p int64) int64 {
+	return 128 * r * (n + p + 2)
+}
+
+func parsePHC(hash, id string) (phcHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 5 || parts[0] != "" || parts[1] != id {
+		return phcHash{}, fmt.Errorf("Invalid %s hash", id)
+	}
+	p := phcHash{id: id, params: make(map[string]string)}
+
+	rest := parts[2:]
+	if strings.HasPrefix(rest[0], "v=") {
+		version, err := strconv.Atoi(rest[0][len("v="):])
+		if err != nil {
+			return phcHash{}, fmt.Errorf("Invalid %s hash version", id)
+		}
+		p.version = version
+		rest = rest[1:]
+	}
+	if len(rest) != 3 {
+		return phcHash{}, fmt.Errorf("Invalid %s hash", id)
+	}
+	for _, param := range strings.Split(rest[0], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return phcHash{}, fmt.Errorf("Invalid %s hash parameter %q", id, param)
+		}
+		p.params[kv[0]] = kv[1]
+	}
+
+	var err error
+	p.salt, err = phcEncoding.DecodeString(rest[1])
+	if err != nil {
+		return phcHash{}, fmt.Errorf("Invalid %s hash salt", id)
+	}
+	p.hash, err = phcEncoding.DecodeString(rest[2])
+	if err != nil || len(p.hash) == 0 {
+		return phcHash{}, fmt.Errorf("Invalid %s hash", id)
+	}
+	if p.overMax(len(p.hash)) {
+		return phcHash{}, ErrInvalidHash
+	}
+	return p, nil
+}
+
+// Whether a parameter of the hash, or the length of its key, is over the maximum
+func (p phcHash) overMax(keyLen int) bool {
+	for name, max := range phcMaxParams[p.id] {
+		n, err := strconv.Atoi(p.params[name])
+		if err == nil && n > max {
+			return true
+		}
+	}
+	if p.id == scryptId {
+		ln, errN := strconv.Atoi(p.params["ln"])
+		r, errR := strconv.Atoi(p.params["r"])
+		lanes, errP := strconv.Atoi(p.params["p"])
+		if errN == nil && errR == nil && errP == nil && ln >= 0 &&
+			scryptMemory(int64(1)<<uint(ln), int64(r), int64(lanes)) > maxScryptMemory {
+			return true
+		}
+	}
+	return keyLen > maxHashLength
+}
+
+// The positive integer parameter of the hash
+func (p phcHash) intParam(name string) (int, error) {
+	n, err := strconv.Atoi(p.params[name])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid %s hash parameter %s", p.id, name)
+	}
+	return n, nil
+}
+
+// Whether the parameter of the hash is lower than the value, or it is not valid
+func (p phcHash) below(name string, value int) bool {
+	n, err := p.intParam(name)
+	return err != nil || n < value
+}
+
+// Compares the hash of the password with the hash of the PHC string in constant time
+func (p phcHash) check(hash []byte) error {
+	if !SecureCompare(hash, p.hash) {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := GenerateRandomKey(saltLength)
+	if salt == nil {
+		return nil, errors.New("Generating the salt")
+	}
+	return salt, nil
+}
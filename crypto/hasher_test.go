@@ -0,0 +1,166 @@
+package crypto
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHashers(t *testing.T) {
+	Convey("The hashers hash the passwords in PHC strings and verify them", t, func() {
+		for _, h := range []Hasher{
+			ScryptHasher{N: 1024, R: 8, P: 1},
+			BcryptHasher{Cost: 4},
+			Argon2Hasher{Time: 1, Memory: 64, Threads: 1},
+			PBKDF2Hasher{Iterations: 1000},
+		} {
+			hash, err := h.Hash("password")
+			So(err, ShouldBeNil)
+			So(h.Verify(hash, "password"), ShouldBeNil)
+			So(h.Verify(hash, "other"), ShouldEqual, ErrPasswordMismatch)
+			So(VerifyPassword(hash, "password"), ShouldBeNil)
+			So(VerifyPassword(hash, "other"), ShouldEqual, ErrPasswordMismatch)
+
+			// every hash has its own salt
+			other, err := h.Hash("password")
+			So(err, ShouldBeNil)
+			So(other, ShouldNotEqual, hash)
+		}
+	})
+
+	Convey("The hashes are the ones of other implementations", t, func() {
+		hashes := []string{
+			// hashlib.scrypt of Python
+			"$scrypt$ln=10,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$BVMRKqdiVYikKAaPR1wucsKUKvw4TuPLkdEYtoSHas4",
+			// hashlib.pbkdf2_hmac of Python
+			"$pbkdf2-sha256$i=1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+			// test vector of the argon2 reference implementation
+			"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7",
+		}
+		for _, hash := range hashes {
+			So(VerifyPassword(hash, "password"), ShouldBeNil)
+			So(VerifyPassword(hash, "Password"), ShouldEqual, ErrPasswordMismatch)
+		}
+	})
+
+	Convey("The parameters are in the hashes", t, func() {
+		hash, err := ScryptHasher{N: 1024, R: 8, P: 2}.Hash("password")
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$scrypt$ln=10,r=8,p=2$")
+
+		hash, err = Argon2Hasher{Time: 2, Memory: 64, Threads: 1, KeyLen: 16}.Hash("password")
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$argon2id$v=19$m=64,t=2,p=1$")
+		p, err := parsePHC(hash, argon2Id)
+		So(err, ShouldBeNil)
+		So(len(p.hash), ShouldEqual, 16)
+		So(len(p.salt), ShouldEqual, saltLength)
+
+		_, err = ScryptHasher{N: 1000, R: 8, P: 1}.Hash("password")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("The unknown and malformed hashes are errors", t, func() {
+		for _, hash := range []string{
+			"",
+			"plain",
+			"$md5$abc$def",
+			"$scrypt$ln=10,r=8$c2FsdA$aGFzaA",
+			"$scrypt$ln=x,r=8,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=10,r=8,p=1$!!$aGFzaA",
+			"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$aGFzaA",
+			"$pbkdf2-sha256$i=1000$c2FsdA",
+		} {
+			err := VerifyPassword(hash, "password")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrPasswordMismatch)
+		}
+		So(VerifyPassword("plain", "plain"), ShouldEqual, ErrUnknownHash)
+	})
+
+	Convey("The hashes with parameters over the maximum ones are invalid", t, func() {
+		for _, hash := range []string{
+			"$scrypt$ln=21,r=8,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=40,r=8,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=20,r=16,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=10,r=64,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=10,r=8,p=1000$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=64,t=1000000,p=1$c2FsdA$aGFzaA",
+			"$pbkdf2-sha256$i=4000000000$c2FsdA$aGFzaA",
+			"$pbkdf2-sha256$i=1000$c2FsdA$" + phcEncoding.EncodeToString(make([]byte, 256)),
+			"$2a$31$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		} {
+			So(VerifyPassword(hash, "password"), ShouldEqual, ErrInvalidHash)
+		}
+		// the hashes of the limits are valid
+		So(VerifyPassword("$scrypt$ln=10,r=32,p=16$c2FsdA$aGFzaA", "password"), ShouldEqual, ErrPasswordMismatch)
+
+		_, err := ScryptHasher{N: 1 << 21, R: 8, P: 1}.Hash("password")
+		So(err, ShouldEqual, ErrInvalidHash)
+		_, err = Argon2Hasher{Time: 1, Memory: 1 << 21, Threads: 1}.Hash("password")
+		So(err, ShouldEqual, ErrInvalidHash)
+		_, err = PBKDF2Hasher{Iterations: 1000, KeyLen: 256}.Hash("password")
+		So(err, ShouldEqual, ErrInvalidHash)
+		_, err = BcryptHasher{Cost: 20}.Hash("password")
+		So(err, ShouldEqual, ErrInvalidHash)
+	})
+
+	Convey("The parameters of every hasher are stored as JSON", t, func() {
+		for _, h := range []interface{}{
+			&ScryptHasher{N: 1024, R: 8, P: 1},
+			&BcryptHasher{Cost: 4},
+			&Argon2Hasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 16},
+			&PBKDF2Hasher{Iterations: 1000},
+		} {
+			data, err := json.Marshal(h)
+			So(err, ShouldBeNil)
+			// the names are the snake case ones of the tags
+			So(string(data), ShouldEqual, strings.ToLower(string(data)))
+			read := reflect.New(reflect.TypeOf(h).Elem()).Interface()
+			So(json.Unmarshal(data, read), ShouldBeNil)
+			So(read, ShouldResemble, h)
+		}
+		data, err := json.Marshal(Argon2Hasher{Time: 1, Memory: 64, Threads: 1})
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"time":1,"memory":64,"threads":1}`)
+	})
+}
+
+func TestNeedsRehash(t *testing.T) {
+	Convey("The hashes of other algorithms and with lower parameters need a rehash", t, func() {
+		scryptHash, err := ScryptHasher{N: 1024, R: 8, P: 1}.Hash("password")
+		So(err, ShouldBeNil)
+		argonHash, err := Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.Hash("password")
+		So(err, ShouldBeNil)
+		bcryptHash, err := BcryptHasher{Cost: 4}.Hash("password")
+		So(err, ShouldBeNil)
+		pbkdf2Hash, err := PBKDF2Hasher{Iterations: 1000}.Hash("password")
+		So(err, ShouldBeNil)
+
+		So(ScryptHasher{N: 1024, R: 8, P: 1}.NeedsRehash(scryptHash), ShouldBeFalse)
+		So(ScryptHasher{N: 512, R: 8, P: 1}.NeedsRehash(scryptHash), ShouldBeFalse)
+		So(ScryptHasher{N: 2048, R: 8, P: 1}.NeedsRehash(scryptHash), ShouldBeTrue)
+		So(ScryptHasher{N: 1024, R: 8, P: 1, KeyLen: 64}.NeedsRehash(scryptHash), ShouldBeTrue)
+		So(ScryptHasher{N: 1024, R: 8, P: 1}.NeedsRehash(argonHash), ShouldBeTrue)
+
+		So(Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.NeedsRehash(argonHash), ShouldBeFalse)
+		So(Argon2Hasher{Time: 2, Memory: 64, Threads: 1}.NeedsRehash(argonHash), ShouldBeTrue)
+		So(Argon2Hasher{Time: 1, Memory: 128, Threads: 1}.NeedsRehash(argonHash), ShouldBeTrue)
+		So(Argon2Hasher{Time: 1, Memory: 64, Threads: 1}.NeedsRehash(scryptHash), ShouldBeTrue)
+
+		So(BcryptHasher{Cost: 4}.NeedsRehash(bcryptHash), ShouldBeFalse)
+		So(BcryptHasher{Cost: 5}.NeedsRehash(bcryptHash), ShouldBeTrue)
+		So(PBKDF2Hasher{Iterations: 1000}.NeedsRehash(pbkdf2Hash), ShouldBeFalse)
+		So(PBKDF2Hasher{Iterations: 2000}.NeedsRehash(pbkdf2Hash), ShouldBeTrue)
+		So(PBKDF2Hasher{Iterations: 1000}.NeedsRehash("plain"), ShouldBeTrue)
+
+		So(HashAlgorithm(scryptHash), ShouldEqual, "scrypt")
+		So(HashAlgorithm(bcryptHash), ShouldEqual, "bcrypt")
+		So(HashAlgorithm(pbkdf2Hash), ShouldEqual, "pbkdf2-sha256")
+		So(HashAlgorithm("plain"), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,276 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptId = "scrypt"
+	argon2Id = "argon2id"
+	pbkdf2Id = "pbkdf2-sha256"
+)
+
+// scrypt hashes, $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>
+type ScryptHasher struct {
+	// CPU and memory cost, a power of 2
+	N int `json:"n"`
+	// Block size
+	R int `json:"r"`
+	// Parallelization
+	P int `json:"p"`
+	// Bytes of the hash, 32 if it is not set
+	KeyLen int `json:"key_len,omitempty"`
+}
+
+func (h ScryptHasher) Hash(pass string) (string, error) {
+	if h.N < 2 || h.N&(h.N-1) != 0 {
+		return "", fmt.Errorf("The scrypt N %d is not a power of 2", h.N)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	p := phcHash{
+		id:     scryptId,
+		params: map[string]string{"ln": strconv.Itoa(bits.Len(uint(h.N)) - 1), "r": strconv.Itoa(h.R), "p": strconv.Itoa(h.P)},
+		salt:   salt,
+	}
+	if p.overMax(h.keyLen()) {
+		return "", ErrInvalidHash
+	}
+	p.hash, err = scrypt.Key([]byte(pass), salt, h.N, h.R, h.P, h.keyLen())
+	if err != nil {
+		return "", err
+	}
+	return p.String(), nil
+}
+
+func (h ScryptHasher) NeedsRehash(hash string) bool {
+	p, err := parsePHC(hash, scryptId)
+	if err != nil {
+		return true
+	}
+	return p.below("ln", bits.Len(uint(h.N))-1) || p.below("r", h.R) || p.below("p", h.P) || len(p.hash) < h.keyLen()
+}
+
+func (h ScryptHasher) keyLen() int {
+	if h.KeyLen == 0 {
+		return 32
+	}
+	return h.KeyLen
+}
+
+func (h ScryptHasher) Verify(hash, pass string) error {
+	p, err := parsePHC(hash, scryptId)
+	if err != nil {
+		return err
+	}
+	ln, err := p.intParam("ln")
+	if err != nil {
+		return err
+	}
+	r, err := p.intParam("r")
+	if err != nil {
+		return err
+	}
+	par, err := p.intParam("p")
+	if err != nil {
+		return err
+	}
+	key, err := scrypt.Key([]byte(pass), p.salt, 1<<uint(ln), r, par, len(p.hash))
+	if err != nil {
+		return err
+	}
+	return p.check(key)
+}
+
+// bcrypt hashes, in their own format $2a$<cost>$<salt and hash>, that also has the cost.
+// bcrypt only uses the first 72 bytes of the passwords
+type BcryptHasher struct {
+	// bcrypt.DefaultCost if it is not set
+	Cost int `json:"cost,omitempty"`
+}
+
+// The bcrypt hashes with a higher cost are invalid
+const maxBcryptCost = 16
+
+func (h BcryptHasher) Hash(pass string) (string, error) {
+	if h.cost() > maxBcryptCost {
+		return "", ErrInvalidHash
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), h.cost())
+	return string(hash), err
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	if !IsBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost()
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Verify(hash, pass string) error {
+	if !IsBcrypt(hash) {
+		return fmt.Errorf("Invalid bcrypt hash")
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err == nil && cost > maxBcryptCost {
+		return ErrInvalidHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+// Whether the hash is a bcrypt hash, of the $2a$, $2b$ or $2y$ variants
+func IsBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// argon2id hashes, $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+type Argon2Hasher struct {
+	// Passes over the memory
+	Time uint32 `json:"time"`
+	// Memory in KiB
+	Memory uint32 `json:"memory"`
+	// Threads
+	Threads uint8 `json:"threads"`
+	// Bytes of the hash, 32 if it is not set
+	KeyLen uint32 `json:"key_len,omitempty"`
+}
+
+func (h Argon2Hasher) Hash(pass string) (string, error) {
+	if h.Time < 1 || h.Threads < 1 || h.Memory < 8*uint32(h.Threads) {
+		return "", fmt.Errorf("Invalid argon2id parameters, time %d, memory %d, threads %d", h.Time, h.Memory, h.Threads)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	p := phcHash{
+		id:      argon2Id,
+		version: argon2.Version,
+		params: map[string]string{
+			"m": strconv.FormatUint(uint64(h.Memory), 10),
+			"t": strconv.FormatUint(uint64(h.Time), 10),
+			"p": strconv.FormatUint(uint64(h.Threads), 10),
+		},
+		salt: salt,
+	}
+	if p.overMax(int(h.keyLen())) {
+		return "", ErrInvalidHash
+	}
+	p.hash = argon2.IDKey([]byte(pass), salt, h.Time, h.Memory, h.Threads, h.keyLen())
+	return p.String(), nil
+}
+
+func (h Argon2Hasher) NeedsRehash(hash string) bool {
+	p, err := parsePHC(hash, argon2Id)
+	if err != nil || p.version != argon2.Version {
+		return true
+	}
+	return p.below("m", int(h.Memory)) || p.below("t", int(h.Time)) || p.below("p", int(h.Threads)) ||
+		len(p.hash) < int(h.keyLen())
+}
+
+func (h Argon2Hasher) keyLen() uint32 {
+	if h.KeyLen == 0 {
+		return 32
+	}
+	return h.KeyLen
+}
+
+func (h Argon2Hasher) Verify(hash, pass string) error {
+	p, err := parsePHC(hash, argon2Id)
+	if err != nil {
+		return err
+	}
+	if p.version != argon2.Version {
+		return fmt.Errorf("Unsupported argon2id version %d", p.version)
+	}
+	m, err := p.intParam("m")
+	if err != nil {
+		return err
+	}
+	t, err := p.intParam("t")
+	if err != nil {
+		return err
+	}
+	threads, err := p.intParam("p")
+	if err != nil || threads > 255 || m < 8*threads {
+		return fmt.Errorf("Invalid argon2id hash parameters")
+	}
+	return p.check(argon2.IDKey([]byte(pass), p.salt, uint32(t), uint32(m), uint8(threads), uint32(len(p.hash))))
+}
+
+// PBKDF2 with HMAC-SHA256 hashes, $pbkdf2-sha256$i=<iterations>$<salt>$<hash>
+type PBKDF2Hasher struct {
+	Iterations int `json:"iterations"`
+	// Bytes of the hash, 32 if it is not set
+	KeyLen int `json:"key_len,omitempty"`
+}
+
+func (h PBKDF2Hasher) Hash(pass string) (string, error) {
+	if h.Iterations < 1 {
+		return "", fmt.Errorf("Invalid PBKDF2 iterations %d", h.Iterations)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	p := phcHash{
+		id:     pbkdf2Id,
+		params: map[string]string{"i": strconv.Itoa(h.Iterations)},
+		salt:   salt,
+	}
+	if p.overMax(h.keyLen()) {
+		return "", ErrInvalidHash
+	}
+	p.hash = pbkdf2.Key([]byte(pass), salt, h.Iterations, h.keyLen(), sha256.New)
+	return p.String(), nil
+}
+
+func (h PBKDF2Hasher) NeedsRehash(hash string) bool {
+	p, err := parsePHC(hash, pbkdf2Id)
+	if err != nil {
+		return true
+	}
+	return p.below("i", h.Iterations) || len(p.hash) < h.keyLen()
+}
+
+func (h PBKDF2Hasher) keyLen() int {
+	if h.KeyLen == 0 {
+		return 32
+	}
+	return h.KeyLen
+}
+
+func (h PBKDF2Hasher) Verify(hash, pass string) error {
+	p, err := parsePHC(hash, pbkdf2Id)
+	if err != nil {
+		return err
+	}
+	i, err := p.intParam("i")
+	if err != nil {
+		return err
+	}
+	return p.check(pbkdf2.Key([]byte(pass), p.salt, i, len(p.hash), sha256.New))
+}
@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrPepperedHash  = errors.New("The hash is peppered, it is verified with the pepper")
+	ErrUnknownPepper = errors.New("Unknown pepper key")
+)
+
+const pepperPrefix = "$peppered$k="
+
+// Secret keys of the pepper of the passwords, kept outside of the database.
+// The new hashes use the current key, and the old ones verify the hashes made with them
+type Pepper struct {
+	currentId string
+	keys      map[string][]byte
+}
+
+// The keys by their id, of at least 32 bytes, the ids are letters, digits, - and _
+func NewPepper(currentId string, keys map[string][]byte) (*Pepper, error) {
+	if _, ok := keys[currentId]; !ok {
+		return nil, fmt.Errorf("The current pepper key %q is not in the keys", currentId)
+	}
+	p := &Pepper{currentId: currentId, keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		if !validPepperId(id) {
+			return nil, fmt.Errorf("Invalid pepper key id %q", id)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("The pepper key %q has less than 32 bytes", id)
+		}
+		p.keys[id] = key
+	}
+	return p, nil
+}
+
+// The id of the key of the new hashes
+func (p *Pepper) KeyId() string {
+	return p.currentId
+}
+
+// HMAC-SHA256 of the password with the key, in base64 so the password of the hasher is text
+// and it fits in the 72 bytes of bcrypt
+func (p *Pepper) mix(keyId, pass string) (string, error) {
+	key, ok := p.keys[keyId]
+	if !ok {
+		return "", ErrUnknownPepper
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pass))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func validPepperId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Hasher of the passwords mixed with a pepper before they are hashed with another Hasher.
+// The hashes are $peppered$k=<key id> followed by the hash of the other Hasher
+type PepperedHasher struct {
+	Hasher Hasher
+	Pepper *Pepper
+}
+
+func (h PepperedHasher) Hash(pass string) (string, error) {
+	peppered, err := h.Pepper.mix(h.Pepper.currentId, pass)
+	if err != nil {
+		return "", err
+	}
+	hash, err := h.Hasher.Hash(peppered)
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + h.Pepper.currentId + hash, nil
+}
+
+// Checks the peppered hashes of any key of the pepper, and the hashes without pepper of any algorithm
+func (h PepperedHasher) Verify(hash, pass string) error {
+	keyId, inner, ok := splitPeppered(hash)
+	if !ok {
+		return VerifyPassword(hash, pass)
+	}
+	peppered, err := h.Pepper.mix(keyId, pass)
+	if err != nil {
+		return err
+	}
+	return VerifyPassword(inner, peppered)
+}
+
+// The hashes without pepper and the ones of an old key need a rehash
+func (h PepperedHasher) NeedsRehash(hash string) bool {
+	keyId, inner, ok := splitPeppered(hash)
+	if !ok || keyId != h.Pepper.currentId {
+		return true
+	}
+	return h.Hasher.NeedsRehash(inner)
+}
+
+// Whether the hash has a pepper, and the id of its key
+func PepperKeyId(hash string) (string, bool) {
+	keyId, _, ok := splitPeppered(hash)
+	return keyId, ok
+}
+
+// The key id and the hash of the other Hasher of a peppered hash
+func splitPeppered(hash string) (string, string, bool) {
+	if !strings.HasPrefix(hash, pepperPrefix) {
+		return "", "", false
+	}
+	rest := hash[len(pepperPrefix):]
+	i := strings.Index(rest, "$")
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i:], true
+}
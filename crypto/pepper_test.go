@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPepperedHasher(t *testing.T) {
+	key1 := []byte("first pepper key of 32 bytes....")
+	key2 := []byte("second pepper key of 32 bytes...")
+
+	Convey("The passwords are mixed with the pepper before they are hashed", t, func() {
+		pepper, err := NewPepper("k1", map[string][]byte{"k1": key1})
+		So(err, ShouldBeNil)
+		h := PepperedHasher{Hasher: ScryptHasher{N: 1024, R: 8, P: 1}, Pepper: pepper}
+
+		hash, err := h.Hash("password")
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$peppered$k=k1$scrypt$ln=10,r=8,p=1$")
+		So(h.Verify(hash, "password"), ShouldBeNil)
+		So(h.Verify(hash, "other"), ShouldEqual, ErrPasswordMismatch)
+		So(h.NeedsRehash(hash), ShouldBeFalse)
+		So(HashAlgorithm(hash), ShouldEqual, "scrypt")
+		keyId, ok := PepperKeyId(hash)
+		So(ok, ShouldBeTrue)
+		So(keyId, ShouldEqual, "k1")
+
+		// without the pepper the hash is not verified
+		So(VerifyPassword(hash, "password"), ShouldEqual, ErrPepperedHash)
+		_, inner, _ := splitPeppered(hash)
+		So(VerifyPassword(inner, "password"), ShouldEqual, ErrPasswordMismatch)
+
+		// the hashes without pepper are verified, and hashed again with it
+		plain, err := ScryptHasher{N: 1024, R: 8, P: 1}.Hash("password")
+		So(err, ShouldBeNil)
+		So(h.Verify(plain, "password"), ShouldBeNil)
+		So(h.NeedsRehash(plain), ShouldBeTrue)
+
+		Convey("The old keys verify the hashes after a rotation", func() {
+			rotated, err := NewPepper("k2", map[string][]byte{"k1": key1, "k2": key2})
+			So(err, ShouldBeNil)
+			h2 := PepperedHasher{Hasher: ScryptHasher{N: 1024, R: 8, P: 1}, Pepper: rotated}
+			So(h2.Verify(hash, "password"), ShouldBeNil)
+			So(h2.NeedsRehash(hash), ShouldBeTrue)
+
+			hash2, err := h2.Hash("password")
+			So(err, ShouldBeNil)
+			So(hash2, ShouldStartWith, "$peppered$k=k2$")
+			So(h2.NeedsRehash(hash2), ShouldBeFalse)
+
+			// the key of the hash is gone
+			So(h.Verify(hash2, "password"), ShouldEqual, ErrUnknownPepper)
+		})
+	})
+
+	Convey("The keys of the pepper are checked", t, func() {
+		_, err := NewPepper("k2", map[string][]byte{"k1": key1})
+		So(err, ShouldNotBeNil)
+		_, err = NewPepper("k1", map[string][]byte{"k1": []byte("short")})
+		So(err, ShouldNotBeNil)
+		_, err = NewPepper("k$1", map[string][]byte{"k$1": key1})
+		So(err, ShouldNotBeNil)
+
+		pepper, err := NewPepper("k1", map[string][]byte{"k1": key1})
+		So(err, ShouldBeNil)
+		So(pepper.KeyId(), ShouldEqual, "k1")
+		mixed, err := pepper.mix("k1", strings.Repeat("long password ", 10))
+		So(err, ShouldBeNil)
+		So(len(mixed), ShouldBeLessThanOrEqualTo, 72)
+	})
+}
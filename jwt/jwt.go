@@ -1,6 +1,7 @@
 package jwt
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/http"
@@ -15,10 +16,14 @@ var (
 	ErrTokenValidation = errors.New("JWT Token ValidationError")
 	ErrTokenParse      = errors.New("JWT Token Error Parsing the token or empty token")
 	ErrTokenInvalid    = errors.New("JWT Token is not Valid")
+	ErrTenantToken     = errors.New("JWT Token is for a tenant")
 
 	logOn = true
 )
 
+// Claim with the tenant of the user, in the tokens of the users of a tenant
+const TenantClaim = "tid"
+
 type Options struct {
 	SigningMethod string
 	PublicKey     string
@@ -32,6 +37,24 @@ type Options struct {
 //
 // In case you use an symmetric-key algorithm set PublicKey and PrivateKey equal to the SecretKey ,
 func GenerateJWTToken(userId string, op Options) (string, error) {
+	return GenerateJWTTokenContext(context.Background(), userId, op)
+}
+
+// Like GenerateJWTToken, the token is not generated when the context is done
+func GenerateJWTTokenContext(ctx context.Context, userId string, op Options) (string, error) {
+	return generateToken(ctx, userId, nil, op)
+}
+
+// Generates the token of a user of a tenant, with the tenant in the TenantClaim
+func GenerateTenantJWTTokenContext(ctx context.Context, userId, tenantId string, op Options) (string, error) {
+	return generateToken(ctx, userId, map[string]interface{}{TenantClaim: tenantId}, op)
+}
+
+func generateToken(ctx context.Context, userId string, claims map[string]interface{}, op Options) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	t := jwt.New(jwt.GetSigningMethod(op.SigningMethod))
 
 	now := time.Now()
@@ -40,6 +63,9 @@ func GenerateJWTToken(userId string, op Options) (string, error) {
 	t.Claims["exp"] = now.Add(op.Expiration).Unix()
 	t.Claims["sub"] = userId
 	t.Claims["jti"] = crypto.GenerateRandomKey(32)
+	for name, value := range claims {
+		t.Claims[name] = value
+	}
 
 	tokenString, err := t.SignedString([]byte(op.PrivateKey))
 	if err != nil {
@@ -54,6 +80,42 @@ func GenerateJWTToken(userId string, op Options) (string, error) {
 //
 // Returns the userId, token (base64 encoded), error
 func ValidateToken(r *http.Request, publicKey string) (string, string, error) {
+	return ValidateTokenContext(context.Background(), r, publicKey)
+}
+
+// Like ValidateToken, the token is not validated when the context is done.
+// The tokens of the users of a tenant are ErrTenantToken, see ValidateTenantTokenContext
+func ValidateTokenContext(ctx context.Context, r *http.Request, publicKey string) (string, string, error) {
+	token, err := validateToken(ctx, r, publicKey)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := token.Claims[TenantClaim]; ok {
+		return "", "", ErrTenantToken
+	}
+	return token.Claims["sub"].(string), token.Raw, nil
+}
+
+// Validates the token of a user of a tenant
+//
+// Returns the userId, tenantId, token (base64 encoded), error
+func ValidateTenantTokenContext(ctx context.Context, r *http.Request, publicKey string) (string, string, string, error) {
+	token, err := validateToken(ctx, r, publicKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	tenantId, ok := token.Claims[TenantClaim].(string)
+	if !ok {
+		return "", "", "", ErrTokenInvalid
+	}
+	return token.Claims["sub"].(string), tenantId, token.Raw, nil
+}
+
+func validateToken(ctx context.Context, r *http.Request, publicKey string) (*jwt.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	token, err := jwt.ParseFromRequest(r, func(token *jwt.Token) (interface{}, error) {
 		return []byte(publicKey), nil
 	})
@@ -66,24 +128,25 @@ func ValidateToken(r *http.Request, publicKey string) (string, string, error) {
 			switch vErr.Errors {
 			case jwt.ValidationErrorExpired:
 				logError("ERROR: JWT Token Expired: %+v\n", vErr.Errors)
-				return "", "", ErrTokenExpired
+				return nil, ErrTokenExpired
 			default:
 				logError("ERROR: JWT Token ValidationError: %+v\n", vErr.Errors)
-				return "", "", ErrTokenValidation
+				return nil, ErrTokenValidation
 			}
 		}
 		logError("ERROR: Token parse error: %v\n", err)
-		return "", "", ErrTokenParse
+		return nil, ErrTokenParse
 	}
 
 	if !token.Valid {
-		return "", "", ErrTokenInvalid
+		return nil, ErrTokenInvalid
 	}
 
 	// otherwise is a valid token
-	userId := token.Claims["sub"].(string)
-
-	return userId, token.Raw, nil
+	if _, ok := token.Claims["sub"].(string); !ok {
+		return nil, ErrTokenInvalid
+	}
+	return token, nil
 
 }
 
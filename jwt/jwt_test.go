@@ -1,6 +1,7 @@
 package jwt
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -57,6 +58,76 @@ func TestGenerateToken(t *testing.T) {
 	})
 }
 
+func TestTokenCancelledContext(t *testing.T) {
+	Convey("The token is not generated or validated when the context is done", t, func() {
+		op := Options{
+			SigningMethod: "RS256",
+			PublicKey:     Public,
+			PrivateKey:    Private,
+			Expiration:    3 * time.Minute,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := GenerateJWTTokenContext(ctx, "ddhhpp@test.com", op)
+		So(err, ShouldEqual, context.Canceled)
+
+		token, err := GenerateJWTToken("ddhhpp@test.com", op)
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("GET", "http://testserver", nil)
+		So(err, ShouldBeNil)
+		req.Header.Add("Authorization", "Bearer "+token)
+
+		_, _, err = ValidateTokenContext(ctx, req, Public)
+		So(err, ShouldEqual, context.Canceled)
+
+		userId, _, err := ValidateTokenContext(context.Background(), req, Public)
+		So(err, ShouldBeNil)
+		So(userId, ShouldEqual, "ddhhpp@test.com")
+	})
+}
+
+func TestTenantToken(t *testing.T) {
+	Convey("The token of a user of a tenant has the tenant", t, func() {
+		op := Options{
+			SigningMethod: "RS256",
+			PublicKey:     Public,
+			PrivateKey:    Private,
+			Expiration:    3 * time.Minute,
+		}
+
+		token, err := GenerateTenantJWTTokenContext(context.Background(), "ddhhpp@test.com", "acme", op)
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("GET", "http://testserver", nil)
+		So(err, ShouldBeNil)
+		req.Header.Add("Authorization", "Bearer "+token)
+
+		userId, tenantId, rawToken, err := ValidateTenantTokenContext(context.Background(), req, Public)
+		So(err, ShouldBeNil)
+		So(userId, ShouldEqual, "ddhhpp@test.com")
+		So(tenantId, ShouldEqual, "acme")
+		So(rawToken, ShouldEqual, token)
+
+		_, _, err = ValidateTokenContext(context.Background(), req, Public)
+		So(err, ShouldEqual, ErrTenantToken)
+
+		Convey("A token without tenant is not a token of a tenant", func() {
+			token, err := GenerateJWTToken("ddhhpp@test.com", op)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest("GET", "http://testserver", nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			_, _, _, err = ValidateTenantTokenContext(context.Background(), req, Public)
+			So(err, ShouldEqual, ErrTokenInvalid)
+		})
+	})
+}
+
 func TestInvalidToken(t *testing.T) {
 	Convey("Validate an invalid token returns an error", t, func() {
 
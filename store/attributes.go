@@ -0,0 +1,216 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Profile attributes of the user, like the display name or the locale.
+// The values are strings, numbers, booleans or lists of strings, and they are stored as JSON,
+// so the numbers are read back as float64 and the lists as []interface{}, use the typed getters to read them.
+type Attributes map[string]interface{}
+
+func (a Attributes) String(name string) (string, bool) {
+	v, ok := a[name].(string)
+	return v, ok
+}
+
+func (a Attributes) Bool(name string) (bool, bool) {
+	v, ok := a[name].(bool)
+	return v, ok
+}
+
+func (a Attributes) Number(name string) (float64, bool) {
+	switch v := a[name].(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// The lists are []string, or []interface{} of strings when they are read back from JSON
+func (a Attributes) Strings(name string) ([]string, bool) {
+	return stringList(a[name])
+}
+
+func stringList(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		list := make([]string, len(v))
+		for i := range v {
+			s, ok := v[i].(string)
+			if !ok {
+				return nil, false
+			}
+			list[i] = s
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// Only the numbers without decimals are ints
+func (a Attributes) Int(name string) (int64, bool) {
+	switch v := a[name].(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	}
+	f, ok := a.Number(name)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+type AttributeType int
+
+const (
+	StringAttribute AttributeType = iota + 1
+	NumberAttribute
+	BoolAttribute
+	StringListAttribute
+)
+
+func (t AttributeType) String() string {
+	switch t {
+	case StringAttribute:
+		return "string"
+	case NumberAttribute:
+		return "number"
+	case BoolAttribute:
+		return "bool"
+	case StringListAttribute:
+		return "list of strings"
+	}
+	return "unknown"
+}
+
+type AttributeRule struct {
+	Type     AttributeType
+	Required bool
+	// Maximum length of a string, or of every string of a list, no limit when it is 0
+	MaxLength int
+}
+
+// The attributes allowed for the users by name, when a store has a schema
+// the attributes that are not in the schema are rejected
+type AttributeSchema map[string]AttributeRule
+
+// The attribute is not valid for the schema, or its value is not a string, a number, a boolean or a list of strings
+type AttributeError struct {
+	Name   string
+	Reason string
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("Invalid attribute %q: %s", e.Name, e.Reason)
+}
+
+func (s AttributeSchema) Validate(attrs Attributes) error {
+	for name, rule := range s {
+		if _, ok := attrs[name]; !ok && rule.Required {
+			return &AttributeError{name, "it is required"}
+		}
+	}
+
+	for name, value := range attrs {
+		rule, ok := s[name]
+		if !ok {
+			return &AttributeError{name, "it is not in the schema"}
+		}
+		if attributeType(value) != rule.Type {
+			return &AttributeError{name, "it must be a " + rule.Type.String()}
+		}
+		if rule.MaxLength == 0 {
+			continue
+		}
+		values, _ := stringList(value)
+		if v, ok := value.(string); ok {
+			values = []string{v}
+		}
+		for _, v := range values {
+			if len([]rune(v)) > rule.MaxLength {
+				return &AttributeError{name, fmt.Sprintf("it is longer than %d characters", rule.MaxLength)}
+			}
+		}
+	}
+	return nil
+}
+
+func attributeType(value interface{}) AttributeType {
+	switch value.(type) {
+	case string:
+		return StringAttribute
+	case float64, float32, int, int64, int32:
+		return NumberAttribute
+	case bool:
+		return BoolAttribute
+	case []string, []interface{}:
+		if _, ok := stringList(value); ok {
+			return StringListAttribute
+		}
+	}
+	return 0
+}
+
+// Checks the values of the attributes, and the schema if there is one
+func validateAttributes(schema AttributeSchema, attrs Attributes) error {
+	for name, value := range attrs {
+		if attributeType(value) == 0 {
+			return &AttributeError{name, "it must be a string, a number, a bool or a list of strings"}
+		}
+	}
+	if schema == nil {
+		return nil
+	}
+	return schema.Validate(attrs)
+}
+
+// The attributes with the update applied, a nil value in the update removes the attribute
+func mergeAttributes(current, update Attributes) Attributes {
+	merged := make(Attributes, len(current)+len(update))
+	for name, value := range current {
+		merged[name] = value
+	}
+	for name, value := range update {
+		if value == nil {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = value
+	}
+	return merged
+}
+
+// For the stores that keep the attributes as a JSON text
+func marshalAttributes(attrs Attributes) (string, error) {
+	if len(attrs) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(attrs)
+	return string(b), err
+}
+
+func unmarshalAttributes(s string) (Attributes, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var attrs Attributes
+	err := json.Unmarshal([]byte(s), &attrs)
+	return attrs, err
+}
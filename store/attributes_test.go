@@ -0,0 +1,146 @@
+package store
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttributesGetters(t *testing.T) {
+	Convey("Reads the attributes by type", t, func() {
+		attrs := Attributes{"name": "David", "age": float64(33), "height": 1.8, "count": 3, "admin": false}
+
+		name, ok := attrs.String("name")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "David")
+
+		_, ok = attrs.String("age")
+		So(ok, ShouldBeFalse)
+
+		age, ok := attrs.Int("age")
+		So(ok, ShouldBeTrue)
+		So(age, ShouldEqual, 33)
+
+		count, ok := attrs.Int("count")
+		So(ok, ShouldBeTrue)
+		So(count, ShouldEqual, 3)
+
+		_, ok = attrs.Int("height")
+		So(ok, ShouldBeFalse)
+
+		height, ok := attrs.Number("height")
+		So(ok, ShouldBeTrue)
+		So(height, ShouldEqual, 1.8)
+
+		admin, ok := attrs.Bool("admin")
+		So(ok, ShouldBeTrue)
+		So(admin, ShouldBeFalse)
+
+		_, ok = attrs.Bool("missing")
+		So(ok, ShouldBeFalse)
+
+		lists := Attributes{"phones": []string{"1234"}, "groups": []interface{}{"admins", "devs"}, "mixed": []interface{}{"a", 1}}
+		phones, ok := lists.Strings("phones")
+		So(ok, ShouldBeTrue)
+		So(phones, ShouldResemble, []string{"1234"})
+		groups, ok := lists.Strings("groups")
+		So(ok, ShouldBeTrue)
+		So(groups, ShouldResemble, []string{"admins", "devs"})
+		_, ok = lists.Strings("mixed")
+		So(ok, ShouldBeFalse)
+		_, ok = attrs.Strings("name")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestAttributeSchema(t *testing.T) {
+	Convey("Validates the attributes with the schema", t, func() {
+		schema := AttributeSchema{
+			"name":   {Type: StringAttribute, Required: true, MaxLength: 5},
+			"age":    {Type: NumberAttribute},
+			"public": {Type: BoolAttribute},
+			"groups": {Type: StringListAttribute, MaxLength: 6},
+		}
+
+		So(schema.Validate(Attributes{"name": "David", "age": 33, "public": true}), ShouldBeNil)
+		So(schema.Validate(Attributes{"name": "David"}), ShouldBeNil)
+
+		err := schema.Validate(Attributes{"age": 33})
+		So(err, ShouldResemble, &AttributeError{"name", "it is required"})
+
+		err = schema.Validate(Attributes{"name": "Davidson"})
+		So(err, ShouldResemble, &AttributeError{"name", "it is longer than 5 characters"})
+
+		err = schema.Validate(Attributes{"name": "David", "age": "33"})
+		So(err, ShouldResemble, &AttributeError{"age", "it must be a number"})
+
+		err = schema.Validate(Attributes{"name": "David", "locale": "en"})
+		So(err, ShouldResemble, &AttributeError{"locale", "it is not in the schema"})
+		So(err.Error(), ShouldEqual, `Invalid attribute "locale": it is not in the schema`)
+
+		So(schema.Validate(Attributes{"name": "David", "groups": []string{"admins"}}), ShouldBeNil)
+		So(schema.Validate(Attributes{"name": "David", "groups": []interface{}{"admins", "devs"}}), ShouldBeNil)
+		err = schema.Validate(Attributes{"name": "David", "groups": []string{"admins", "developers"}})
+		So(err, ShouldResemble, &AttributeError{"groups", "it is longer than 6 characters"})
+		err = schema.Validate(Attributes{"name": "David", "groups": "admins"})
+		So(err, ShouldResemble, &AttributeError{"groups", "it must be a list of strings"})
+	})
+
+	Convey("The values are strings, numbers, booleans or lists of strings", t, func() {
+		So(validateAttributes(nil, Attributes{"name": "David", "age": 33, "public": true, "groups": []string{"admins"}}), ShouldBeNil)
+		So(validateAttributes(nil, Attributes{"groups": []interface{}{"admins", "devs"}}), ShouldBeNil)
+
+		reason := "it must be a string, a number, a bool or a list of strings"
+		So(validateAttributes(nil, Attributes{"groups": []interface{}{"admins", 1}}), ShouldResemble, &AttributeError{"groups", reason})
+		So(validateAttributes(nil, Attributes{"address": map[string]interface{}{"city": "Madrid"}}), ShouldResemble, &AttributeError{"address", reason})
+	})
+}
+
+func TestAttributeSchemaInBolt(t *testing.T) {
+	Convey("Bolt validates the attributes with the schema on signin and updates", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketAttrs"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{
+			AttributeSchema: AttributeSchema{
+				"name": {Type: StringAttribute, Required: true},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		_, err = bs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldResemble, &AttributeError{"name", "it is required"})
+
+		id, err := bs.SigninWithAttributes("ddhhpp@test.com", "123456", Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+
+		err = bs.UpdateAttributes(id, Attributes{"name": nil})
+		So(err, ShouldResemble, &AttributeError{"name", "it is required"})
+
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Attributes, ShouldResemble, Attributes{"name": "David"})
+	})
+
+	Convey("Bolt reads back the lists of strings", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketAttrs"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		id, err := bs.SigninWithAttributes("ddhhpp@test.com", "123456", Attributes{"groups": []string{"admins", "devs"}})
+		So(err, ShouldBeNil)
+		// the lists are read back from JSON as []interface{}
+		So(bs.UpdateAttributes(id, Attributes{"name": "David"}), ShouldBeNil)
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		groups, ok := user.Attributes.Strings("groups")
+		So(ok, ShouldBeTrue)
+		So(groups, ShouldResemble, []string{"admins", "devs"})
+	})
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// How Import restores the users in the store
+type RestoreMode int
+
+const (
+	// Adds the users, the ones with the same id are replaced and the rest are kept
+	RestoreMerge RestoreMode = iota
+	// Removes all the users of the store before adding them
+	RestoreReplace
+)
+
+// Writes a consistent snapshot of the whole Bolt database while the store is in use,
+// it is read in a transaction so the writes are not blocked. The snapshot is a Bolt
+// file that can be opened as it is.
+func (bs *BoltStore) Backup(w io.Writer) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Copy(w)
+	})
+}
+
+// Writes the users as JSON Lines, one record like the ones stored per line,
+// with the hashed passwords, so they can be imported in another store.
+// The users are read in a transaction, so the export is consistent.
+// The users of the stores with Encryption are exported decrypted, keep the export safe.
+// Returns the number of users exported.
+func (bs *BoltStore) Export(w io.Writer) (int, error) {
+	exported := 0
+	err := bs.view(context.Background(), func(tx *bolt.Tx) error {
+		return bs.parent(tx).Bucket(bs.bucket).ForEach(func(k, v []byte) error {
+			user, _, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			line, err := encodeUser(user)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(line, '\n'))
+			if err != nil {
+				return err
+			}
+			exported++
+			return nil
+		})
+	})
+	return exported, err
+}
+
+// Imports the users exported with Export, in one transaction, so nothing
+// is imported if there is an error. The emails are stored as they are in the export,
+// and a user with an email of a different user is an ErrEmailDuplication.
+// The users imported in the store of a tenant are users of the tenant.
+// Returns the number of users imported.
+func (bs *BoltStore) Import(r io.Reader, mode RestoreMode) (int, error) {
+	var users []User
+	dec := json.NewDecoder(r)
+	for {
+		var env recordEnvelope
+		err := dec.Decode(&env)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Importing user %d: %s", len(users)+1, err)
+		}
+		user, err := decodeImported(env)
+		if err != nil {
+			return 0, fmt.Errorf("Importing user %d: %s", len(users)+1, err)
+		}
+		users = append(users, user)
+	}
+
+	err := bs.update(context.Background(), func(tx *bolt.Tx) error {
+		if mode == RestoreReplace {
+			err := bs.deleteBuckets(tx)
+			if err != nil {
+				return err
+			}
+		}
+		b := bs.parent(tx).Bucket(bs.bucket)
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+
+		for i, user := range users {
+			user.TenantId = bs.tenant
+			if id := idx.Get(bs.emailKey(user.Email)); id != nil && string(id) != user.Id {
+				return fmt.Errorf("Importing user %d: %s", i+1, ErrEmailDuplication)
+			}
+
+			// the user replaced can have a different email
+			old, err := bs.getUser(b, user.Id)
+			if err == nil && old.Email != user.Email {
+				err = idx.Delete(bs.emailKey(old.Email))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = bs.putUser(b, user)
+			if err != nil {
+				return err
+			}
+			err = idx.Put(bs.emailKey(user.Email), []byte(user.Id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+	return len(users), nil
+}
+
+func decodeImported(env recordEnvelope) (User, error) {
+	if env.Version == 0 {
+		return User{}, fmt.Errorf("The record has no version")
+	}
+	user, _, err := decodeEnvelope(env, nil)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Id == "" || user.Email == "" {
+		return User{}, fmt.Errorf("The record has no id or email")
+	}
+	return user, nil
+}
+
+// Empties the store, deleting and creating again the buckets
+func (bs *BoltStore) deleteBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bs.bucket, bs.emailBucket} {
+		err := bs.parent(tx).DeleteBucket(name)
+		if err != nil {
+			return err
+		}
+		_, err = bs.parent(tx).CreateBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
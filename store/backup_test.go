@@ -0,0 +1,147 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackup(t *testing.T) {
+	Convey("Backup writes a snapshot that is a Bolt database", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketBackup"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		id, err := bs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		dir, err := ioutil.TempDir("", "authbackup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "backup.db")
+		f, err := os.Create(path)
+		So(err, ShouldBeNil)
+		err = bs.Backup(f)
+		f.Close()
+		So(err, ShouldBeNil)
+
+		backup, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		So(err, ShouldBeNil)
+		defer backup.Close()
+
+		restored, err := NewBoltStore(backup, bucket)
+		So(err, ShouldBeNil)
+
+		loginId, err := restored.Login("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	Convey("The users are exported and imported as JSON Lines with the hashed passwords", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		DeleteBucket(t, db, "testBucketExport")
+		DeleteBucket(t, db, "testBucketImport")
+		bs, err := NewBoltStore(db, "testBucketExport")
+		So(err, ShouldBeNil)
+		other, err := NewBoltStore(db, "testBucketImport")
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := bs.SigninWithAttributes("ddhhpp@test.com", pass, Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+		disabled, err := bs.Signin("disabled@test.com", pass)
+		So(err, ShouldBeNil)
+		So(DisableUser(bs, disabled), ShouldBeNil)
+
+		var export bytes.Buffer
+		n, err := bs.Export(&export)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(strings.Count(export.String(), "\n"), ShouldEqual, 2)
+
+		kept, err := other.Signin("kept@test.com", pass)
+		So(err, ShouldBeNil)
+
+		Convey("Merge keeps the users of the store", func() {
+			n, err := other.Import(bytes.NewReader(export.Bytes()), RestoreMerge)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			loginId, err := other.Login("ddhhpp@test.com", pass)
+			So(err, ShouldBeNil)
+			So(loginId, ShouldEqual, id)
+
+			user, err := other.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Attributes, ShouldResemble, Attributes{"name": "David"})
+
+			_, err = other.Login("disabled@test.com", pass)
+			So(err, ShouldEqual, ErrAccountDisabled)
+
+			_, err = other.UserById(kept)
+			So(err, ShouldBeNil)
+
+			// importing again replaces the users with the same id
+			_, err = other.Import(bytes.NewReader(export.Bytes()), RestoreMerge)
+			So(err, ShouldBeNil)
+			users, _, err := other.ListUsers("", 0)
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 3)
+		})
+
+		Convey("Replace removes the users of the store", func() {
+			n, err := other.Import(bytes.NewReader(export.Bytes()), RestoreReplace)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			_, err = other.UserById(kept)
+			So(err, ShouldEqual, ErrUserNotFound)
+			_, err = other.UserByEmail("kept@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			loginId, err := other.Login("ddhhpp@test.com", pass)
+			So(err, ShouldBeNil)
+			So(loginId, ShouldEqual, id)
+		})
+
+		Convey("Nothing is imported when a user has the email of another user", func() {
+			_, err := other.Signin("ddhhpp@test.com", pass)
+			So(err, ShouldBeNil)
+
+			_, err = other.Import(bytes.NewReader(export.Bytes()), RestoreMerge)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, ErrEmailDuplication.Error())
+
+			_, err = other.UserByEmail("disabled@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+		})
+
+		Convey("Invalid records are not imported", func() {
+			_, err := other.Import(strings.NewReader(`{"user":{"id":"1","email":"a@test.com"}}`), RestoreReplace)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Importing user 1")
+
+			_, err = other.Import(strings.NewReader("not json"), RestoreReplace)
+			So(err, ShouldNotBeNil)
+
+			_, err = other.UserById(kept)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -1,44 +1,142 @@
 package store
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/dahernan/auth/crypto"
 )
 
+// The users are stored by id in the user bucket, and the bucket
+// "<userBucket>.email" is the index to find the id of a user by the email.
+// The stores of the tenants have the buckets nested in the bucket of the tenant, see TenantBoltStore
 type BoltStore struct {
-	db     *bolt.DB
-	bucket []byte
+	db          *bolt.DB
+	bucket      []byte
+	emailBucket []byte
+	newId       IdGenerator
+	normalize   EmailNormalizer
+	schema      AttributeSchema
+	hasher      crypto.Hasher
+	// nil when the users are stored in clear
+	cipher *recordCipher
+	// the bucket with the buckets of the tenants, and the tenant of the store
+	tenantsBucket []byte
+	tenant        string
+}
+
+type BoltOptions struct {
+	// Generates the ids of the new users, UUID if it is not set
+	IdGenerator IdGenerator
+	// Normalizes the emails, NormalizeEmail if it is not set
+	EmailNormalizer EmailNormalizer
+	// Validates the attributes of the users, any attribute is valid if it is not set
+	AttributeSchema AttributeSchema
+	// Hashes the passwords of the new users and the changed ones, crypto.DefaultHasher if it is not set.
+	// The passwords hashed with any other supported hasher are still checked, and hashed again
+	// with this one when the users log in
+	Hasher crypto.Hasher
+	// Encrypts the emails and the attributes of the users, they are stored in clear if it is not set.
+	// Call ReencryptRecords when it is set in a store with users in clear
+	Encryption *Encryption
 }
 
 func NewBoltStore(db *bolt.DB, userBucket string) (*BoltStore, error) {
-	bucket := []byte(userBucket)
+	return NewBoltStoreWithOptions(db, userBucket, BoltOptions{})
+}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucket)
-		if err != nil {
-			return fmt.Errorf("Creating bucket: %s", err)
-		}
+func NewBoltStoreWithOptions(db *bolt.DB, userBucket string, opt BoltOptions) (*BoltStore, error) {
+	bs, err := newBoltStore(db, userBucket, opt)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(bs.createBuckets)
+	return bs, err
+}
+
+func newBoltStore(db *bolt.DB, userBucket string, opt BoltOptions) (*BoltStore, error) {
+	cipher, err := newRecordCipher(opt.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &BoltStore{
+		db:          db,
+		bucket:      []byte(userBucket),
+		emailBucket: []byte(userBucket + ".email"),
+		newId:       opt.IdGenerator,
+		normalize:   opt.EmailNormalizer,
+		schema:      opt.AttributeSchema,
+		hasher:      opt.Hasher,
+		cipher:      cipher,
+	}
+	if bs.hasher == nil {
+		bs.hasher = crypto.DefaultHasher
+	}
+	if bs.newId == nil {
+		bs.newId = UUID
+	}
+	if bs.normalize == nil {
+		bs.normalize = NormalizeEmail
+	}
+	return bs, nil
+}
+
+func (bs *BoltStore) createBuckets(tx *bolt.Tx) error {
+	parent := bs.parent(tx)
+	b, err := parent.CreateBucketIfNotExists(bs.bucket)
+	if err != nil {
+		return fmt.Errorf("Creating bucket: %s", err)
+	}
+	if parent.Bucket(bs.emailBucket) != nil {
 		return nil
-	})
-	return &BoltStore{db: db, bucket: bucket}, err
+	}
+
+	idx, err := parent.CreateBucket(bs.emailBucket)
+	if err != nil {
+		return fmt.Errorf("Creating bucket: %s", err)
+	}
+	// the users stored before the index existed are keyed by the email,
+	// that is their id, so the index is built for them
+	return bs.indexEmails(b, idx)
+}
+
+// The tenant of the store, empty if the store is not for a tenant
+func (bs *BoltStore) TenantId() string {
+	return bs.tenant
 }
 
 func (bs *BoltStore) UserByEmail(email string) (User, error) {
-	var user User
-	err := bs.db.View(func(tx *bolt.Tx) error {
-		var err error
-		b := tx.Bucket(bs.bucket)
+	return bs.UserByEmailContext(context.Background(), email)
+}
 
-		gobUser := b.Get([]byte(email))
-		if gobUser == nil {
+func (bs *BoltStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	var user User
+	err := bs.view(ctx, func(tx *bolt.Tx) error {
+		id := bs.lookupEmail(bs.parent(tx).Bucket(bs.emailBucket), email)
+		if id == nil {
 			return ErrUserNotFound
 		}
 
-		user, err = gobDecode(gobUser)
+		var err error
+		user, err = bs.getUser(bs.parent(tx).Bucket(bs.bucket), string(id))
+		return err
+	})
+
+	return user, err
+}
+
+func (bs *BoltStore) UserById(userId string) (User, error) {
+	return bs.UserByIdContext(context.Background(), userId)
+}
+
+func (bs *BoltStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	var user User
+	err := bs.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		user, err = bs.getUser(bs.parent(tx).Bucket(bs.bucket), userId)
 		return err
 	})
 
@@ -46,74 +144,603 @@ func (bs *BoltStore) UserByEmail(email string) (User, error) {
 }
 
 func (bs *BoltStore) Signin(email, pass string) (string, error) {
-	// check if the user exists
-	_, err := bs.UserByEmail(email)
+	return bs.SigninContext(context.Background(), email, pass)
+}
+
+func (bs *BoltStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return bs.SigninWithAttributesContext(ctx, email, pass, nil)
+}
+
+func (bs *BoltStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return bs.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (bs *BoltStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	err := validateAttributes(bs.schema, attrs)
+	if err != nil {
+		return "", err
+	}
+
+	// check if the user exists, before spending time hashing the password
+	_, err = bs.UserByEmailContext(ctx, email)
 	if err == nil {
 		return "", ErrEmailDuplication
 	}
+	if err != ErrUserNotFound {
+		return "", err
+	}
 
-	err = bs.db.Update(func(tx *bolt.Tx) error {
+	email, err = bs.normalize(email)
+	if err != nil {
+		return "", err
+	}
 
-		b := tx.Bucket(bs.bucket)
+	userId, err := bs.newId()
+	if err != nil {
+		return "", err
+	}
 
-		// email is going to be the Id of the user
-		user, err := NewUser(email, email, pass)
-		if err != nil {
-			return err
+	user, err := NewUserWithHasher(bs.hasher, userId, email, pass)
+	if err != nil {
+		return "", err
+	}
+	user.Attributes = attrs
+	user.TenantId = bs.tenant
+
+	// the email is checked again in the same transaction of the insert,
+	// so only one of two concurrent signins with the same email wins
+	err = bs.update(ctx, func(tx *bolt.Tx) error {
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+		if bs.lookupEmail(idx, email) != nil {
+			return ErrEmailDuplication
 		}
-		g, err := gobEncode(user)
+
+		err := bs.putUser(bs.parent(tx).Bucket(bs.bucket), user)
 		if err != nil {
 			return err
 		}
-		err = b.Put([]byte(email), g)
-		return err
+		return idx.Put(bs.emailKey(email), []byte(userId))
 	})
 
 	if err != nil {
 		return "", err
 	}
 
-	return email, nil
+	return userId, nil
 
 }
 
 func (bs *BoltStore) Login(email, pass string) (string, error) {
-	user, err := bs.UserByEmail(email)
-	if err != nil {
+	return bs.LoginContext(context.Background(), email, pass)
+}
+
+func (bs *BoltStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	user, err := bs.UserByEmailContext(ctx, email)
+	if err == ErrUserNotFound {
 		return "", ErrWrongPassword
 	}
-	passStored := user.Password
-	salt := user.Salt
+	if err != nil {
+		return "", err
+	}
+
+	if needsRehash(bs.hasher, user) {
+		return bs.loginAndRehash(ctx, email, pass)
+	}
 
-	hpass, err := crypto.HashPassword(pass, []byte(salt))
+	err = checkPassword(bs.hasher, user, pass)
 	if err != nil {
 		return "", err
 	}
-	passOk := crypto.SecureCompare(hpass, []byte(passStored))
-	if !passOk {
-		return "", ErrWrongPassword
+	err = user.CheckStatus(time.Now())
+	if err != nil {
+		return "", err
 	}
 	return user.Id, nil
 }
 
-func gobEncode(user User) ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
+func (bs *BoltStore) UpdatePassword(userId, pass string) error {
+	return bs.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (bs *BoltStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	hpass, err := hashPassword(bs.hasher, pass)
+	if err != nil {
+		return err
+	}
+
+	return bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		user, err := bs.getUser(b, userId)
+		if err != nil {
+			return err
+		}
+		user.Password = hpass
+		user.Salt = ""
+		return bs.putUser(b, user)
+	})
+}
+
+func (bs *BoltStore) UpdateEmail(userId, email string) error {
+	return bs.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (bs *BoltStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	email, err := bs.normalize(email)
+	if err != nil {
+		return err
+	}
+
+	return bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+
+		user, err := bs.getUser(b, userId)
+		if err != nil {
+			return err
+		}
+		if user.Email == email {
+			return nil
+		}
+		if id := bs.lookupEmail(idx, email); id != nil && string(id) != userId {
+			return ErrEmailDuplication
+		}
+
+		err = idx.Delete(bs.emailKey(user.Email))
+		if err != nil {
+			return err
+		}
+		err = idx.Put(bs.emailKey(email), []byte(userId))
+		if err != nil {
+			return err
+		}
+		user.Email = email
+		return bs.putUser(b, user)
+	})
+}
+
+func (bs *BoltStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return bs.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (bs *BoltStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	return bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		user, err := bs.getUser(b, userId)
+		if err != nil {
+			return err
+		}
+
+		user.Attributes = mergeAttributes(user.Attributes, attrs)
+		err = validateAttributes(bs.schema, user.Attributes)
+		if err != nil {
+			return err
+		}
+		return bs.putUser(b, user)
+	})
+}
+
+func (bs *BoltStore) SetStatus(userId string, status Status, until time.Time) error {
+	return bs.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (bs *BoltStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	return bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		user, err := bs.getUser(b, userId)
+		if err != nil {
+			return err
+		}
+
+		err = setStatus(&user, status, until)
+		if err != nil {
+			return err
+		}
+		return bs.putUser(b, user)
+	})
+}
+
+func (bs *BoltStore) PurgeUsers(now time.Time) ([]string, error) {
+	return bs.PurgeUsersContext(context.Background(), now)
+}
+
+func (bs *BoltStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	var purged []string
+
+	err := bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+
+		var users []User
+		err := b.ForEach(func(k, v []byte) error {
+			user, _, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			if user.purgeable(now) {
+				users = append(users, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			err = idx.Delete(bs.emailKey(user.Email))
+			if err != nil {
+				return err
+			}
+			err = b.Delete([]byte(user.Id))
+			if err != nil {
+				return err
+			}
+			purged = append(purged, user.Id)
+		}
+		return nil
+	})
 
-	err := enc.Encode(user)
 	if err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return purged, nil
+}
+
+func (bs *BoltStore) DeleteUser(userId string) error {
+	return bs.DeleteUserContext(context.Background(), userId)
+}
+
+func (bs *BoltStore) DeleteUserContext(ctx context.Context, userId string) error {
+	return bs.update(ctx, func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		user, err := bs.getUser(b, userId)
+		if err != nil {
+			return err
+		}
+
+		err = bs.parent(tx).Bucket(bs.emailBucket).Delete(bs.emailKey(user.Email))
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(userId))
+	})
+}
+
+// Users are listed in the order of the ids,
+// and the cursor is the id of the last user of the page
+func (bs *BoltStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return bs.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (bs *BoltStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	var users []User
+	var next string
+
+	err := bs.view(ctx, func(tx *bolt.Tx) error {
+		c := bs.parent(tx).Bucket(bs.bucket).Cursor()
+
+		k, v := c.First()
+		if cursor != "" {
+			k, v = c.Seek([]byte(cursor))
+			if k != nil && string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if limit > 0 && len(users) == limit {
+				next = users[len(users)-1].Id
+				break
+			}
+			user, _, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+
+	return users, next, err
+}
+
+// Before the opaque ids the email was the id of the user. This gives a new id
+// to the users that still have the email as the id, and returns the new id by the old one,
+// so the references to the old ids can be updated.
+// The tokens issued with the old ids are not valid for the users anymore.
+func (bs *BoltStore) MigrateEmailIds() (map[string]string, error) {
+	migrated := make(map[string]string)
+
+	err := bs.update(context.Background(), func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+
+		var legacy []User
+		err := b.ForEach(func(k, v []byte) error {
+			user, _, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			if user.Id == user.Email {
+				legacy = append(legacy, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range legacy {
+			oldId := user.Id
+			user.Id, err = bs.newId()
+			if err != nil {
+				return err
+			}
+
+			err = b.Delete([]byte(oldId))
+			if err != nil {
+				return err
+			}
+			err = bs.putUser(b, user)
+			if err != nil {
+				return err
+			}
+			err = idx.Put(bs.emailKey(user.Email), []byte(user.Id))
+			if err != nil {
+				return err
+			}
+			migrated[oldId] = user.Id
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// Normalizes the emails of the users that were stored before the normalization,
+// they are only found by the email exactly as it was stored until then.
+// The users that collide with other users when the emails are normalized are not changed,
+// they are returned grouped by the normalized email to be solved by hand.
+func (bs *BoltStore) NormalizeEmails() ([][]User, error) {
+	var collisions [][]User
+
+	err := bs.update(context.Background(), func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+		idx := bs.parent(tx).Bucket(bs.emailBucket)
+
+		var users []User
+		err := b.ForEach(func(k, v []byte) error {
+			user, _, err := bs.decodeUser(v)
+			users = append(users, user)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		order, groups := groupByEmail(users, bs.normalize)
+		for _, email := range order {
+			group := groups[email]
+			if len(group) > 1 {
+				collisions = append(collisions, group)
+				continue
+			}
+
+			user := group[0]
+			if user.Email == email {
+				continue
+			}
+			err = idx.Delete(bs.emailKey(user.Email))
+			if err != nil {
+				return err
+			}
+			err = idx.Put(bs.emailKey(email), []byte(user.Id))
+			if err != nil {
+				return err
+			}
+			user.Email = email
+			err = bs.putUser(b, user)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+// Writes again the records that are stored in an old format, with the current one.
+// The old records are readable, so this is only needed to use the store with tools
+// that only know the current format, or before removing the support of the old one.
+// Returns the number of records upgraded.
+func (bs *BoltStore) UpgradeRecords() (int, error) {
+	upgraded := 0
+	err := bs.update(context.Background(), func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+
+		var users []User
+		err := b.ForEach(func(k, v []byte) error {
+			user, old, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			if old {
+				users = append(users, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			err = bs.putUser(b, user)
+			if err != nil {
+				return err
+			}
+		}
+		upgraded = len(users)
+		return nil
+	})
+	return upgraded, err
+}
+
+// Encrypts again the records that are not encrypted with the current key encryption key,
+// the ones stored in clear too, and builds again the email index with the index key.
+// Call it after a rotation of the key encryption key, when the old key is still known,
+// after a change of the index key, or after setting the Encryption in a store with users.
+// Returns the number of records encrypted.
+func (bs *BoltStore) ReencryptRecords() (int, error) {
+	if bs.cipher == nil {
+		return 0, ErrNoEncryption
+	}
+
+	reencrypted := 0
+	err := bs.update(context.Background(), func(tx *bolt.Tx) error {
+		b := bs.parent(tx).Bucket(bs.bucket)
+
+		var users, stale []User
+		err := b.ForEach(func(k, v []byte) error {
+			user, old, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			if old || recordKeyId(v) != bs.cipher.kek.KeyId() {
+				stale = append(stale, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range stale {
+			err = bs.putUser(b, user)
+			if err != nil {
+				return err
+			}
+		}
+		reencrypted = len(stale)
+
+		// the index could have the emails in clear, or a HMAC with another key
+		err = bs.parent(tx).DeleteBucket(bs.emailBucket)
+		if err != nil {
+			return err
+		}
+		idx, err := bs.parent(tx).CreateBucket(bs.emailBucket)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			err = idx.Put(bs.emailKey(user.Email), []byte(user.Id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return reencrypted, err
 }
 
-func gobDecode(b []byte) (User, error) {
-	reader := bytes.NewReader(b)
-	dec := gob.NewDecoder(reader)
-	var u User
-	err := dec.Decode(&u)
+// Bolt can not cancel a transaction, so the context is checked before it starts,
+// and when it starts, because the writes wait for the previous ones.
+// The tenant of the store could be deleted, so it is checked too
+func (bs *BoltStore) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if bs.parent(tx) == nil {
+			return ErrTenantNotFound
+		}
+		return fn(tx)
+	})
+}
+
+func (bs *BoltStore) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.db.View(func(tx *bolt.Tx) error {
+		if bs.parent(tx) == nil {
+			return ErrTenantNotFound
+		}
+		return fn(tx)
+	})
+}
+
+// bolt.Tx or bolt.Bucket, where the buckets of the store are
+type bucketParent interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// nil when the tenant of the store is deleted
+func (bs *BoltStore) parent(tx *bolt.Tx) bucketParent {
+	if bs.tenant == "" {
+		return tx
+	}
+	b := tx.Bucket(bs.tenantsBucket).Bucket([]byte(bs.tenant))
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+// The key of the email in the index, a HMAC of the email in the stores with Encryption
+func (bs *BoltStore) emailKey(email string) []byte {
+	return bs.cipher.emailKey(email)
+}
+
+// Finds the id of the user in the email index
+func (bs *BoltStore) lookupEmail(idx *bolt.Bucket, email string) []byte {
+	for _, e := range lookupEmails(bs.normalize, email) {
+		if id := idx.Get(bs.emailKey(e)); id != nil {
+			return id
+		}
+	}
+	return nil
+}
+
+func (bs *BoltStore) indexEmails(b, idx *bolt.Bucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		user, _, err := bs.decodeUser(v)
+		if err != nil {
+			return err
+		}
+		return idx.Put(bs.emailKey(user.Email), []byte(user.Id))
+	})
+}
+
+func (bs *BoltStore) getUser(b *bolt.Bucket, userId string) (User, error) {
+	v := b.Get([]byte(userId))
+	if v == nil {
+		return User{}, ErrUserNotFound
+	}
+	user, _, err := bs.decodeUser(v)
+	return user, err
+}
+
+func (bs *BoltStore) decodeUser(v []byte) (User, bool, error) {
+	return decodeRecord(v, bs.cipher)
+}
+
+func (bs *BoltStore) putUser(b *bolt.Bucket, user User) error {
+	v, err := encodeRecord(user, bs.cipher)
 	if err != nil {
-		return User{}, err
+		return err
 	}
-	return u, nil
+	return b.Put([]byte(user.Id), v)
 }
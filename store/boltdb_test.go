@@ -1,24 +1,39 @@
 package store
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/dahernan/auth/crypto"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// Deletes the user bucket and the email index of the store
 func DeleteBucket(t *testing.T, db *bolt.DB, bucket string) {
 	db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket([]byte(bucket))
-		if err != nil {
-			t.Errorf("Deleting bucket: %s", err)
-			return err
+		for _, name := range []string{bucket, bucket + ".email"} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				t.Errorf("Deleting bucket: %s", err)
+				return err
+			}
 		}
 		return nil
 	})
 }
 
+// Writes the user in the bucket in clear, like the stores without encryption
+func putUser(b *bolt.Bucket, user User) error {
+	v, err := encodeUser(user)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(user.Id), v)
+}
+
 func NewDB(t *testing.T, name string) *bolt.DB {
 	db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
@@ -41,7 +56,8 @@ func TestSignIn(t *testing.T) {
 		email := "ddhhpp@test.com"
 		id, err := bs.Signin(email, "123456")
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
+		So(id, ShouldNotEqual, email)
 
 	})
 }
@@ -60,7 +76,7 @@ func TestSignInDuplicateEmail(t *testing.T) {
 		email := "ddhhpp@test.com"
 		id, err := bs.Signin(email, "123456")
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
 
 		_, err = bs.Signin(email, "123456")
 		So(err, ShouldEqual, ErrEmailDuplication)
@@ -68,6 +84,57 @@ func TestSignInDuplicateEmail(t *testing.T) {
 	})
 }
 
+func TestSignInConcurrentDuplicateEmail(t *testing.T) {
+	Convey("Concurrent SingIns with the same email, only one wins", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketConcurrent"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		signins := 8
+		errs := make(chan error, signins)
+		ids := make(chan string, signins)
+
+		var wg sync.WaitGroup
+		for i := 0; i < signins; i++ {
+			wg.Add(1)
+			go func(pass string) {
+				defer wg.Done()
+				id, err := bs.Signin(email, pass)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids <- id
+			}(fmt.Sprintf("pass%d", i))
+		}
+		wg.Wait()
+		close(errs)
+		close(ids)
+
+		So(len(ids), ShouldEqual, 1)
+		So(len(errs), ShouldEqual, signins-1)
+		for err := range errs {
+			So(err, ShouldEqual, ErrEmailDuplication)
+		}
+
+		// the winner keeps the user, nobody overwrote the password
+		id := <-ids
+		users, _, err := bs.ListUsers("", 0)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].Id, ShouldEqual, id)
+
+		user, err := bs.UserByEmail(email)
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, id)
+	})
+}
+
 func TestGetUserDataByEmail(t *testing.T) {
 	Convey("Gets the user data by the email", t, func() {
 		db := NewDB(t, "testUsers.db")
@@ -82,15 +149,15 @@ func TestGetUserDataByEmail(t *testing.T) {
 		email := "ddhhpp@test.com"
 		id, err := bs.Signin(email, "123456")
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
 
 		user, err := bs.UserByEmail(email)
 		So(err, ShouldBeNil)
 
-		So(user.Id, ShouldEqual, email)
+		So(user.Id, ShouldEqual, id)
 		So(user.Email, ShouldEqual, email)
-		So(user.Password, ShouldNotBeEmpty)
-		So(user.Salt, ShouldNotBeEmpty)
+		So(user.Password, ShouldStartWith, "$scrypt$")
+		So(user.Salt, ShouldBeEmpty)
 
 	})
 }
@@ -128,11 +195,11 @@ func TestLogIn(t *testing.T) {
 		pass := "123456"
 		id, err := bs.Signin(email, pass)
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
 
-		id, err = bs.Login(email, pass)
+		loginId, err := bs.Login(email, pass)
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(loginId, ShouldEqual, id)
 	})
 }
 
@@ -151,7 +218,7 @@ func TestLogInBadEmail(t *testing.T) {
 		pass := "123456"
 		id, err := bs.Signin(email, pass)
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
 
 		_, err = bs.Login("no@user.com", pass)
 		So(err, ShouldEqual, ErrWrongPassword)
@@ -174,10 +241,328 @@ func TestLogInBadPass(t *testing.T) {
 		pass := "123456"
 		id, err := bs.Signin(email, pass)
 		So(err, ShouldBeNil)
-		So(id, ShouldEqual, email)
+		So(id, ShouldNotBeEmpty)
 
 		_, err = bs.Login(email, "xyz")
 		So(err, ShouldEqual, ErrWrongPassword)
 
 	})
 }
+
+func TestUpdatePassword(t *testing.T) {
+	Convey("Updates the password of the user", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketUpdatePass"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		id, err := bs.Signin(email, "123456")
+		So(err, ShouldBeNil)
+
+		err = bs.UpdatePassword(id, "abcdef")
+		So(err, ShouldBeNil)
+
+		_, err = bs.Login(email, "123456")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		loginId, err := bs.Login(email, "abcdef")
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+
+		err = bs.UpdatePassword("404", "abcdef")
+		So(err, ShouldEqual, ErrUserNotFound)
+	})
+}
+
+func TestUpdateEmail(t *testing.T) {
+	Convey("Updates the email of the user", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketUpdateEmail"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := bs.Signin("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = bs.Signin("taken@test.com", pass)
+		So(err, ShouldBeNil)
+
+		err = bs.UpdateEmail(id, "taken@test.com")
+		So(err, ShouldEqual, ErrEmailDuplication)
+
+		err = bs.UpdateEmail(id, "new@test.com")
+		So(err, ShouldBeNil)
+
+		_, err = bs.UserByEmail("ddhhpp@test.com")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		user, err := bs.UserByEmail("new@test.com")
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "new@test.com")
+		So(user.Id, ShouldEqual, id)
+
+		_, err = bs.Login("new@test.com", pass)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	Convey("Deletes the user", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketDelete"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		id, err := bs.Signin(email, "123456")
+		So(err, ShouldBeNil)
+
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, email)
+
+		err = bs.DeleteUser(id)
+		So(err, ShouldBeNil)
+
+		_, err = bs.UserById(id)
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		err = bs.DeleteUser(id)
+		So(err, ShouldEqual, ErrUserNotFound)
+	})
+}
+
+func TestListUsers(t *testing.T) {
+	Convey("Lists the users by pages", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketList"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		for _, email := range []string{"a@test.com", "b@test.com", "c@test.com"} {
+			_, err = bs.Signin(email, "123456")
+			So(err, ShouldBeNil)
+		}
+
+		// the users are in the order of the ids, that are random
+		users, cursor, err := bs.ListUsers("", 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(cursor, ShouldNotBeEmpty)
+
+		last, cursor, err := bs.ListUsers(cursor, 2)
+		So(err, ShouldBeNil)
+		So(len(last), ShouldEqual, 1)
+		So(cursor, ShouldBeEmpty)
+
+		emails := []string{users[0].Email, users[1].Email, last[0].Email}
+		So(emails, ShouldContain, "a@test.com")
+		So(emails, ShouldContain, "b@test.com")
+		So(emails, ShouldContain, "c@test.com")
+
+		users, cursor, err = bs.ListUsers("", 0)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 3)
+		So(cursor, ShouldBeEmpty)
+	})
+}
+
+func TestSignInWithIdGenerator(t *testing.T) {
+	Convey("SingIn uses the id generator of the store", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketIdGenerator"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{
+			IdGenerator: func() (string, error) { return "custom-id", nil },
+		})
+		So(err, ShouldBeNil)
+
+		id, err := bs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "custom-id")
+
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "ddhhpp@test.com")
+	})
+}
+
+func TestMigrateEmailIds(t *testing.T) {
+	Convey("Users stored by the email are indexed and migrated to opaque ids", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketMigrateIds"
+		DeleteBucket(t, db, bucket)
+
+		// users stored before the opaque ids, keyed by the email
+		email := "ddhhpp@test.com"
+		pass := "123456"
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			user, err := NewUser(email, email, pass)
+			if err != nil {
+				return err
+			}
+			return putUser(b, user)
+		})
+		So(err, ShouldBeNil)
+
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		id, err := bs.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, email)
+
+		migrated, err := bs.MigrateEmailIds()
+		So(err, ShouldBeNil)
+		So(len(migrated), ShouldEqual, 1)
+		So(migrated[email], ShouldNotBeEmpty)
+		So(migrated[email], ShouldNotEqual, email)
+
+		id, err = bs.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, migrated[email])
+
+		_, err = bs.UserById(email)
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		migrated, err = bs.MigrateEmailIds()
+		So(err, ShouldBeNil)
+		So(len(migrated), ShouldEqual, 0)
+	})
+}
+
+func TestUpgradeRecords(t *testing.T) {
+	Convey("Users stored with gob are readable and upgraded to the JSON records", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketUpgrade"
+		DeleteBucket(t, db, bucket)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+		user, err := NewUser("1", email, pass)
+		So(err, ShouldBeNil)
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(user.Id), gobEncode(t, user))
+		})
+		So(err, ShouldBeNil)
+
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		id, err := bs.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, user.Id)
+
+		upgraded, err := bs.UpgradeRecords()
+		So(err, ShouldBeNil)
+		So(upgraded, ShouldEqual, 1)
+
+		db.View(func(tx *bolt.Tx) error {
+			_, old, err := decodeUser(tx.Bucket([]byte(bucket)).Get([]byte(user.Id)))
+			So(err, ShouldBeNil)
+			So(old, ShouldBeFalse)
+			return nil
+		})
+
+		id, err = bs.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, user.Id)
+
+		upgraded, err = bs.UpgradeRecords()
+		So(err, ShouldBeNil)
+		So(upgraded, ShouldEqual, 0)
+	})
+}
+
+func TestPasswordHashers(t *testing.T) {
+	Convey("The passwords of any supported hash and the legacy scrypt ones log in", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketHashers"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{
+			Hasher: crypto.Argon2Hasher{Time: 1, Memory: 1024, Threads: 1},
+		})
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := bs.Signin("argon@test.com", pass)
+		So(err, ShouldBeNil)
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Password, ShouldStartWith, "$argon2id$v=19$m=1024,t=1,p=1$")
+
+		salt := crypto.GenerateRandomKey(128)
+		legacy, err := crypto.HashPassword(pass, salt)
+		So(err, ShouldBeNil)
+		bcrypt, err := crypto.BcryptHasher{Cost: 4}.Hash(pass)
+		So(err, ShouldBeNil)
+		pbkdf2, err := crypto.PBKDF2Hasher{Iterations: 1000}.Hash(pass)
+		So(err, ShouldBeNil)
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			idx := tx.Bucket([]byte(bucket + ".email"))
+			for _, user := range []User{
+				{Id: "legacy", Email: "legacy@test.com", Password: string(legacy), Salt: string(salt)},
+				{Id: "bcrypt", Email: "bcrypt@test.com", Password: bcrypt},
+				{Id: "pbkdf2", Email: "pbkdf2@test.com", Password: pbkdf2},
+			} {
+				if err := putUser(b, user); err != nil {
+					return err
+				}
+				if err := idx.Put([]byte(user.Email), []byte(user.Id)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		for _, email := range []string{"argon@test.com", "legacy@test.com", "bcrypt@test.com", "pbkdf2@test.com"} {
+			_, err := bs.Login(email, pass)
+			So(err, ShouldBeNil)
+			_, err = bs.Login(email, "other")
+			So(err, ShouldEqual, ErrWrongPassword)
+		}
+
+		Convey("A new password of a legacy user is hashed with the hasher of the store", func() {
+			So(bs.UpdatePassword("legacy", "new password"), ShouldBeNil)
+			user, err := bs.UserById("legacy")
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldStartWith, "$argon2id$")
+			So(user.Salt, ShouldBeEmpty)
+			_, err = bs.Login("legacy@test.com", "new password")
+			So(err, ShouldBeNil)
+		})
+	})
+}
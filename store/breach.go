@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBreachCheckFailed = errors.New("The password could not be checked against the breached passwords")
+
+// Checks whether a password appears in the known breach corpora
+type BreachedPasswordChecker interface {
+	Breached(ctx context.Context, pass string) (bool, error)
+}
+
+// The upper case hex SHA-1 of the password, the format of the breached password lists
+func sha1Hex(pass string) string {
+	sum := sha1.Sum([]byte(pass))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+type HIBPOptions struct {
+	// The URL of the range API, DefaultHIBPURL if it is not set
+	URL string
+	// The client of the requests, a client with a timeout of 5 seconds if it is not set
+	Client *http.Client
+	// The password is breached when it appears at least this number of times, 1 if it is not set
+	MinCount int
+	// Asks the API to pad the responses, so their size does not tell the prefix
+	Padding bool
+}
+
+const DefaultHIBPURL = "https://api.pwnedpasswords.com/range/"
+
+// BreachedPasswordChecker with the k-anonymity range API of Have I Been Pwned:
+// only the first 5 characters of the SHA-1 of the password are sent,
+// and the rest is looked up in the hash suffixes of the response
+type HIBPChecker struct {
+	opt HIBPOptions
+}
+
+func NewHIBPChecker(opt HIBPOptions) *HIBPChecker {
+	if opt.URL == "" {
+		opt.URL = DefaultHIBPURL
+	}
+	if !strings.HasSuffix(opt.URL, "/") {
+		opt.URL += "/"
+	}
+	if opt.Client == nil {
+		opt.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	if opt.MinCount < 1 {
+		opt.MinCount = 1
+	}
+	return &HIBPChecker{opt: opt}
+}
+
+func (hc *HIBPChecker) Breached(ctx context.Context, pass string) (bool, error) {
+	hash := sha1Hex(pass)
+	req, err := http.NewRequest("GET", hc.opt.URL+hash[:5], nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "dahernan-auth")
+	if hc.opt.Padding {
+		req.Header.Set("Add-Padding", "true")
+	}
+
+	resp, err := hc.opt.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("The breached passwords range API returned %s", resp.Status)
+	}
+
+	// lines of <suffix>:<count>, the padding lines have a count of 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 || !strings.EqualFold(line[:colon], hash[5:]) {
+			continue
+		}
+		count, err := strconv.Atoi(line[colon+1:])
+		if err != nil {
+			return false, fmt.Errorf("Invalid count in the breached passwords range API: %q", line)
+		}
+		return count >= hc.opt.MinCount, nil
+	}
+	return false, scanner.Err()
+}
+
+// BreachedPasswordChecker with a bloom filter of a list of SHA-1 hashes of breached passwords, for the hosts
+// without access to an API. The passwords in the list are always found, and a few of the others are found too,
+// at the false positive rate of the filter
+type BloomChecker struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// Builds the filter from a file with a SHA-1 hash in hex on every line, like the downloads of Have I Been Pwned,
+// the lines can have a :<count> after the hash. The file is read twice, to count the hashes and to add them
+func NewBloomChecker(path string, falsePositiveRate float64) (*BloomChecker, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("Invalid false positive rate %v", falsePositiveRate)
+	}
+
+	n := 0
+	err := readHashList(path, func([]byte) { n++ })
+	if err != nil {
+		return nil, err
+	}
+	bc := newBloomChecker(n, falsePositiveRate)
+	err = readHashList(path, bc.add)
+	if err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// The size and the number of hashes of the filter of n items with the false positive rate
+func newBloomChecker(n int, falsePositiveRate float64) *BloomChecker {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomChecker{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (bc *BloomChecker) Breached(ctx context.Context, pass string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	sum := sha1.Sum([]byte(pass))
+	return bc.contains(sum[:]), nil
+}
+
+// The bits of the hash, with the double hashing of the two halves of the SHA-1,
+// that is already uniform
+func (bc *BloomChecker) positions(hash []byte, f func(uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16]) | 1
+	for i := uint64(0); i < bc.k; i++ {
+		if !f((h1 + i*h2) % bc.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bc *BloomChecker) add(hash []byte) {
+	bc.positions(hash, func(pos uint64) bool {
+		bc.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+func (bc *BloomChecker) contains(hash []byte) bool {
+	return bc.positions(hash, func(pos uint64) bool {
+		return bc.bits[pos/64]&(1<<(pos%64)) != 0
+	})
+}
+
+func readHashList(path string, f func([]byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanHashList(file, f)
+}
+
+func scanHashList(r io.Reader, f func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			line = line[:colon]
+		}
+		hash, err := hex.DecodeString(line)
+		if err != nil || len(hash) != sha1.Size {
+			return fmt.Errorf("Invalid SHA-1 hash in the line %d of the hash list", lineNo)
+		}
+		f(hash)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// BreachedPasswordChecker with a fixed answer
+type fakeBreachChecker struct {
+	breached map[string]bool
+	err      error
+	calls    int
+}
+
+func (fc *fakeBreachChecker) Breached(ctx context.Context, pass string) (bool, error) {
+	fc.calls++
+	return fc.breached[pass], fc.err
+}
+
+func TestHIBPChecker(t *testing.T) {
+	Convey("The range API client only sends the prefix of the hash of the password", t, func() {
+		// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+		var paths []string
+		var padding, userAgent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			padding = r.Header.Get("Add-Padding")
+			userAgent = r.Header.Get("User-Agent")
+			switch r.URL.Path {
+			case "/range/5BAA6":
+				fmt.Fprint(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n"+
+					"1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n"+
+					"012C192B2F16F82EA0EB9EF18D9D539B0DD:0\r\n")
+			case "/range/7C4A8":
+				// 123456 only in the padding
+				fmt.Fprint(w, "D09CA3762AF61E59520943DC26494F8941B:0\r\n")
+			default:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		hc := NewHIBPChecker(HIBPOptions{URL: server.URL + "/range", Padding: true})
+		breached, err := hc.Breached(context.Background(), "password")
+		So(err, ShouldBeNil)
+		So(breached, ShouldBeTrue)
+		So(paths, ShouldResemble, []string{"/range/5BAA6"})
+		So(padding, ShouldEqual, "true")
+		So(userAgent, ShouldNotBeEmpty)
+
+		breached, err = hc.Breached(context.Background(), "123456")
+		So(err, ShouldBeNil)
+		So(breached, ShouldBeFalse)
+
+		// the API fails for the prefix of "Password"
+		_, err = hc.Breached(context.Background(), "Password")
+		So(err, ShouldNotBeNil)
+
+		strict := NewHIBPChecker(HIBPOptions{URL: server.URL + "/range/", MinCount: 5000000})
+		breached, err = strict.Breached(context.Background(), "password")
+		So(err, ShouldBeNil)
+		So(breached, ShouldBeFalse)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = hc.Breached(ctx, "password")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestBloomChecker(t *testing.T) {
+	Convey("The bloom filter finds the hashes of the list", t, func() {
+		var lines []string
+		for i := 0; i < 2000; i++ {
+			line := sha1Hex(fmt.Sprintf("breached-%d", i))
+			if i%2 == 0 {
+				line += fmt.Sprintf(":%d", i+1)
+			}
+			lines = append(lines, line)
+		}
+		path := filepath.Join(os.TempDir(), "testBreached.txt")
+		err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n\r\n"), 0600)
+		So(err, ShouldBeNil)
+		defer os.Remove(path)
+
+		bc, err := NewBloomChecker(path, 0.01)
+		So(err, ShouldBeNil)
+		for i := 0; i < 2000; i++ {
+			breached, err := bc.Breached(context.Background(), fmt.Sprintf("breached-%d", i))
+			So(err, ShouldBeNil)
+			So(breached, ShouldBeTrue)
+		}
+
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			breached, _ := bc.Breached(context.Background(), fmt.Sprintf("safe-%d", i))
+			if breached {
+				falsePositives++
+			}
+		}
+		So(falsePositives, ShouldBeLessThan, 300)
+
+		Convey("The invalid lists and rates are rejected", func() {
+			_, err := NewBloomChecker(path, 0)
+			So(err, ShouldNotBeNil)
+			_, err = NewBloomChecker(filepath.Join(os.TempDir(), "testMissing.txt"), 0.01)
+			So(err, ShouldNotBeNil)
+
+			err = ioutil.WriteFile(path, []byte(lines[0]+"\nnot a hash\n"), 0600)
+			So(err, ShouldBeNil)
+			_, err = NewBloomChecker(path, 0.01)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "line 2")
+		})
+	})
+}
+
+func TestBreachedPasswordPolicy(t *testing.T) {
+	Convey("The policy rejects the breached passwords", t, func() {
+		checker := &fakeBreachChecker{breached: map[string]bool{"correct horse": true}}
+		policy := PasswordPolicy{Breached: checker}
+
+		So(violationCodes(policy.Check("correct horse", "", nil)), ShouldResemble, []string{PasswordBreached})
+		So(policy.Check("battery staple", "", nil), ShouldBeNil)
+
+		Convey("The policy fails closed when the passwords can not be checked", func() {
+			checker.err = errors.New("unavailable")
+			So(policy.Check("battery staple", "", nil), ShouldEqual, ErrBreachCheckFailed)
+
+			policy.BreachedFailOpen = true
+			So(policy.Check("battery staple", "", nil), ShouldBeNil)
+			So(violationCodes(policy.Check("short", "", nil)), ShouldResemble, []string{PasswordTooShort})
+		})
+
+		Convey("The signins and the password changes of the policy store are checked", func() {
+			db := NewDB(t, "testUsers.db")
+			defer db.Close()
+
+			bucket := "testBucketBreach"
+			DeleteBucket(t, db, bucket)
+			bs, err := NewBoltStore(db, bucket)
+			So(err, ShouldBeNil)
+			ps := NewPolicyStore(bs, policy)
+
+			_, err = ps.Signin("ddhhpp@test.com", "ｃｏｒｒｅｃｔ horse")
+			So(violationCodes(err), ShouldResemble, []string{PasswordBreached})
+			id, err := ps.Signin("ddhhpp@test.com", "battery staple")
+			So(err, ShouldBeNil)
+			err = ps.UpdatePassword(id, "correct horse")
+			So(violationCodes(err), ShouldResemble, []string{PasswordBreached})
+
+			// the logins are not checked
+			calls := checker.calls
+			_, err = ps.Login("ddhhpp@test.com", "battery staple")
+			So(err, ShouldBeNil)
+			So(checker.calls, ShouldEqual, calls)
+
+			checker.err = errors.New("unavailable")
+			err = ps.UpdatePassword(id, "other staple")
+			So(err, ShouldEqual, ErrBreachCheckFailed)
+		})
+	})
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// UserRepository that caches the lookups of the users of another one, UserById and UserByEmail,
+// in a LRU cache with a time to live. The writes through the CachedStore remove the user from the cache,
+// the writes that go directly to the other repository are seen when the cached user expires.
+// Login always goes to the other repository, so the password and the status are always fresh.
+type CachedStore struct {
+	repo ContextUserRepository
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// changes with every invalidation, a lookup that started before it is not cached
+	gen uint64
+}
+
+type cacheEntry struct {
+	key     string
+	user    User
+	expires time.Time
+}
+
+// Caches up to size lookups, at least one, for the ttl
+func NewCachedStore(repo UserRepository, size int, ttl time.Duration) *CachedStore {
+	if size < 1 {
+		size = 1
+	}
+	return &CachedStore{
+		repo:    WithContext(repo),
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (cs *CachedStore) UserByEmail(email string) (User, error) {
+	return cs.UserByEmailContext(context.Background(), email)
+}
+
+func (cs *CachedStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	return cs.lookup("email:"+email, func() (User, error) {
+		return cs.repo.UserByEmailContext(ctx, email)
+	})
+}
+
+func (cs *CachedStore) UserById(userId string) (User, error) {
+	return cs.UserByIdContext(context.Background(), userId)
+}
+
+func (cs *CachedStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	return cs.lookup("id:"+userId, func() (User, error) {
+		return cs.repo.UserByIdContext(ctx, userId)
+	})
+}
+
+func (cs *CachedStore) Signin(email, pass string) (string, error) {
+	return cs.SigninContext(context.Background(), email, pass)
+}
+
+func (cs *CachedStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return cs.repo.SigninContext(ctx, email, pass)
+}
+
+func (cs *CachedStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return cs.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (cs *CachedStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	return cs.repo.SigninWithAttributesContext(ctx, email, pass, attrs)
+}
+
+func (cs *CachedStore) Login(email, pass string) (string, error) {
+	return cs.LoginContext(context.Background(), email, pass)
+}
+
+// A login can change the stored user, like the stores that hash the password again, so the user is removed
+func (cs *CachedStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	userId, err := cs.repo.LoginContext(ctx, email, pass)
+	if err == nil {
+		cs.invalidate(userId)
+	}
+	return userId, err
+}
+
+func (cs *CachedStore) UpdatePassword(userId, pass string) error {
+	return cs.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (cs *CachedStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	defer cs.invalidate(userId)
+	return cs.repo.UpdatePasswordContext(ctx, userId, pass)
+}
+
+func (cs *CachedStore) UpdateEmail(userId, email string) error {
+	return cs.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (cs *CachedStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	defer cs.invalidate(userId)
+	return cs.repo.UpdateEmailContext(ctx, userId, email)
+}
+
+func (cs *CachedStore) DeleteUser(userId string) error {
+	return cs.DeleteUserContext(context.Background(), userId)
+}
+
+func (cs *CachedStore) DeleteUserContext(ctx context.Context, userId string) error {
+	defer cs.invalidate(userId)
+	return cs.repo.DeleteUserContext(ctx, userId)
+}
+
+func (cs *CachedStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return cs.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (cs *CachedStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	defer cs.invalidate(userId)
+	return cs.repo.UpdateAttributesContext(ctx, userId, attrs)
+}
+
+func (cs *CachedStore) SetStatus(userId string, status Status, until time.Time) error {
+	return cs.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (cs *CachedStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	defer cs.invalidate(userId)
+	return cs.repo.SetStatusContext(ctx, userId, status, until)
+}
+
+func (cs *CachedStore) PurgeUsers(now time.Time) ([]string, error) {
+	return cs.PurgeUsersContext(context.Background(), now)
+}
+
+func (cs *CachedStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	purged, err := cs.repo.PurgeUsersContext(ctx, now)
+	if err != nil {
+		// some users could be purged
+		cs.Clear()
+		return purged, err
+	}
+	for _, userId := range purged {
+		cs.invalidate(userId)
+	}
+	return purged, nil
+}
+
+func (cs *CachedStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return cs.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (cs *CachedStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	return cs.repo.ListUsersContext(ctx, cursor, limit)
+}
+
+// Removes all the users from the cache
+func (cs *CachedStore) Clear() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.lru.Init()
+	cs.entries = make(map[string]*list.Element)
+	cs.gen++
+}
+
+func (cs *CachedStore) lookup(key string, load func() (User, error)) (User, error) {
+	cs.mu.Lock()
+	if elem, ok := cs.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if cs.now().Before(entry.expires) {
+			cs.lru.MoveToFront(elem)
+			cs.mu.Unlock()
+			return copyUser(entry.user), nil
+		}
+		cs.remove(elem)
+	}
+	gen := cs.gen
+	cs.mu.Unlock()
+
+	// the errors, like a user not found, are not cached
+	user, err := load()
+	if err != nil {
+		return user, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if gen == cs.gen {
+		cs.add(key, user)
+	}
+	return copyUser(user), nil
+}
+
+func (cs *CachedStore) add(key string, user User) {
+	entry := &cacheEntry{key: key, user: copyUser(user), expires: cs.now().Add(cs.ttl)}
+	if elem, ok := cs.entries[key]; ok {
+		elem.Value = entry
+		cs.lru.MoveToFront(elem)
+		return
+	}
+
+	cs.entries[key] = cs.lru.PushFront(entry)
+	for cs.lru.Len() > cs.size {
+		cs.remove(cs.lru.Back())
+	}
+}
+
+func (cs *CachedStore) remove(elem *list.Element) {
+	cs.lru.Remove(elem)
+	delete(cs.entries, elem.Value.(*cacheEntry).key)
+}
+
+// Removes the user from the cache, by the id and by all the emails it was looked up with
+func (cs *CachedStore) invalidate(userId string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for elem := cs.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cacheEntry).user.Id == userId {
+			cs.remove(elem)
+		}
+		elem = next
+	}
+	cs.gen++
+}
+
+// The attributes are a map, so the user in the cache has its own copy, with its own lists
+func copyUser(user User) User {
+	if user.Attributes != nil {
+		attrs := make(Attributes, len(user.Attributes))
+		for name, value := range user.Attributes {
+			attrs[name] = copyValue(value)
+		}
+		user.Attributes = attrs
+	}
+	return user
+}
+
+// The lists and the maps of the attributes are copied too, so they are not shared with the cache
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []string:
+		return append([]string(nil), v...)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item)
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = copyValue(item)
+		}
+		return m
+	}
+	return value
+}
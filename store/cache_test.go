@@ -0,0 +1,172 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dahernan/auth/crypto"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Counts the lookups that get to the repository
+type countingRepo struct {
+	UserRepository
+	lookups int
+}
+
+func (cr *countingRepo) UserById(userId string) (User, error) {
+	cr.lookups++
+	return cr.UserRepository.UserById(userId)
+}
+
+func (cr *countingRepo) UserByEmail(email string) (User, error) {
+	cr.lookups++
+	return cr.UserRepository.UserByEmail(email)
+}
+
+func TestCachedStore(t *testing.T) {
+	Convey("The cached store caches the lookups of the users", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketCache"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		repo := &countingRepo{UserRepository: bs}
+		cs := NewCachedStore(repo, 2, time.Minute)
+		now := time.Now()
+		cs.now = func() time.Time { return now }
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+		id, err := cs.SigninWithAttributes(email, pass, Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+
+		user, err := cs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, email)
+		user, err = cs.UserById(id)
+		So(err, ShouldBeNil)
+		So(repo.lookups, ShouldEqual, 1)
+
+		_, err = cs.UserByEmail(email)
+		So(err, ShouldBeNil)
+		_, err = cs.UserByEmail(email)
+		So(err, ShouldBeNil)
+		So(repo.lookups, ShouldEqual, 2)
+
+		Convey("The users in the cache can not be changed from outside", func() {
+			user.Attributes["name"] = "Other"
+			user, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Attributes["name"], ShouldEqual, "David")
+		})
+
+		Convey("The lists of the users in the cache can not be changed from outside", func() {
+			err := cs.UpdateAttributes(id, Attributes{"groups": []string{"admins", "devs"}})
+			So(err, ShouldBeNil)
+			user, err := cs.UserById(id)
+			So(err, ShouldBeNil)
+			user.Attributes["groups"].([]interface{})[0] = "guests"
+
+			user, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			groups, _ := user.Attributes.Strings("groups")
+			So(groups, ShouldResemble, []string{"admins", "devs"})
+			So(repo.lookups, ShouldEqual, 3)
+		})
+
+		Convey("The users not found are not cached", func() {
+			_, err = cs.UserById("404")
+			So(err, ShouldEqual, ErrUserNotFound)
+			_, err = cs.UserById("404")
+			So(err, ShouldEqual, ErrUserNotFound)
+			So(repo.lookups, ShouldEqual, 4)
+		})
+
+		Convey("The cached users expire after the ttl", func() {
+			now = now.Add(time.Minute)
+			_, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(repo.lookups, ShouldEqual, 3)
+		})
+
+		Convey("The least recently used users are evicted", func() {
+			other, err := cs.Signin("other@test.com", pass)
+			So(err, ShouldBeNil)
+
+			// the email lookup is used, so the id lookup is the least recent
+			_, err = cs.UserByEmail(email)
+			So(err, ShouldBeNil)
+			_, err = cs.UserById(other)
+			So(err, ShouldBeNil)
+			So(repo.lookups, ShouldEqual, 3)
+
+			_, err = cs.UserByEmail(email)
+			So(err, ShouldBeNil)
+			So(repo.lookups, ShouldEqual, 3)
+
+			_, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(repo.lookups, ShouldEqual, 4)
+		})
+
+		Convey("The writes remove the user from the cache", func() {
+			err = cs.UpdateEmail(id, "new@test.com")
+			So(err, ShouldBeNil)
+
+			user, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Email, ShouldEqual, "new@test.com")
+
+			_, err = cs.UserByEmail(email)
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			err = cs.UpdateAttributes(id, Attributes{"name": "Dave"})
+			So(err, ShouldBeNil)
+			user, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Attributes["name"], ShouldEqual, "Dave")
+
+			err = DisableUser(cs, id)
+			So(err, ShouldBeNil)
+			user, err = cs.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Status, ShouldEqual, StatusDisabled)
+
+			err = cs.DeleteUser(id)
+			So(err, ShouldBeNil)
+			_, err = cs.UserById(id)
+			So(err, ShouldEqual, ErrUserNotFound)
+		})
+
+		Convey("Login uses the fresh password", func() {
+			// changed in the repository, not through the cache
+			err = bs.UpdatePassword(id, "abcdef")
+			So(err, ShouldBeNil)
+
+			_, err = cs.Login(email, pass)
+			So(err, ShouldEqual, ErrWrongPassword)
+
+			loginId, err := cs.Login(email, "abcdef")
+			So(err, ShouldBeNil)
+			So(loginId, ShouldEqual, id)
+		})
+
+		Convey("A login removes the user, so the rehashed password is not stale", func() {
+			stronger, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.ScryptHasher{N: 1 << 15, R: 8, P: 1}})
+			So(err, ShouldBeNil)
+			cached := NewCachedStore(stronger, 2, time.Minute)
+			before, err := cached.UserById(id)
+			So(err, ShouldBeNil)
+
+			_, err = cached.Login(email, pass)
+			So(err, ShouldBeNil)
+			after, err := cached.UserById(id)
+			So(err, ShouldBeNil)
+			So(after.Password, ShouldNotEqual, before.Password)
+		})
+	})
+}
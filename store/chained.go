@@ -0,0 +1,429 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ChainedOptions struct {
+	// The repositories where Signin creates the users, by their position in the chain.
+	// The first one by default, the id of the user is the one of the first target
+	WriteTargets []int
+	// The users that log in with a repository after the first one are created in the first one,
+	// with the same email, password and attributes. The user is kept in the other repository.
+	// The lists of numbers or booleans are migrated as lists of strings, and the attributes
+	// that are not strings, numbers, booleans or lists, like the maps, are not migrated
+	MigrateOnLogin bool
+	// Called with the chained id of the user when a migration fails, the user logs in with
+	// the repository it has, or when some of its attributes are not migrated.
+	// The errors are logged if it is not set
+	OnMigrationError func(userId string, err error)
+}
+
+// UserRepository of the users of several repositories, for the migrations from a legacy store.
+// Login and the lookups by email try the repositories in order and the first one with the user wins,
+// a user with a wrong password in a repository does not log in with the next ones.
+// The ids of the users of the first repository are kept, so their tokens are the same with the chain,
+// and the ids of the users of the next ones are <position>:<id>, with the position of their repository
+// in the chain, so the same id in two repositories are different users, and the changes of a user go
+// to its repository. The ids of the first repository that look like <position>:<id> are 0:<id>.
+type ChainedStore struct {
+	repos   []ContextUserRepository
+	writes  []int
+	migrate bool
+	onError func(userId string, err error)
+}
+
+// The repositories in the order they are tried, the first one is the primary one
+func NewChainedStore(opt ChainedOptions, repos ...UserRepository) (*ChainedStore, error) {
+	if len(repos) == 0 {
+		return nil, errors.New("The chained store needs at least one repository")
+	}
+	writes := opt.WriteTargets
+	if len(writes) == 0 {
+		writes = []int{0}
+	}
+	for _, i := range writes {
+		if i < 0 || i >= len(repos) {
+			return nil, fmt.Errorf("The write target %d is not a repository of the chain", i)
+		}
+	}
+
+	cs := &ChainedStore{writes: writes, migrate: opt.MigrateOnLogin, onError: opt.OnMigrationError}
+	if cs.onError == nil {
+		cs.onError = func(userId string, err error) {
+			log.Printf("ERROR: Migrating the user %s: %v\n", userId, err)
+		}
+	}
+	for _, repo := range repos {
+		cs.repos = append(cs.repos, WithContext(repo))
+	}
+	return cs, nil
+}
+
+func (cs *ChainedStore) Signin(email, pass string) (string, error) {
+	return cs.SigninContext(context.Background(), email, pass)
+}
+
+func (cs *ChainedStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return cs.SigninWithAttributesContext(ctx, email, pass, nil)
+}
+
+func (cs *ChainedStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return cs.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+// The user is created in every write target, the email can not be in any repository of the chain.
+// When a target fails the user is kept in the targets before it
+func (cs *ChainedStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	_, err := cs.userByEmail(ctx, email)
+	if err == nil {
+		return "", ErrEmailDuplication
+	}
+	if err != ErrUserNotFound && err != ErrInvalidEmail {
+		return "", err
+	}
+
+	var userId string
+	for n, i := range cs.writes {
+		id, err := cs.repos[i].SigninWithAttributesContext(ctx, email, pass, attrs)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			userId = chainedId(i, id)
+		}
+	}
+	return userId, nil
+}
+
+func (cs *ChainedStore) Login(email, pass string) (string, error) {
+	return cs.LoginContext(context.Background(), email, pass)
+}
+
+func (cs *ChainedStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	for i, repo := range cs.repos {
+		userId, err := repo.LoginContext(ctx, email, pass)
+		if err == nil {
+			if i > 0 && cs.migrate {
+				return cs.migrateUser(ctx, i, userId, email, pass), nil
+			}
+			return chainedId(i, userId), nil
+		}
+		if err != ErrWrongPassword {
+			return "", err
+		}
+		// the password of a user of this repository is wrong, an old one of the next repositories is not tried
+		if _, err := repo.UserByEmailContext(ctx, email); err == nil {
+			return "", ErrWrongPassword
+		}
+	}
+	return "", ErrWrongPassword
+}
+
+// Creates the user of the repository i in the first one, and returns its id there.
+// When the user can not be created the error is reported and the user keeps the id it had
+func (cs *ChainedStore) migrateUser(ctx context.Context, i int, userId, email, pass string) string {
+	user, err := cs.repos[i].UserByIdContext(ctx, userId)
+	if err != nil {
+		cs.onError(chainedId(i, userId), err)
+		return chainedId(i, userId)
+	}
+	attrs, dropped := migratedAttributes(user.Attributes)
+	id, err := cs.repos[0].SigninWithAttributesContext(ctx, email, pass, attrs)
+	if err != nil {
+		cs.onError(chainedId(i, userId), err)
+		return chainedId(i, userId)
+	}
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		cs.onError(chainedId(0, id), fmt.Errorf("The attributes %s are not migrated, they are not strings, numbers, bools or lists",
+			strings.Join(dropped, ", ")))
+	}
+	return chainedId(0, id)
+}
+
+// The attributes of a legacy repository that are valid attributes, with the lists converted to lists of strings,
+// and the names of the ones that are not
+func migratedAttributes(attrs Attributes) (Attributes, []string) {
+	var dropped []string
+	migrated := make(Attributes, len(attrs))
+	for name, value := range attrs {
+		if attributeType(value) != 0 {
+			migrated[name] = value
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			dropped = append(dropped, name)
+			continue
+		}
+		values := make([]string, len(list))
+		for n, v := range list {
+			switch attributeType(v) {
+			case StringAttribute, NumberAttribute, BoolAttribute:
+				values[n] = fmt.Sprint(v)
+			default:
+				ok = false
+			}
+		}
+		if !ok {
+			dropped = append(dropped, name)
+			continue
+		}
+		migrated[name] = values
+	}
+	return migrated, dropped
+}
+
+func (cs *ChainedStore) UserByEmail(email string) (User, error) {
+	return cs.UserByEmailContext(context.Background(), email)
+}
+
+func (cs *ChainedStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	return cs.userByEmail(ctx, email)
+}
+
+func (cs *ChainedStore) UserById(userId string) (User, error) {
+	return cs.UserByIdContext(context.Background(), userId)
+}
+
+func (cs *ChainedStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	i, id, err := cs.parseId(userId)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := cs.repos[i].UserByIdContext(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	user.Id = chainedId(i, user.Id)
+	return user, nil
+}
+
+func (cs *ChainedStore) UpdatePassword(userId, pass string) error {
+	return cs.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (cs *ChainedStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	repo, id, err := cs.owner(userId)
+	if err != nil {
+		return err
+	}
+	return repo.UpdatePasswordContext(ctx, id, pass)
+}
+
+func (cs *ChainedStore) UpdateEmail(userId, email string) error {
+	return cs.UpdateEmailContext(context.Background(), userId, email)
+}
+
+// The new email can not be in any repository of the chain
+func (cs *ChainedStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	repo, id, err := cs.owner(userId)
+	if err != nil {
+		return err
+	}
+	user, err := cs.userByEmail(ctx, email)
+	if err == nil && user.Id != userId {
+		return ErrEmailDuplication
+	}
+	if err != nil && err != ErrUserNotFound && err != ErrInvalidEmail {
+		return err
+	}
+	return repo.UpdateEmailContext(ctx, id, email)
+}
+
+func (cs *ChainedStore) DeleteUser(userId string) error {
+	return cs.DeleteUserContext(context.Background(), userId)
+}
+
+func (cs *ChainedStore) DeleteUserContext(ctx context.Context, userId string) error {
+	repo, id, err := cs.owner(userId)
+	if err != nil {
+		return err
+	}
+	return repo.DeleteUserContext(ctx, id)
+}
+
+func (cs *ChainedStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return cs.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (cs *ChainedStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	repo, id, err := cs.owner(userId)
+	if err != nil {
+		return err
+	}
+	return repo.UpdateAttributesContext(ctx, id, attrs)
+}
+
+func (cs *ChainedStore) SetStatus(userId string, status Status, until time.Time) error {
+	return cs.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (cs *ChainedStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	repo, id, err := cs.owner(userId)
+	if err != nil {
+		return err
+	}
+	return repo.SetStatusContext(ctx, id, status, until)
+}
+
+func (cs *ChainedStore) PurgeUsers(now time.Time) ([]string, error) {
+	return cs.PurgeUsersContext(context.Background(), now)
+}
+
+// Purges the users of every repository, the read-only ones are skipped
+func (cs *ChainedStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	var purged []string
+	for i, repo := range cs.repos {
+		ids, err := repo.PurgeUsersContext(ctx, now)
+		for _, id := range ids {
+			purged = append(purged, chainedId(i, id))
+		}
+		if err != nil && err != ErrReadOnly {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (cs *ChainedStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return cs.ListUsersContext(context.Background(), cursor, limit)
+}
+
+// Lists the users of the repositories in order, the users with an email that is in a repository
+// before theirs are not listed. The cursor is the position of the repository and its cursor
+func (cs *ChainedStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	i, repoCursor, err := cs.parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var users []User
+	for i < len(cs.repos) {
+		want := 0
+		if limit > 0 {
+			want = limit - len(users)
+		}
+		page, next, err := cs.repos[i].ListUsersContext(ctx, repoCursor, want)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, user := range page {
+			hidden, err := cs.hidden(ctx, i, user)
+			if err != nil {
+				return nil, "", err
+			}
+			if !hidden {
+				user.Id = chainedId(i, user.Id)
+				users = append(users, user)
+			}
+		}
+
+		repoCursor = next
+		if next == "" {
+			i++
+		}
+		if limit > 0 && len(users) == limit {
+			break
+		}
+	}
+
+	if i == len(cs.repos) {
+		return users, "", nil
+	}
+	return users, strconv.Itoa(i) + ":" + repoCursor, nil
+}
+
+func (cs *ChainedStore) parseCursor(cursor string) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	parts := strings.SplitN(cursor, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrInvalidCursor
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil || i < 0 || i >= len(cs.repos) {
+		return 0, "", ErrInvalidCursor
+	}
+	return i, parts[1], nil
+}
+
+// A user with an email that is in a repository before the repository i, like a migrated user
+func (cs *ChainedStore) hidden(ctx context.Context, i int, user User) (bool, error) {
+	for _, repo := range cs.repos[:i] {
+		_, err := repo.UserByEmailContext(ctx, user.Email)
+		if err == nil {
+			return true, nil
+		}
+		if err != ErrUserNotFound && err != ErrInvalidEmail {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// The user of the first repository with the email
+func (cs *ChainedStore) userByEmail(ctx context.Context, email string) (User, error) {
+	for i, repo := range cs.repos {
+		user, err := repo.UserByEmailContext(ctx, email)
+		if err == nil {
+			user.Id = chainedId(i, user.Id)
+		}
+		if err != ErrUserNotFound {
+			return user, err
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// The repository of the user and its id there
+func (cs *ChainedStore) owner(userId string) (ContextUserRepository, string, error) {
+	i, id, err := cs.parseId(userId)
+	if err != nil {
+		return nil, "", err
+	}
+	return cs.repos[i], id, nil
+}
+
+// The id of the user of the repository in the position i
+func chainedId(i int, userId string) string {
+	if _, _, ok := splitPosition(userId); i == 0 && !ok {
+		return userId
+	}
+	return strconv.Itoa(i) + ":" + userId
+}
+
+// The position of the repository and the id there, the ids without a position are of the first repository.
+// ErrUserNotFound when the position is not in the chain
+func (cs *ChainedStore) parseId(userId string) (int, string, error) {
+	i, id, ok := splitPosition(userId)
+	if !ok {
+		return 0, userId, nil
+	}
+	if i >= len(cs.repos) {
+		return 0, "", ErrUserNotFound
+	}
+	return i, id, nil
+}
+
+// The position and the id of a <position>:<id>
+func splitPosition(userId string) (int, string, bool) {
+	parts := strings.SplitN(userId, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil || i < 0 || parts[0] != strconv.Itoa(i) {
+		return 0, "", false
+	}
+	return i, parts[1], true
+}
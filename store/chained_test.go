@@ -0,0 +1,292 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChainedStore(t *testing.T) {
+	Convey("The chained store logs in with the new store and falls back to the legacy one", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		DeleteBucket(t, db, "testBucketPrimary")
+		DeleteBucket(t, db, "testBucketLegacy")
+		primary, err := NewBoltStore(db, "testBucketPrimary")
+		So(err, ShouldBeNil)
+		legacy, err := NewBoltStore(db, "testBucketLegacy")
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		newId, err := primary.Signin("new@test.com", pass)
+		So(err, ShouldBeNil)
+		oldId, err := legacy.SigninWithAttributes("old@test.com", pass, Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+
+		cs, err := NewChainedStore(ChainedOptions{}, primary, legacy)
+		So(err, ShouldBeNil)
+
+		// the ids of the legacy store have its position
+		id, err := cs.Login("new@test.com", pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, newId)
+		id, err = cs.Login("old@test.com", pass)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "1:"+oldId)
+		_, err = cs.Login("old@test.com", "other")
+		So(err, ShouldEqual, ErrWrongPassword)
+		_, err = cs.Login("nobody@test.com", pass)
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		user, err := cs.UserByEmail("old@test.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, "1:"+oldId)
+		user, err = cs.UserById("1:" + oldId)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "old@test.com")
+		So(user.Id, ShouldEqual, "1:"+oldId)
+
+		user, err = cs.UserById(newId)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "new@test.com")
+		user, err = cs.UserById("0:" + newId)
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, newId)
+
+		// the ids of the legacy store without its position are not ids of the chain
+		for _, id := range []string{oldId, "0:" + oldId, "2:" + oldId, "01:" + oldId, "x:" + oldId} {
+			_, err = cs.UserById(id)
+			So(err, ShouldEqual, ErrUserNotFound)
+		}
+		So(cs.DeleteUser(oldId), ShouldEqual, ErrUserNotFound)
+
+		Convey("The old password of a user of the new store does not log in", func() {
+			_, err := legacy.Signin("new@test.com", "old password")
+			So(err, ShouldBeNil)
+			_, err = cs.Login("new@test.com", "old password")
+			So(err, ShouldEqual, ErrWrongPassword)
+		})
+
+		Convey("Signin creates the users in the write targets, the emails of any store are taken", func() {
+			_, err := cs.Signin("old@test.com", pass)
+			So(err, ShouldEqual, ErrEmailDuplication)
+
+			id, err := cs.Signin("other@test.com", pass)
+			So(err, ShouldBeNil)
+			user, err := cs.UserById(id)
+			So(err, ShouldBeNil)
+			user, err = primary.UserByEmail("other@test.com")
+			So(err, ShouldBeNil)
+			So(user.Id, ShouldEqual, id)
+			_, err = legacy.UserByEmail("other@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			both, err := NewChainedStore(ChainedOptions{WriteTargets: []int{0, 1}}, primary, legacy)
+			So(err, ShouldBeNil)
+			id, err = both.Signin("both@test.com", pass)
+			So(err, ShouldBeNil)
+			user, err = primary.UserByEmail("both@test.com")
+			So(err, ShouldBeNil)
+			So(user.Id, ShouldEqual, id)
+			_, err = legacy.UserByEmail("both@test.com")
+			So(err, ShouldBeNil)
+
+			_, err = NewChainedStore(ChainedOptions{WriteTargets: []int{2}}, primary, legacy)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The changes go to the store of the user", func() {
+			So(cs.UpdatePassword("1:"+oldId, "new password"), ShouldBeNil)
+			_, err := legacy.Login("old@test.com", "new password")
+			So(err, ShouldBeNil)
+
+			So(cs.UpdateEmail("1:"+oldId, "new@test.com"), ShouldEqual, ErrEmailDuplication)
+			So(cs.UpdateEmail("1:"+oldId, "old@test.com"), ShouldBeNil)
+			So(cs.DeleteUser("1:"+oldId), ShouldBeNil)
+			_, err = legacy.UserById(oldId)
+			So(err, ShouldEqual, ErrUserNotFound)
+		})
+
+		Convey("The users of the legacy store are migrated on login", func() {
+			cs, err := NewChainedStore(ChainedOptions{MigrateOnLogin: true}, primary, legacy)
+			So(err, ShouldBeNil)
+
+			id, err := cs.Login("old@test.com", pass)
+			So(err, ShouldBeNil)
+			user, err := primary.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Email, ShouldEqual, "old@test.com")
+			So(user.Attributes["name"], ShouldEqual, "David")
+
+			// the next login is with the new store
+			loginId, err := cs.Login("old@test.com", pass)
+			So(err, ShouldBeNil)
+			So(loginId, ShouldEqual, id)
+			loginId, err = primary.Login("old@test.com", pass)
+			So(err, ShouldBeNil)
+			So(loginId, ShouldEqual, id)
+
+			// the migrated users are listed once
+			users, next, err := cs.ListUsers("", 0)
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 2)
+			So(next, ShouldBeEmpty)
+		})
+
+		Convey("ListUsers lists the users of every store by pages", func() {
+			users, next, err := cs.ListUsers("", 1)
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 1)
+			So(users[0].Id, ShouldEqual, newId)
+			users, next, err = cs.ListUsers(next, 1)
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 1)
+			So(users[0].Id, ShouldEqual, "1:"+oldId)
+			So(next, ShouldBeEmpty)
+
+			_, _, err = cs.ListUsers("9:x", 1)
+			So(err, ShouldEqual, ErrInvalidCursor)
+		})
+	})
+
+	Convey("The same id in two stores are different users", t, func() {
+		dir, err := ioutil.TempDir("", "authchained")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		// the password of both is "password"
+		primaryPath := filepath.Join(dir, "primary.json")
+		writeFile(t, primaryPath, `{"users": [
+			{"id": "1", "email": "new@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}
+		]}`)
+		legacyPath := filepath.Join(dir, "legacy.json")
+		writeFile(t, legacyPath, `{"users": [
+			{"id": "1", "email": "old@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}
+		]}`)
+
+		cs, err := NewChainedStore(ChainedOptions{}, mustFileStore(t, primaryPath, JSONFile), mustFileStore(t, legacyPath, JSONFile))
+		So(err, ShouldBeNil)
+
+		newId, err := cs.Login("new@test.com", "password")
+		So(err, ShouldBeNil)
+		oldId, err := cs.Login("old@test.com", "password")
+		So(err, ShouldBeNil)
+		So(newId, ShouldNotEqual, oldId)
+
+		user, err := cs.UserById(oldId)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "old@test.com")
+		user, err = cs.UserById(newId)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "new@test.com")
+
+		// the changes go to the store of the user, that is read-only
+		So(cs.DeleteUser(oldId), ShouldEqual, ErrReadOnly)
+
+		users, _, err := cs.ListUsers("", 0)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Id, ShouldEqual, newId)
+		So(users[1].Id, ShouldEqual, oldId)
+	})
+
+	Convey("The users with lists and maps in their attributes are migrated", t, func() {
+		dir, err := ioutil.TempDir("", "authchained")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		legacyPath := filepath.Join(dir, "legacy.yaml")
+		writeFile(t, legacyPath, `users:
+  - id: "1"
+    email: old@test.com
+    password: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="
+    attributes:
+      name: Dave
+      groups: [admins, devs]
+      codes: [1, 2]
+      address:
+        city: Madrid
+`)
+
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+		DeleteBucket(t, db, "testBucketPrimary")
+		primary, err := NewBoltStore(db, "testBucketPrimary")
+		So(err, ShouldBeNil)
+
+		var reported []string
+		cs, err := NewChainedStore(ChainedOptions{
+			MigrateOnLogin: true,
+			OnMigrationError: func(userId string, err error) {
+				reported = append(reported, userId+": "+err.Error())
+			},
+		}, primary, mustFileStore(t, legacyPath, YAMLFile))
+		So(err, ShouldBeNil)
+
+		id, err := cs.Login("old@test.com", "password")
+		So(err, ShouldBeNil)
+		So(reported, ShouldResemble, []string{id + ": The attributes address are not migrated, they are not strings, numbers, bools or lists"})
+
+		user, err := primary.UserByEmail("old@test.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, id)
+		groups, _ := user.Attributes.Strings("groups")
+		So(groups, ShouldResemble, []string{"admins", "devs"})
+		codes, _ := user.Attributes.Strings("codes")
+		So(codes, ShouldResemble, []string{"1", "2"})
+		So(user.Attributes["name"], ShouldEqual, "Dave")
+
+		Convey("The failed migrations are reported and the user logs in with the legacy store", func() {
+			DeleteBucket(t, db, "testBucketPrimary")
+			strict, err := NewBoltStoreWithOptions(db, "testBucketPrimary", BoltOptions{
+				AttributeSchema: AttributeSchema{"name": {Type: StringAttribute}},
+			})
+			So(err, ShouldBeNil)
+			reported = nil
+			cs, err := NewChainedStore(ChainedOptions{
+				MigrateOnLogin: true,
+				OnMigrationError: func(userId string, err error) {
+					reported = append(reported, userId+": "+err.Error())
+				},
+			}, strict, mustFileStore(t, legacyPath, YAMLFile))
+			So(err, ShouldBeNil)
+
+			id, err := cs.Login("old@test.com", "password")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "1:1")
+			So(len(reported), ShouldEqual, 1)
+			So(reported[0], ShouldStartWith, "1:1: Invalid attribute")
+			_, err = strict.UserByEmail("old@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+		})
+	})
+}
+
+func TestChainedIds(t *testing.T) {
+	Convey("The ids of the first store are kept unless they look like the ids of another store", t, func() {
+		cs := &ChainedStore{repos: make([]ContextUserRepository, 2)}
+		for _, c := range []struct {
+			position  int
+			id, chain string
+		}{
+			{0, "a1b2", "a1b2"},
+			{0, "x:a1b2", "x:a1b2"},
+			{0, "1:a1b2", "0:1:a1b2"},
+			{1, "a1b2", "1:a1b2"},
+			{1, "1:a1b2", "1:1:a1b2"},
+		} {
+			So(chainedId(c.position, c.id), ShouldEqual, c.chain)
+			i, id, err := cs.parseId(c.chain)
+			So(err, ShouldBeNil)
+			So(i, ShouldEqual, c.position)
+			So(id, ShouldEqual, c.id)
+		}
+
+		_, _, err := cs.parseId("2:a1b2")
+		So(err, ShouldEqual, ErrUserNotFound)
+	})
+}
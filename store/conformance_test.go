@@ -0,0 +1,124 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dahernan/auth/store"
+	"github.com/dahernan/auth/store/storetest"
+)
+
+// Bolt store in a new database file
+func newBoltStore(t *testing.T) (*store.BoltStore, func()) {
+	return newBoltStoreWithOptions(t, store.BoltOptions{})
+}
+
+func newBoltStoreWithOptions(t *testing.T, opt store.BoltOptions) (*store.BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "authbolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "users.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := store.NewBoltStoreWithOptions(db, "users", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		return newBoltStore(t)
+	})
+}
+
+func TestEncryptedBoltConformance(t *testing.T) {
+	kek, err := store.NewKeyRing("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		return newBoltStoreWithOptions(t, store.BoltOptions{
+			Encryption: &store.Encryption{KEK: kek, IndexKey: []byte("index key of the emails, 32 byte")},
+		})
+	})
+}
+
+func TestTenantBoltConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		dir, err := ioutil.TempDir("", "authbolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bolt.Open(filepath.Join(dir, "users.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := store.NewTenantBoltStore(db, "tenants", store.BoltOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ts.CreateTenant("acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs, func() {
+			db.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestRedisConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		fr := store.NewFakeRedis(t)
+		rs, err := store.NewRedisStore(store.NewRedisPool(fr.Addr()), "test:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs, fr.Close
+	})
+}
+
+func TestSQLConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		db, closeDB := store.NewSQLiteDB(t)
+		ss, err := store.NewSQLStore(db, store.SQLite, "users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ss, closeDB
+	})
+}
+
+func TestCachedStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		bs, cleanup := newBoltStore(t)
+		return store.NewCachedStore(bs, 100, time.Minute), cleanup
+	})
+}
+
+func TestChainedStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+		primary, cleanupPrimary := newBoltStore(t)
+		legacy, cleanupLegacy := newBoltStore(t)
+		cs, err := store.NewChainedStore(store.ChainedOptions{MigrateOnLogin: true}, primary, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs, func() {
+			cleanupPrimary()
+			cleanupLegacy()
+		}
+	})
+}
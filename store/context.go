@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// UserRepository with a context in every operation, so the operations of a slow store
+// are cancelled when the request is gone, and the deadlines of the requests are respected.
+// The stores of this package implement both interfaces, use WithContext and WithoutContext
+// to adapt the ones that implement only one of them.
+type ContextUserRepository interface {
+	SigninContext(ctx context.Context, email, pass string) (string, error)
+	SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error)
+	LoginContext(ctx context.Context, email, pass string) (string, error)
+	UserByEmailContext(ctx context.Context, email string) (User, error)
+	UserByIdContext(ctx context.Context, userId string) (User, error)
+	UpdatePasswordContext(ctx context.Context, userId, pass string) error
+	UpdateEmailContext(ctx context.Context, userId, email string) error
+	DeleteUserContext(ctx context.Context, userId string) error
+	UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error
+	SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error
+	PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error)
+	ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error)
+}
+
+// The repository with the context operations. When it does not have them,
+// the context is checked before every operation, but an operation that started is not stopped
+func WithContext(repo UserRepository) ContextUserRepository {
+	if ctxRepo, ok := repo.(ContextUserRepository); ok {
+		return ctxRepo
+	}
+	return contextAdapter{repo}
+}
+
+// The repository without the context operations, they are called with context.Background()
+func WithoutContext(repo ContextUserRepository) UserRepository {
+	if plainRepo, ok := repo.(UserRepository); ok {
+		return plainRepo
+	}
+	return backgroundAdapter{repo}
+}
+
+type contextAdapter struct {
+	repo UserRepository
+}
+
+func (ca contextAdapter) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return ca.repo.Signin(email, pass)
+}
+
+func (ca contextAdapter) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return ca.repo.SigninWithAttributes(email, pass, attrs)
+}
+
+func (ca contextAdapter) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return ca.repo.Login(email, pass)
+}
+
+func (ca contextAdapter) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	return ca.repo.UserByEmail(email)
+}
+
+func (ca contextAdapter) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	return ca.repo.UserById(userId)
+}
+
+func (ca contextAdapter) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.repo.UpdatePassword(userId, pass)
+}
+
+func (ca contextAdapter) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.repo.UpdateEmail(userId, email)
+}
+
+func (ca contextAdapter) DeleteUserContext(ctx context.Context, userId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.repo.DeleteUser(userId)
+}
+
+func (ca contextAdapter) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.repo.UpdateAttributes(userId, attrs)
+}
+
+func (ca contextAdapter) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.repo.SetStatus(userId, status, until)
+}
+
+func (ca contextAdapter) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ca.repo.PurgeUsers(now)
+}
+
+func (ca contextAdapter) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return ca.repo.ListUsers(cursor, limit)
+}
+
+type backgroundAdapter struct {
+	repo ContextUserRepository
+}
+
+func (ba backgroundAdapter) Signin(email, pass string) (string, error) {
+	return ba.repo.SigninContext(context.Background(), email, pass)
+}
+
+func (ba backgroundAdapter) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return ba.repo.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (ba backgroundAdapter) Login(email, pass string) (string, error) {
+	return ba.repo.LoginContext(context.Background(), email, pass)
+}
+
+func (ba backgroundAdapter) UserByEmail(email string) (User, error) {
+	return ba.repo.UserByEmailContext(context.Background(), email)
+}
+
+func (ba backgroundAdapter) UserById(userId string) (User, error) {
+	return ba.repo.UserByIdContext(context.Background(), userId)
+}
+
+func (ba backgroundAdapter) UpdatePassword(userId, pass string) error {
+	return ba.repo.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (ba backgroundAdapter) UpdateEmail(userId, email string) error {
+	return ba.repo.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (ba backgroundAdapter) DeleteUser(userId string) error {
+	return ba.repo.DeleteUserContext(context.Background(), userId)
+}
+
+func (ba backgroundAdapter) UpdateAttributes(userId string, attrs Attributes) error {
+	return ba.repo.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (ba backgroundAdapter) SetStatus(userId string, status Status, until time.Time) error {
+	return ba.repo.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (ba backgroundAdapter) PurgeUsers(now time.Time) ([]string, error) {
+	return ba.repo.PurgeUsersContext(context.Background(), now)
+}
+
+func (ba backgroundAdapter) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return ba.repo.ListUsersContext(context.Background(), cursor, limit)
+}
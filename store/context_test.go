@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContextAdapters(t *testing.T) {
+	Convey("The repositories are adapted to and from the context operations", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketContext"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		// the stores of the package have both
+		So(WithContext(bs), ShouldEqual, bs)
+		So(WithoutContext(bs), ShouldEqual, bs)
+
+		// a repository without the context operations
+		repo := &countingRepo{UserRepository: bs}
+		ctxRepo := WithContext(repo)
+		So(ctxRepo, ShouldHaveSameTypeAs, contextAdapter{})
+
+		id, err := ctxRepo.SigninContext(context.Background(), "ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		_, err = ctxRepo.UserByIdContext(ctx, id)
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		So(repo.lookups, ShouldEqual, 0)
+
+		// and back
+		plain := WithoutContext(ctxRepo.(contextAdapter))
+		So(plain, ShouldHaveSameTypeAs, backgroundAdapter{})
+		user, err := plain.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "ddhhpp@test.com")
+		So(repo.lookups, ShouldEqual, 1)
+	})
+}
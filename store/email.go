@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var ErrInvalidEmail = errors.New("The email is not valid")
+
+// Normalizes the emails before they are stored or looked up,
+// so the same mailbox written in different ways is the same user
+type EmailNormalizer func(email string) (string, error)
+
+// Trims the spaces, lower cases the email and converts
+// internationalized domains to ASCII (punycode)
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", ErrInvalidEmail
+	}
+
+	local := strings.ToLower(email[:at])
+	domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(email[at+1:], "."))
+	if err != nil || domain == "" {
+		return "", ErrInvalidEmail
+	}
+
+	return local + "@" + domain, nil
+}
+
+// Like NormalizeEmail, and applies the rules of the email providers
+// that deliver different addresses to the same mailbox, Gmail ignores
+// the dots and the +tag of the address, and googlemail.com is gmail.com
+func NormalizeEmailProviders(email string) (string, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+
+	switch domain {
+	case "gmail.com", "googlemail.com":
+		if plus := strings.Index(local, "+"); plus >= 0 {
+			local = local[:plus]
+		}
+		local = strings.Replace(local, ".", "", -1)
+		if local == "" {
+			return "", ErrInvalidEmail
+		}
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain, nil
+}
+
+// Finds the users of the repository that are the same user when the emails are normalized,
+// they were stored before the normalization or with a different normalizer.
+// Each group has the users with the same normalized email.
+func FindEmailCollisions(repo UserRepository, normalize EmailNormalizer) ([][]User, error) {
+	var all []User
+	cursor := ""
+	for {
+		users, next, err := repo.ListUsers(cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, users...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	var collisions [][]User
+	order, groups := groupByEmail(all, normalize)
+	for _, email := range order {
+		if len(groups[email]) > 1 {
+			collisions = append(collisions, groups[email])
+		}
+	}
+	return collisions, nil
+}
+
+// Groups the users by the normalized email, and returns the emails in the order they are found
+func groupByEmail(users []User, normalize EmailNormalizer) ([]string, map[string][]User) {
+	groups := make(map[string][]User)
+	var order []string
+	for _, user := range users {
+		email, err := normalize(user.Email)
+		if err != nil {
+			// not a valid email, so it can not collide
+			email = user.Email
+		}
+		if _, ok := groups[email]; !ok {
+			order = append(order, email)
+		}
+		groups[email] = append(groups[email], user)
+	}
+	return order, groups
+}
+
+// The emails to look up a user: the normalized email, and the email as it is given
+// to find the users that were stored before the emails were normalized
+func lookupEmails(normalize EmailNormalizer, email string) []string {
+	normalized, err := normalize(email)
+	if err != nil {
+		return []string{email}
+	}
+	if normalized == email {
+		return []string{normalized}
+	}
+	return []string{normalized, email}
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	Convey("Normalizes the case, the spaces and the domain of the emails", t, func() {
+		email, err := NormalizeEmail("  Bob@Example.COM ")
+		So(err, ShouldBeNil)
+		So(email, ShouldEqual, "bob@example.com")
+
+		email, err = NormalizeEmail("josé@Bücher.example")
+		So(err, ShouldBeNil)
+		So(email, ShouldEqual, "josé@xn--bcher-kva.example")
+
+		email, err = NormalizeEmail("bob.smith+news@gmail.com")
+		So(err, ShouldBeNil)
+		So(email, ShouldEqual, "bob.smith+news@gmail.com")
+
+		for _, invalid := range []string{"", "bob", "@example.com", "bob@", "bob@exa mple.com"} {
+			_, err = NormalizeEmail(invalid)
+			So(err, ShouldEqual, ErrInvalidEmail)
+		}
+	})
+}
+
+func TestNormalizeEmailProviders(t *testing.T) {
+	Convey("Normalizes the addresses that go to the same Gmail mailbox", t, func() {
+		email, err := NormalizeEmailProviders("Bob.Smith+news@GoogleMail.com")
+		So(err, ShouldBeNil)
+		So(email, ShouldEqual, "bobsmith@gmail.com")
+
+		email, err = NormalizeEmailProviders("bob.smith+news@example.com")
+		So(err, ShouldBeNil)
+		So(email, ShouldEqual, "bob.smith+news@example.com")
+
+		_, err = NormalizeEmailProviders("+news@gmail.com")
+		So(err, ShouldEqual, ErrInvalidEmail)
+	})
+}
+
+func TestNormalizedEmailsInBolt(t *testing.T) {
+	Convey("Bolt finds the users by the normalized email", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketNormalize"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{EmailNormalizer: NormalizeEmailProviders})
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := bs.Signin(" Bob.Smith@Gmail.com", pass)
+		So(err, ShouldBeNil)
+
+		_, err = bs.Signin("bobsmith+other@gmail.com", pass)
+		So(err, ShouldEqual, ErrEmailDuplication)
+
+		_, err = bs.Signin("not an email", pass)
+		So(err, ShouldEqual, ErrInvalidEmail)
+
+		user, err := bs.UserByEmail("BOBSMITH@googlemail.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, id)
+		So(user.Email, ShouldEqual, "bobsmith@gmail.com")
+
+		loginId, err := bs.Login("bob.smith@gmail.com", pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+	})
+}
+
+func TestEmailCollisions(t *testing.T) {
+	Convey("Finds the users stored before the normalization that are the same user", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketCollisions"
+		DeleteBucket(t, db, bucket)
+
+		// users stored as they were given before the normalization
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			for i, email := range []string{"Bob@Example.com", "bob@example.com", "Carol@Example.com"} {
+				user, err := NewUser(strconv.Itoa(i+1), email, "123456")
+				if err != nil {
+					return err
+				}
+				if err = putUser(b, user); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		// the users stored as they were given are found with the same email
+		user, err := bs.UserByEmail("Carol@Example.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, "3")
+
+		_, err = bs.UserByEmail("carol@example.com")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		collisions, err := FindEmailCollisions(bs, NormalizeEmail)
+		So(err, ShouldBeNil)
+		So(len(collisions), ShouldEqual, 1)
+		So(len(collisions[0]), ShouldEqual, 2)
+		So(collisions[0][0].Email, ShouldEqual, "Bob@Example.com")
+		So(collisions[0][1].Email, ShouldEqual, "bob@example.com")
+
+		collisions, err = bs.NormalizeEmails()
+		So(err, ShouldBeNil)
+		So(len(collisions), ShouldEqual, 1)
+
+		user, err = bs.UserByEmail("CAROL@example.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, "3")
+		So(user.Email, ShouldEqual, "carol@example.com")
+
+		_, err = bs.Signin("carol@example.com", "123456")
+		So(err, ShouldEqual, ErrEmailDuplication)
+
+		// the collisions are not changed
+		user, err = bs.UserById("1")
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "Bob@Example.com")
+	})
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dahernan/auth/crypto"
+)
+
+var (
+	ErrUnknownKey      = errors.New("Unknown encryption key")
+	ErrEncryptedRecord = errors.New("The record is encrypted and the store has no keys")
+	ErrDecryption      = errors.New("The record can not be decrypted")
+	ErrNoEncryption    = errors.New("The store has no encryption")
+)
+
+// Encryption of the users at rest. Every record has its own data key, that
+// encrypts the email and the attributes with AES-GCM, and the data key is stored
+// encrypted with the key encryption key. The emails in the index are a keyed HMAC,
+// so the users are found by email without storing it in clear.
+type Encryption struct {
+	// Encrypts the data keys of the records
+	KEK KeyEncryptionKey
+	// Key of the HMAC of the emails in the index, at least 32 bytes
+	IndexKey []byte
+}
+
+// Encrypts the data keys of the records, it can be a key in memory like KeyRing, or a KMS.
+// The records keep the id of the key, so after a rotation the old records are
+// decrypted with the old key until they are encrypted again
+type KeyEncryptionKey interface {
+	// The id of the key that encrypts the new data keys
+	KeyId() string
+	WrapKey(dataKey []byte) ([]byte, error)
+	// Decrypts a data key encrypted with the key of the id, ErrUnknownKey if the key is not known
+	UnwrapKey(keyId string, wrapped []byte) ([]byte, error)
+}
+
+// Key encryption keys in memory, AES-256 keys by id.
+// The data keys are encrypted with the current one, and decrypted with any of them
+type KeyRing struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func NewKeyRing(currentId string, keys map[string][]byte) (*KeyRing, error) {
+	kr := &KeyRing{
+		current: currentId,
+		keys:    make(map[string]cipher.AEAD),
+	}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("The key %q is not an AES-256 key", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+	if _, ok := kr.keys[currentId]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return kr, nil
+}
+
+func (kr *KeyRing) KeyId() string {
+	return kr.current
+}
+
+func (kr *KeyRing) WrapKey(dataKey []byte) ([]byte, error) {
+	return sealGCM(kr.keys[kr.current], dataKey, []byte(kr.current))
+}
+
+func (kr *KeyRing) UnwrapKey(keyId string, wrapped []byte) ([]byte, error) {
+	aead, ok := kr.keys[keyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return openGCM(aead, wrapped, []byte(keyId))
+}
+
+// The encrypted fields of a record
+type sealedRecord struct {
+	KeyId string `json:"key_id"`
+	// the data key encrypted with the key encryption key
+	Key  []byte `json:"key"`
+	Data []byte `json:"data"`
+	// the version of the additional data of Data, 0 for the records sealed with only the id
+	AD int `json:"ad,omitempty"`
+}
+
+// The additional data of the records has the tenant and the version of the record
+const sealedADVersion = 1
+
+type sealedFields struct {
+	Email      string     `json:"email"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// Encrypts and decrypts the records of a store
+type recordCipher struct {
+	kek      KeyEncryptionKey
+	indexKey []byte
+	// the tenant of the store, authenticated with the records
+	tenant string
+}
+
+func newRecordCipher(enc *Encryption) (*recordCipher, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	if enc.KEK == nil || len(enc.IndexKey) < 32 {
+		return nil, errors.New("The encryption needs a key encryption key and an index key of 32 bytes")
+	}
+	return &recordCipher{kek: enc.KEK, indexKey: enc.IndexKey}, nil
+}
+
+// Moves the email and the attributes of the record of the version to its encrypted fields
+func (c *recordCipher) seal(r *userRecord, version int) error {
+	data, err := json.Marshal(sealedFields{Email: r.Email, Attributes: r.Attributes})
+	if err != nil {
+		return err
+	}
+
+	dataKey := crypto.GenerateRandomKey(32)
+	if dataKey == nil {
+		return errors.New("Generating the data key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	data, err = sealGCM(aead, data, c.additionalData(sealedADVersion, version, r.Id))
+	if err != nil {
+		return err
+	}
+	key, err := c.kek.WrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+
+	r.Email = ""
+	r.Attributes = nil
+	r.Sealed = &sealedRecord{KeyId: c.kek.KeyId(), Key: key, Data: data, AD: sealedADVersion}
+	return nil
+}
+
+// Decrypts the email and the attributes of the record of the version
+func (c *recordCipher) open(r *userRecord, version int) error {
+	if c == nil {
+		return ErrEncryptedRecord
+	}
+	dataKey, err := c.kek.UnwrapKey(r.Sealed.KeyId, r.Sealed.Key)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	data, err := openGCM(aead, r.Sealed.Data, c.additionalData(r.Sealed.AD, version, r.Id))
+	if err != nil {
+		return err
+	}
+
+	var fields sealedFields
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	r.Email = fields.Email
+	r.Attributes = fields.Attributes
+	r.Sealed = nil
+	return nil
+}
+
+// The id, the tenant of the store and the version of the record are authenticated with the encrypted fields,
+// so they can not be moved to another user, to the same id in another tenant or to another version of the record.
+// The records sealed before the tenant and the version were added only have the id
+func (c *recordCipher) additionalData(adVersion, version int, id string) []byte {
+	if adVersion == 0 {
+		return []byte(id)
+	}
+	ad, _ := json.Marshal([]interface{}{adVersion, version, c.tenant, id})
+	return ad
+}
+
+// The id of the key of an encrypted record, empty when the record is in clear
+func recordKeyId(b []byte) string {
+	var env recordEnvelope
+	err := json.Unmarshal(b, &env)
+	if err != nil || env.User.Sealed == nil {
+		return ""
+	}
+	return env.User.Sealed.KeyId
+}
+
+// The key of the email in the index
+func (c *recordCipher) emailKey(email string) []byte {
+	if c == nil {
+		return []byte(email)
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(email))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The nonce is random, and it is before the ciphertext
+func sealGCM(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := crypto.GenerateRandomKey(aead.NonceSize())
+	if nonce == nil {
+		return nil, errors.New("Generating the nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openGCM(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var (
+	oldKey   = []byte("0123456789abcdef0123456789abcdef")
+	newKey   = []byte("fedcba9876543210fedcba9876543210")
+	indexKey = []byte("index key of the emails, 32 byte")
+)
+
+func encryption(t *testing.T, current string) *Encryption {
+	kek, err := NewKeyRing(current, map[string][]byte{"old": oldKey, "new": newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Encryption{KEK: kek, IndexKey: indexKey}
+}
+
+// The stored records and the index have the email in clear
+func emailInClear(t *testing.T, db *bolt.DB, bucket, email string) bool {
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucket, bucket + ".email"} {
+			tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				if bytes.Contains(k, []byte(email)) || bytes.Contains(v, []byte(email)) {
+					found = true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return found
+}
+
+// The record sealed again with only the id as additional data, like the records of the first encrypted stores
+func sealWithId(c *recordCipher, v []byte) ([]byte, error) {
+	var env recordEnvelope
+	err := json.Unmarshal(v, &env)
+	if err != nil {
+		return nil, err
+	}
+	r := env.User
+	dataKey, err := c.kek.UnwrapKey(r.Sealed.KeyId, r.Sealed.Key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openGCM(aead, r.Sealed.Data, c.additionalData(r.Sealed.AD, env.Version, r.Id))
+	if err != nil {
+		return nil, err
+	}
+	r.Sealed.Data, err = sealGCM(aead, data, []byte(r.Id))
+	if err != nil {
+		return nil, err
+	}
+	r.Sealed.AD = 0
+	env.User = r
+	return json.Marshal(env)
+}
+
+func TestKeyRing(t *testing.T) {
+	Convey("The key ring wraps with the current key and unwraps with any key", t, func() {
+		kr, err := NewKeyRing("new", map[string][]byte{"old": oldKey, "new": newKey})
+		So(err, ShouldBeNil)
+		So(kr.KeyId(), ShouldEqual, "new")
+
+		wrapped, err := kr.WrapKey([]byte("data key"))
+		So(err, ShouldBeNil)
+		key, err := kr.UnwrapKey("new", wrapped)
+		So(err, ShouldBeNil)
+		So(string(key), ShouldEqual, "data key")
+
+		_, err = kr.UnwrapKey("old", wrapped)
+		So(err, ShouldEqual, ErrDecryption)
+		_, err = kr.UnwrapKey("other", wrapped)
+		So(err, ShouldEqual, ErrUnknownKey)
+
+		_, err = NewKeyRing("other", map[string][]byte{"old": oldKey})
+		So(err, ShouldEqual, ErrUnknownKey)
+		_, err = NewKeyRing("short", map[string][]byte{"short": []byte("short")})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEncryptedBoltStore(t *testing.T) {
+	Convey("The emails and the attributes are encrypted at rest", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketEncrypted"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Encryption: encryption(t, "old")})
+		So(err, ShouldBeNil)
+
+		id, err := bs.SigninWithAttributes("ddhhpp@test.com", "123456", Attributes{"name": "Secret Name"})
+		So(err, ShouldBeNil)
+
+		So(emailInClear(t, db, bucket, "ddhhpp@test.com"), ShouldBeFalse)
+		So(emailInClear(t, db, bucket, "Secret Name"), ShouldBeFalse)
+
+		user, err := bs.UserByEmail("ddhhpp@test.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, id)
+		So(user.Attributes["name"], ShouldEqual, "Secret Name")
+
+		Convey("A store without the keys can not read the users", func() {
+			plain, err := NewBoltStore(db, bucket)
+			So(err, ShouldBeNil)
+			_, err = plain.UserById(id)
+			So(err, ShouldEqual, ErrEncryptedRecord)
+			_, err = plain.UserByEmail("ddhhpp@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+		})
+
+		Convey("The encrypted fields can not be moved to another user", func() {
+			err := db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte(bucket))
+				return b.Put([]byte("other-id"), bytes.Replace(b.Get([]byte(id)), []byte(id), []byte("other-id"), -1))
+			})
+			So(err, ShouldBeNil)
+
+			_, err = bs.UserById("other-id")
+			So(err, ShouldEqual, ErrDecryption)
+		})
+
+		Convey("The records sealed with only the id are read and sealed again", func() {
+			err := db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte(bucket))
+				v, err := sealWithId(bs.cipher, b.Get([]byte(id)))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte(id), v)
+			})
+			So(err, ShouldBeNil)
+
+			user, err := bs.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Attributes["name"], ShouldEqual, "Secret Name")
+
+			n, err := bs.ReencryptRecords()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			n, err = bs.ReencryptRecords()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("After a rotation of the key the records are encrypted again", func() {
+			rotated, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Encryption: encryption(t, "new")})
+			So(err, ShouldBeNil)
+
+			_, err = rotated.Signin("other@test.com", "123456")
+			So(err, ShouldBeNil)
+
+			// the old records are still read with the old key
+			user, err := rotated.UserByEmail("ddhhpp@test.com")
+			So(err, ShouldBeNil)
+			So(user.Id, ShouldEqual, id)
+
+			n, err := rotated.ReencryptRecords()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			onlyNew, err := NewKeyRing("new", map[string][]byte{"new": newKey})
+			So(err, ShouldBeNil)
+			bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{
+				Encryption: &Encryption{KEK: onlyNew, IndexKey: indexKey},
+			})
+			So(err, ShouldBeNil)
+			user, err = bs.UserByEmail("ddhhpp@test.com")
+			So(err, ShouldBeNil)
+			So(user.Attributes["name"], ShouldEqual, "Secret Name")
+
+			n, err = bs.ReencryptRecords()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("After a change of the index key the index is built again", func() {
+			enc := encryption(t, "old")
+			enc.IndexKey = []byte("another index key of the emails.")
+			rekeyed, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Encryption: enc})
+			So(err, ShouldBeNil)
+
+			_, err = rekeyed.UserByEmail("ddhhpp@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			_, err = rekeyed.ReencryptRecords()
+			So(err, ShouldBeNil)
+
+			user, err := rekeyed.UserByEmail("ddhhpp@test.com")
+			So(err, ShouldBeNil)
+			So(user.Id, ShouldEqual, id)
+		})
+	})
+
+	Convey("The users in clear are encrypted when the encryption is set", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketEncrypted"
+		DeleteBucket(t, db, bucket)
+		plain, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+		id, err := plain.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(emailInClear(t, db, bucket, "ddhhpp@test.com"), ShouldBeTrue)
+
+		_, err = plain.ReencryptRecords()
+		So(err, ShouldEqual, ErrNoEncryption)
+
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Encryption: encryption(t, "old")})
+		So(err, ShouldBeNil)
+		n, err := bs.ReencryptRecords()
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		So(emailInClear(t, db, bucket, "ddhhpp@test.com"), ShouldBeFalse)
+		loginId, err := bs.Login("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+	})
+
+	Convey("The encryption needs the keys", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		_, err := NewBoltStoreWithOptions(db, "testBucketEncrypted", BoltOptions{Encryption: &Encryption{IndexKey: indexKey}})
+		So(err, ShouldNotBeNil)
+		_, err = NewBoltStoreWithOptions(db, "testBucketEncrypted", BoltOptions{
+			Encryption: &Encryption{KEK: encryption(t, "old").KEK, IndexKey: []byte("short")},
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Format of the file of a FileStore
+type FileFormat int
+
+const (
+	// Apache htpasswd file, "user:hash" lines with bcrypt, SHA or apr1 hashes,
+	// the user is the email and the id
+	HtpasswdFile FileFormat = iota
+	// {"users": [{"id": "...", "email": "...", "password": "<hash>", "attributes": {...}, "status": "..."}]}
+	// the hashes are the ones of htpasswd, and the id is the email when it is empty
+	JSONFile
+	// The same users of the JSON file in YAML
+	YAMLFile
+)
+
+type fileUser struct {
+	Id         string     `json:"id" yaml:"id"`
+	Email      string     `json:"email" yaml:"email"`
+	Password   string     `json:"password" yaml:"password"`
+	Attributes Attributes `json:"attributes" yaml:"attributes"`
+	Status     Status     `json:"status" yaml:"status"`
+}
+
+type usersFile struct {
+	Users []fileUser `json:"users" yaml:"users"`
+}
+
+// Read-only UserRepository of the users of a file, for small deployments
+// that manage the users by hand. The file is read again when it changes,
+// and when the new file has errors the store keeps the users it had.
+// The operations that change the users return ErrReadOnly.
+type FileStore struct {
+	path      string
+	format    FileFormat
+	normalize EmailNormalizer
+	interval  time.Duration
+	now       func() time.Time
+
+	mu      sync.RWMutex
+	users   map[string]User
+	emails  map[string]string
+	ids     []string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// Reads the users of the file, the file has to be valid
+func NewFileStore(path string, format FileFormat) (*FileStore, error) {
+	fs := &FileStore{
+		path:      path,
+		format:    format,
+		normalize: NormalizeEmail,
+		interval:  time.Second,
+		now:       time.Now,
+	}
+	err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// The file is checked for changes at most once in the interval, one second by default
+func (fs *FileStore) SetReloadInterval(interval time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.interval = interval
+}
+
+func (fs *FileStore) UserByEmail(email string) (User, error) {
+	return fs.UserByEmailContext(context.Background(), email)
+}
+
+func (fs *FileStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	if err := fs.refresh(ctx); err != nil {
+		return User{}, err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for _, e := range lookupEmails(fs.normalize, email) {
+		if id, ok := fs.emails[e]; ok {
+			return copyUser(fs.users[id]), nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (fs *FileStore) UserById(userId string) (User, error) {
+	return fs.UserByIdContext(context.Background(), userId)
+}
+
+func (fs *FileStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	if err := fs.refresh(ctx); err != nil {
+		return User{}, err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	user, ok := fs.users[userId]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (fs *FileStore) Login(email, pass string) (string, error) {
+	return fs.LoginContext(context.Background(), email, pass)
+}
+
+func (fs *FileStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	user, err := fs.UserByEmailContext(ctx, email)
+	if err == ErrUserNotFound {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = checkHtpasswd(user.Password, pass)
+	if err != nil {
+		return "", err
+	}
+
+	err = user.CheckStatus(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+// Users are listed in the order of the ids,
+// and the cursor is the id of the last user of the page
+func (fs *FileStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return fs.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (fs *FileStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	if err := fs.refresh(ctx); err != nil {
+		return nil, "", err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var users []User
+	var next string
+	for _, id := range fs.ids[sort.SearchStrings(fs.ids, cursor):] {
+		if id == cursor {
+			continue
+		}
+		if limit > 0 && len(users) == limit {
+			next = users[len(users)-1].Id
+			break
+		}
+		users = append(users, copyUser(fs.users[id]))
+	}
+	return users, next, nil
+}
+
+func (fs *FileStore) Signin(email, pass string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (fs *FileStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (fs *FileStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (fs *FileStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (fs *FileStore) UpdatePassword(userId, pass string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) UpdateEmail(userId, email string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) DeleteUser(userId string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) DeleteUserContext(ctx context.Context, userId string) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) SetStatus(userId string, status Status, until time.Time) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	return ErrReadOnly
+}
+
+func (fs *FileStore) PurgeUsers(now time.Time) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+func (fs *FileStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+// Reads the file again when it changed, the errors are logged and the users are kept
+func (fs *FileStore) refresh(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fs.mu.RLock()
+	fresh := fs.now().Sub(fs.checked) < fs.interval
+	fs.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	err := fs.load()
+	if err != nil {
+		log.Printf("ERROR: Reloading the users of %s: %v\n", fs.path, err)
+	}
+	return nil
+}
+
+func (fs *FileStore) load() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.checked = fs.now()
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return err
+	}
+	if fs.users != nil && info.ModTime().Equal(fs.modTime) && info.Size() == fs.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fs.path)
+	if err != nil {
+		return err
+	}
+	fileUsers, err := fs.parse(data)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]User, len(fileUsers))
+	emails := make(map[string]string, len(fileUsers))
+	ids := make([]string, 0, len(fileUsers))
+	for i, fu := range fileUsers {
+		user, err := fs.fileUser(fu)
+		if err != nil {
+			return fmt.Errorf("User %d: %s", i+1, err)
+		}
+		if _, ok := users[user.Id]; ok {
+			return fmt.Errorf("User %d: the id %q is repeated", i+1, user.Id)
+		}
+		if _, ok := emails[user.Email]; ok {
+			return fmt.Errorf("User %d: %s", i+1, ErrEmailDuplication)
+		}
+		users[user.Id] = user
+		emails[user.Email] = user.Id
+		ids = append(ids, user.Id)
+	}
+	sort.Strings(ids)
+
+	fs.users, fs.emails, fs.ids = users, emails, ids
+	fs.modTime, fs.size = info.ModTime(), info.Size()
+	return nil
+}
+
+func (fs *FileStore) parse(data []byte) ([]fileUser, error) {
+	var file usersFile
+	switch fs.format {
+	case HtpasswdFile:
+		return parseHtpasswd(data)
+	case JSONFile:
+		err := json.Unmarshal(data, &file)
+		return file.Users, err
+	case YAMLFile:
+		err := yaml.Unmarshal(data, &file)
+		for _, fu := range file.Users {
+			for name, value := range fu.Attributes {
+				fu.Attributes[name] = yamlValue(value)
+			}
+		}
+		return file.Users, err
+	}
+	return nil, fmt.Errorf("Unknown file format %d", fs.format)
+}
+
+// The user of the file as it is in the store, the emails are normalized
+// when they are emails, the names of the htpasswd files are kept as they are
+func (fs *FileStore) fileUser(fu fileUser) (User, error) {
+	if fu.Email == "" {
+		return User{}, errors.New("the user has no email")
+	}
+	err := checkHtpasswdFormat(fu.Password)
+	if err != nil {
+		return User{}, err
+	}
+
+	email, err := fs.normalize(fu.Email)
+	if err != nil {
+		email = fu.Email
+	}
+	user := User{
+		Id:         fu.Id,
+		Email:      email,
+		Password:   fu.Password,
+		Attributes: fu.Attributes,
+	}
+	if user.Id == "" {
+		user.Id = email
+	}
+	// the statuses with an end need a time, that the files do not have
+	switch fu.Status {
+	case "", StatusActive, StatusDisabled:
+		user.Status = fu.Status
+	default:
+		return User{}, fmt.Errorf("the status %q is not active or disabled", fu.Status)
+	}
+	return user, nil
+}
+
+// The YAML maps have keys of any type, they are converted to the maps of the JSON attributes
+func yamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = yamlValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = yamlValue(v[i])
+		}
+	}
+	return value
+}
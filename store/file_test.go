@@ -0,0 +1,180 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdHashes(t *testing.T) {
+	Convey("The bcrypt, SHA and apr1 hashes of htpasswd are checked", t, func() {
+		So(apr1("myPassword", "qHDFfhPC"), ShouldEqual, "$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0")
+		So(apr1("p@ss w0rd longer than sixteen chars", "abcdefgh"), ShouldEqual, "$apr1$abcdefgh$eL62iRC/f/rH7UZcPy/Zm/")
+
+		So(checkHtpasswd("$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0", "myPassword"), ShouldBeNil)
+		So(checkHtpasswd("$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0", "other"), ShouldEqual, ErrWrongPassword)
+
+		// htpasswd -nbs user password
+		So(checkHtpasswd("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"), ShouldBeNil)
+		So(checkHtpasswd("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "other"), ShouldEqual, ErrWrongPassword)
+
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		So(err, ShouldBeNil)
+		So(checkHtpasswd(string(hash), "password"), ShouldBeNil)
+		So(checkHtpasswd(string(hash), "other"), ShouldEqual, ErrWrongPassword)
+
+		So(checkHtpasswdFormat("plain"), ShouldNotBeNil)
+		So(checkHtpasswd("plain", "plain"), ShouldEqual, ErrWrongPassword)
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("The users of a htpasswd file log in", t, func() {
+		path := filepath.Join(dir, "htpasswd")
+		writeFile(t, path, "# users\nadmin:$apr1$qHDFfhPC$nITSVHgYbDAK1Y0acGRnY0\nddhhpp@test.com:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+		fs, err := NewFileStore(path, HtpasswdFile)
+		So(err, ShouldBeNil)
+
+		id, err := fs.Login("admin", "myPassword")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "admin")
+		id, err = fs.Login("DDHHPP@test.com", "password")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "ddhhpp@test.com")
+
+		_, err = fs.Login("admin", "password")
+		So(err, ShouldEqual, ErrWrongPassword)
+		_, err = fs.Login("nobody", "password")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		users, next, err := fs.ListUsers("", 1)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].Id, ShouldEqual, "admin")
+		users, next, err = fs.ListUsers(next, 1)
+		So(err, ShouldBeNil)
+		So(users[0].Id, ShouldEqual, "ddhhpp@test.com")
+		So(next, ShouldBeEmpty)
+
+		Convey("The store is read-only", func() {
+			_, err := fs.Signin("new@test.com", "password")
+			So(err, ShouldEqual, ErrReadOnly)
+			So(fs.UpdatePassword("admin", "password"), ShouldEqual, ErrReadOnly)
+			So(fs.DeleteUser("admin"), ShouldEqual, ErrReadOnly)
+		})
+
+		Convey("The file is read again when it changes", func() {
+			fs.SetReloadInterval(0)
+			writeFile(t, path, "root:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+			// the size can be the same, the time is changed to see the change
+			os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+			id, err := fs.Login("root", "password")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "root")
+			_, err = fs.UserById("admin")
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			Convey("A file with errors is not loaded", func() {
+				writeFile(t, path, "broken line\n")
+				os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+
+				id, err := fs.Login("root", "password")
+				So(err, ShouldBeNil)
+				So(id, ShouldEqual, "root")
+			})
+		})
+
+		Convey("The entries with unsupported hashes are an error", func() {
+			writeFile(t, path, "admin:plain\n")
+			_, err := NewFileStore(path, HtpasswdFile)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("The users of JSON and YAML files have ids, attributes and status", t, func() {
+		jsonPath := filepath.Join(dir, "users.json")
+		writeFile(t, jsonPath, `{"users": [
+			{"id": "1", "email": "DDHHPP@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "attributes": {"name": "Dave", "age": 30}},
+			{"id": "2", "email": "disabled@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "status": "disabled"}
+		]}`)
+		yamlPath := filepath.Join(dir, "users.yaml")
+		writeFile(t, yamlPath, `users:
+  - id: "1"
+    email: DDHHPP@test.com
+    password: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="
+    attributes:
+      name: Dave
+      age: 30
+      address:
+        city: Madrid
+  - id: "2"
+    email: disabled@test.com
+    password: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="
+    status: disabled
+`)
+
+		for _, file := range []struct {
+			path   string
+			format FileFormat
+		}{{jsonPath, JSONFile}, {yamlPath, YAMLFile}} {
+			fs, err := NewFileStore(file.path, file.format)
+			So(err, ShouldBeNil)
+
+			id, err := fs.Login("ddhhpp@test.com", "password")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "1")
+
+			user, err := fs.UserById("1")
+			So(err, ShouldBeNil)
+			So(user.Email, ShouldEqual, "ddhhpp@test.com")
+			name, _ := user.Attributes.String("name")
+			So(name, ShouldEqual, "Dave")
+			age, _ := user.Attributes.Int("age")
+			So(age, ShouldEqual, 30)
+
+			_, err = fs.Login("disabled@test.com", "password")
+			So(err, ShouldEqual, ErrAccountDisabled)
+		}
+
+		user, err := mustFileStore(t, yamlPath, YAMLFile).UserById("1")
+		So(err, ShouldBeNil)
+		So(user.Attributes["address"], ShouldResemble, map[string]interface{}{"city": "Madrid"})
+
+		Convey("The repeated emails are an error", func() {
+			writeFile(t, jsonPath, `{"users": [
+				{"email": "ddhhpp@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+				{"email": "DDHHPP@test.com", "password": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}
+			]}`)
+			_, err := NewFileStore(jsonPath, JSONFile)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func mustFileStore(t *testing.T, path string, format FileFormat) *FileStore {
+	fs, err := NewFileStore(path, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/dahernan/auth/crypto"
+)
+
+// Parses the lines "user:hash" of an Apache htpasswd file, the user is the email and the id
+func parseHtpasswd(data []byte) ([]fileUser, error) {
+	var users []fileUser
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Line %d is not user:hash", line)
+		}
+		users = append(users, fileUser{Email: text[:i], Password: text[i+1:]})
+	}
+	return users, scanner.Err()
+}
+
+// The password hashes of htpasswd that are supported
+func checkHtpasswdFormat(hash string) error {
+	switch {
+	case crypto.IsBcrypt(hash), strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$apr1$"):
+		return nil
+	}
+	return fmt.Errorf("Unsupported password hash, use bcrypt, SHA or apr1")
+}
+
+func checkHtpasswd(hash, pass string) error {
+	var ok bool
+	switch {
+	case crypto.IsBcrypt(hash):
+		ok = crypto.BcryptHasher{}.Verify(hash, pass) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		ok = crypto.SecureCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:])))
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		ok = crypto.SecureCompare([]byte(hash), []byte(apr1(pass, salt)))
+	}
+	if !ok {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// The Apache variant of the MD5 crypt, $apr1$<salt>$<hash>
+func apr1(pass, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p, s := []byte(pass), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(p)
+	h.Write([]byte("$apr1$"))
+	h.Write(s)
+	for i := len(p); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(p[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 == 1 {
+			r.Write(p)
+		} else {
+			r.Write(sum)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(p)
+		}
+		if i&1 == 1 {
+			r.Write(sum)
+		} else {
+			r.Write(p)
+		}
+		sum = r.Sum(nil)
+	}
+
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return "$apr1$" + salt + "$" + string(out)
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Generates the opaque ids of the new users,
+// UUID and ULID are provided, or use your own function
+type IdGenerator func() (string, error)
+
+// Random UUID (version 4), for example "2b4bb4a6-0fb4-4c5b-9a3b-1d3fa0e2c1e4"
+func UUID() (string, error) {
+	var u [16]byte
+	if _, err := io.ReadFull(rand.Reader, u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant RFC 4122
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf), nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID, 48 bits of time in milliseconds and 80 random bits in Crockford's base32,
+// for example "01ARZ3NDEKTSV4RRFFQ69G5FAV". They sort by the creation time.
+func ULID() (string, error) {
+	var u [16]byte
+	binary.BigEndian.PutUint64(u[0:8], uint64(time.Now().UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := io.ReadFull(rand.Reader, u[6:]); err != nil {
+		return "", err
+	}
+
+	// 128 bits in 26 characters of 5 bits, the first one only has 3 bits
+	buf := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(u[0:8])
+	lo := binary.BigEndian.Uint64(u[8:16])
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf), nil
+}
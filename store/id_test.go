@@ -0,0 +1,36 @@
+package store
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUUID(t *testing.T) {
+	Convey("Generates random version 4 UUIDs", t, func() {
+		id, err := UUID()
+		So(err, ShouldBeNil)
+		So(id, ShouldHaveLength, 36)
+		So(regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id), ShouldBeTrue)
+
+		other, err := UUID()
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, id)
+	})
+}
+
+func TestULID(t *testing.T) {
+	Convey("Generates ULIDs that sort by time", t, func() {
+		id, err := ULID()
+		So(err, ShouldBeNil)
+		So(id, ShouldHaveLength, 26)
+		So(regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`).MatchString(id), ShouldBeTrue)
+
+		time.Sleep(2 * time.Millisecond)
+		later, err := ULID()
+		So(err, ShouldBeNil)
+		So(later, ShouldBeGreaterThan, id)
+	})
+}
@@ -0,0 +1,452 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// The attribute of the users with the names of their groups in the directory
+const LDAPGroupsAttribute = "groups"
+
+// Active Directory flag of the userAccountControl of the disabled accounts
+const adAccountDisabled = 0x2
+
+type LDAPOptions struct {
+	// ldap://host:389 or ldaps://host:636
+	URL string
+	// Upgrades the ldap:// connections to TLS with StartTLS
+	StartTLS bool
+	// For ldaps:// and StartTLS, the server name is the host of the URL if it is not set
+	TLSConfig *tls.Config
+
+	// The account that searches the users, the searches are anonymous if it is not set
+	BindDN       string
+	BindPassword string
+
+	// Where the users are searched
+	BaseDN string
+	// Filter of a user by the login, %s is the escaped login, "(mail=%s)" by default.
+	// For Active Directory it can be "(sAMAccountName=%s)"
+	UserFilter string
+	// Filter of all the users, for ListUsers, "(mail=*)" by default
+	UsersFilter string
+	// Attribute with the id of the users, a text one like uid or entryUUID, "uid" by default
+	IdAttribute string
+	// Attribute with the email of the users, "mail" by default
+	EmailAttribute string
+	// Directory attributes copied to the attributes of the users, by the name of the attribute of the user.
+	// The attributes with several values are lists
+	Attributes map[string]string
+
+	// Where the groups are searched, the groups of the users are not looked up if it is not set
+	GroupBaseDN string
+	// Filter of the groups of a user, %s is the escaped DN of the user, "(member=%s)" by default
+	GroupFilter string
+	// Attribute with the name of the groups, "cn" by default
+	GroupNameAttribute string
+
+	// Of every operation with the directory, 10 seconds by default
+	Timeout time.Duration
+}
+
+// Read-only UserRepository of the users of a LDAP directory, like OpenLDAP or Active Directory.
+// The user is searched with the bind account and Login binds as the user with the password,
+// so the passwords are checked by the directory. The users are managed in the directory,
+// the operations that change them return ErrReadOnly.
+type LDAPStore struct {
+	opt  LDAPOptions
+	url  *url.URL
+	host string
+}
+
+func NewLDAPStore(opt LDAPOptions) (*LDAPStore, error) {
+	u, err := url.Parse(opt.URL)
+	if err != nil {
+		return nil, err
+	}
+	port := ""
+	switch u.Scheme {
+	case "ldap":
+		port = "389"
+	case "ldaps":
+		port = "636"
+		if opt.StartTLS {
+			return nil, errors.New("StartTLS is for ldap:// URLs, ldaps:// is already TLS")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP URL %q, use ldap:// or ldaps://", opt.URL)
+	}
+	if opt.BaseDN == "" {
+		return nil, errors.New("The LDAP store needs the BaseDN of the users")
+	}
+
+	if opt.UserFilter == "" {
+		opt.UserFilter = "(mail=%s)"
+	}
+	if opt.UsersFilter == "" {
+		opt.UsersFilter = "(mail=*)"
+	}
+	if opt.IdAttribute == "" {
+		opt.IdAttribute = "uid"
+	}
+	if opt.EmailAttribute == "" {
+		opt.EmailAttribute = "mail"
+	}
+	if opt.GroupFilter == "" {
+		opt.GroupFilter = "(member=%s)"
+	}
+	if opt.GroupNameAttribute == "" {
+		opt.GroupNameAttribute = "cn"
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = 10 * time.Second
+	}
+
+	ls := &LDAPStore{opt: opt, url: u, host: u.Hostname()}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Host, port)
+	}
+	return ls, nil
+}
+
+func (ls *LDAPStore) Login(email, pass string) (string, error) {
+	return ls.LoginContext(context.Background(), email, pass)
+}
+
+func (ls *LDAPStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	// a bind without password is an unauthenticated bind, that succeeds in most directories
+	if pass == "" {
+		return "", ErrWrongPassword
+	}
+
+	conn, err := ls.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	entry, err := ls.search(conn, fmt.Sprintf(ls.opt.UserFilter, ldap.EscapeFilter(email)))
+	if err == ErrUserNotFound {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", ls.error(ctx, err)
+	}
+
+	err = conn.Bind(entry.DN, pass)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", ls.error(ctx, err)
+	}
+
+	user := ls.entryUser(entry)
+	err = user.CheckStatus(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+func (ls *LDAPStore) UserByEmail(email string) (User, error) {
+	return ls.UserByEmailContext(context.Background(), email)
+}
+
+func (ls *LDAPStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	return ls.user(ctx, fmt.Sprintf(ls.opt.UserFilter, ldap.EscapeFilter(email)))
+}
+
+func (ls *LDAPStore) UserById(userId string) (User, error) {
+	return ls.UserByIdContext(context.Background(), userId)
+}
+
+func (ls *LDAPStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	filter := fmt.Sprintf("(&%s(%s=%s))", ls.opt.UsersFilter, ls.opt.IdAttribute, ldap.EscapeFilter(userId))
+	return ls.user(ctx, filter)
+}
+
+// Users are listed in the order of the ids, and the cursor is the id of the last user of the page.
+// All the users are read from the directory for every page, without their groups
+func (ls *LDAPStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return ls.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (ls *LDAPStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	conn, err := ls.connect(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	result, err := conn.Search(ls.searchRequest(ls.opt.BaseDN, ls.opt.UsersFilter, ls.userAttributes()))
+	if err != nil {
+		return nil, "", ls.error(ctx, err)
+	}
+
+	all := make([]User, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		all = append(all, ls.entryUser(entry))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Id < all[j].Id })
+
+	var users []User
+	var next string
+	for _, user := range all {
+		if cursor != "" && user.Id <= cursor {
+			continue
+		}
+		if limit > 0 && len(users) == limit {
+			next = users[len(users)-1].Id
+			break
+		}
+		users = append(users, user)
+	}
+	return users, next, nil
+}
+
+func (ls *LDAPStore) Signin(email, pass string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (ls *LDAPStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (ls *LDAPStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (ls *LDAPStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdatePassword(userId, pass string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdateEmail(userId, email string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) DeleteUser(userId string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) DeleteUserContext(ctx context.Context, userId string) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) SetStatus(userId string, status Status, until time.Time) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	return ErrReadOnly
+}
+
+func (ls *LDAPStore) PurgeUsers(now time.Time) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+func (ls *LDAPStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+// The user of the filter with its groups
+func (ls *LDAPStore) user(ctx context.Context, filter string) (User, error) {
+	conn, err := ls.connect(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	entry, err := ls.search(conn, filter)
+	if err != nil {
+		return User{}, ls.error(ctx, err)
+	}
+	user := ls.entryUser(entry)
+
+	if ls.opt.GroupBaseDN != "" {
+		groups, err := ls.groups(conn, entry.DN)
+		if err != nil {
+			return User{}, ls.error(ctx, err)
+		}
+		if user.Attributes == nil {
+			user.Attributes = make(Attributes)
+		}
+		user.Attributes[LDAPGroupsAttribute] = groups
+	}
+	return user, nil
+}
+
+// Connects to the directory and binds with the bind account.
+// The connection is closed when the context is done
+func (ls *LDAPStore) connect(ctx context.Context) (*ldapConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: ls.opt.Timeout}
+	c, err := dialer.DialContext(ctx, "tcp", ls.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	isTLS := ls.url.Scheme == "ldaps"
+	if isTLS {
+		tc := tls.Client(c, ls.tlsConfig())
+		err = tc.HandshakeContext(ctx)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+
+	conn := ldap.NewConn(c, isTLS)
+	conn.SetTimeout(ls.opt.Timeout)
+	conn.Start()
+	lc := &ldapConn{Conn: conn, stop: context.AfterFunc(ctx, conn.Close)}
+
+	if ls.opt.StartTLS {
+		err = conn.StartTLS(ls.tlsConfig())
+		if err != nil {
+			lc.Close()
+			return nil, ls.error(ctx, err)
+		}
+	}
+	if ls.opt.BindDN != "" {
+		err = conn.Bind(ls.opt.BindDN, ls.opt.BindPassword)
+		if err != nil {
+			lc.Close()
+			return nil, ls.error(ctx, err)
+		}
+	}
+	return lc, nil
+}
+
+func (ls *LDAPStore) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if ls.opt.TLSConfig != nil {
+		config = ls.opt.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = ls.host
+	}
+	return config
+}
+
+// The only entry of the filter, ErrUserNotFound when there is none
+func (ls *LDAPStore) search(conn *ldapConn, filter string) (*ldap.Entry, error) {
+	req := ls.searchRequest(ls.opt.BaseDN, filter, ls.userAttributes())
+	// two are enough to know that the filter is not of one user
+	req.SizeLimit = 2
+	result, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || err == nil && len(result.Entries) > 1 {
+		return nil, fmt.Errorf("The filter %s is of several users", filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return result.Entries[0], nil
+}
+
+func (ls *LDAPStore) groups(conn *ldapConn, userDN string) ([]string, error) {
+	filter := fmt.Sprintf(ls.opt.GroupFilter, ldap.EscapeFilter(userDN))
+	result, err := conn.Search(ls.searchRequest(ls.opt.GroupBaseDN, filter, []string{ls.opt.GroupNameAttribute}))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetAttributeValue(ls.opt.GroupNameAttribute))
+	}
+	return groups, nil
+}
+
+func (ls *LDAPStore) searchRequest(baseDN, filter string, attributes []string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(ls.opt.Timeout/time.Second), false, filter, attributes, nil)
+}
+
+func (ls *LDAPStore) userAttributes() []string {
+	attributes := []string{ls.opt.IdAttribute, ls.opt.EmailAttribute, "userAccountControl"}
+	for name := range ls.opt.Attributes {
+		attributes = append(attributes, name)
+	}
+	return attributes
+}
+
+// The user of the entry of the directory, the disabled accounts of Active Directory are disabled
+func (ls *LDAPStore) entryUser(entry *ldap.Entry) User {
+	user := User{
+		Id:    entry.GetAttributeValue(ls.opt.IdAttribute),
+		Email: entry.GetAttributeValue(ls.opt.EmailAttribute),
+	}
+	for name, attribute := range ls.opt.Attributes {
+		values := entry.GetAttributeValues(name)
+		if len(values) == 0 {
+			continue
+		}
+		if user.Attributes == nil {
+			user.Attributes = make(Attributes)
+		}
+		if len(values) == 1 {
+			user.Attributes[attribute] = values[0]
+			continue
+		}
+		user.Attributes[attribute] = values
+	}
+
+	control, err := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+	if err == nil && control&adAccountDisabled != 0 {
+		user.Status = StatusDisabled
+	}
+	return user
+}
+
+// The errors of the connections closed because the context is done are the errors of the context
+func (ls *LDAPStore) error(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type ldapConn struct {
+	*ldap.Conn
+	stop func() bool
+}
+
+func (lc *ldapConn) Close() {
+	lc.stop()
+	lc.Conn.Close()
+}
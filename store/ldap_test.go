@@ -0,0 +1,403 @@
+package store
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/asn1-ber.v1"
+)
+
+// In-process LDAP server with the bind, search, StartTLS and unbind operations,
+// and the and, or, not, equality and present filters.
+// The searches in stalledDN are not answered until the connection is closed
+type fakeLDAP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   []fakeEntry
+	passwords map[string]string
+}
+
+const stalledDN = "ou=stalled,dc=test"
+
+type fakeEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func newFakeLDAP(t *testing.T, ldaps bool) *fakeLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeLDAP{tlsConfig: fakeTLSConfig(t), passwords: map[string]string{}}
+	if ldaps {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listener = l
+	go s.serve()
+	return s
+}
+
+func (s *fakeLDAP) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeLDAP) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeLDAP) add(dn, password string, attrs map[string][]string) {
+	s.entries = append(s.entries, fakeEntry{dn: dn, attrs: attrs})
+	if password != "" {
+		s.passwords[dn] = password
+	}
+}
+
+func (s *fakeLDAP) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *fakeLDAP) handle(c net.Conn) {
+	defer func() { c.Close() }()
+	for {
+		packet, err := ber.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case 0: // bind
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(0)
+			if dn != "" && (password == "" || s.passwords[dn] != password) {
+				code = 49
+			}
+			s.reply(c, id, 1, code)
+		case 2: // unbind
+			return
+		case 3: // search
+			baseDN := strings.ToLower(op.Children[0].Value.(string))
+			if baseDN == stalledDN {
+				ber.ReadPacket(c)
+				return
+			}
+			for _, entry := range s.entries {
+				if strings.HasSuffix(strings.ToLower(entry.dn), baseDN) && entry.match(op.Children[6]) {
+					s.write(c, id, entry.packet())
+				}
+			}
+			s.reply(c, id, 5, 0)
+		case 23: // StartTLS
+			s.reply(c, id, 24, 0)
+			tc := tls.Server(c, s.tlsConfig)
+			if tc.Handshake() != nil {
+				return
+			}
+			c = tc
+		default:
+			return
+		}
+	}
+}
+
+func (s *fakeLDAP) reply(w io.Writer, id int64, tag ber.Tag, code int64) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	s.write(w, id, op)
+}
+
+func (s *fakeLDAP) write(w io.Writer, id int64, op *ber.Packet) {
+	packet := ber.NewSequence("")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	w.Write(packet.Bytes())
+}
+
+func (e fakeEntry) packet() *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.NewSequence("")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+func (e fakeEntry) match(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, f := range filter.Children {
+			if !e.match(f) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, f := range filter.Children {
+			if e.match(f) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return !e.match(filter.Children[0])
+	case 3: // equality
+		for _, v := range e.values(filter.Children[0].Value.(string)) {
+			if strings.EqualFold(v, filter.Children[1].Value.(string)) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		return len(e.values(filter.Data.String())) > 0
+	}
+	return false
+}
+
+func (e fakeEntry) values(name string) []string {
+	for attr, values := range e.attrs {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Self-signed certificate of 127.0.0.1
+func fakeTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake ldap"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func fakeDirectory(s *fakeLDAP) {
+	s.add("cn=service,dc=test", "service-secret", nil)
+	s.add("uid=dave,ou=people,dc=test", "password", map[string][]string{
+		"uid":             {"dave"},
+		"mail":            {"DDHHPP@test.com"},
+		"cn":              {"Dave"},
+		"telephoneNumber": {"1234", "5678"},
+	})
+	s.add("uid=bob,ou=people,dc=test", "bob-password", map[string][]string{
+		"uid":                {"bob"},
+		"mail":               {"bob@test.com"},
+		"userAccountControl": {"514"},
+	})
+	s.add("uid=twin1,ou=people,dc=test", "", map[string][]string{"uid": {"twin1"}, "mail": {"twin@test.com"}})
+	s.add("uid=twin2,ou=people,dc=test", "", map[string][]string{"uid": {"twin2"}, "mail": {"twin@test.com"}})
+	s.add("cn=admins,ou=groups,dc=test", "", map[string][]string{
+		"cn":     {"admins"},
+		"member": {"uid=dave,ou=people,dc=test"},
+	})
+	s.add("cn=devs,ou=groups,dc=test", "", map[string][]string{
+		"cn":     {"devs"},
+		"member": {"uid=dave,ou=people,dc=test", "uid=bob,ou=people,dc=test"},
+	})
+}
+
+func TestLDAPStore(t *testing.T) {
+	server := newFakeLDAP(t, false)
+	defer server.Close()
+	fakeDirectory(server)
+
+	opt := LDAPOptions{
+		URL:          "ldap://" + server.Addr(),
+		BindDN:       "cn=service,dc=test",
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=test",
+		Attributes:   map[string]string{"cn": "name", "telephoneNumber": "phones"},
+		GroupBaseDN:  "ou=groups,dc=test",
+	}
+
+	Convey("The users log in with the password of the directory", t, func() {
+		ls, err := NewLDAPStore(opt)
+		So(err, ShouldBeNil)
+
+		id, err := ls.Login("ddhhpp@test.com", "password")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "dave")
+
+		_, err = ls.Login("ddhhpp@test.com", "other")
+		So(err, ShouldEqual, ErrWrongPassword)
+		_, err = ls.Login("ddhhpp@test.com", "")
+		So(err, ShouldEqual, ErrWrongPassword)
+		_, err = ls.Login("nobody@test.com", "password")
+		So(err, ShouldEqual, ErrWrongPassword)
+		// the login is escaped in the filter
+		_, err = ls.Login("*", "password")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		Convey("The disabled accounts of Active Directory are disabled", func() {
+			_, err := ls.Login("bob@test.com", "bob-password")
+			So(err, ShouldEqual, ErrAccountDisabled)
+		})
+
+		Convey("A login of several users is an error", func() {
+			_, err := ls.Login("twin@test.com", "password")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrWrongPassword)
+		})
+
+		Convey("A wrong bind account is an error of the store", func() {
+			wrong := opt
+			wrong.BindPassword = "wrong"
+			ls, err := NewLDAPStore(wrong)
+			So(err, ShouldBeNil)
+			_, err = ls.Login("ddhhpp@test.com", "password")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrWrongPassword)
+		})
+
+		Convey("A done context stops the login", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := ls.LoginContext(ctx, "ddhhpp@test.com", "password")
+			So(err, ShouldEqual, context.Canceled)
+
+			stalled := opt
+			stalled.BaseDN = stalledDN
+			ls, err := NewLDAPStore(stalled)
+			So(err, ShouldBeNil)
+			ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err = ls.LoginContext(ctx, "ddhhpp@test.com", "password")
+			So(err, ShouldResemble, context.DeadlineExceeded)
+		})
+	})
+
+	Convey("The attributes of the directory and the groups are the attributes of the users", t, func() {
+		ls, err := NewLDAPStore(opt)
+		So(err, ShouldBeNil)
+
+		user, err := ls.UserById("dave")
+		So(err, ShouldBeNil)
+		So(user.Email, ShouldEqual, "DDHHPP@test.com")
+		So(user.Attributes["name"], ShouldEqual, "Dave")
+		So(user.Attributes["phones"], ShouldResemble, []string{"1234", "5678"})
+		So(user.Attributes[LDAPGroupsAttribute], ShouldResemble, []string{"admins", "devs"})
+		So(validateAttributes(nil, user.Attributes), ShouldBeNil)
+
+		user, err = ls.UserByEmail("bob@test.com")
+		So(err, ShouldBeNil)
+		So(user.Id, ShouldEqual, "bob")
+		So(user.Status, ShouldEqual, StatusDisabled)
+		So(user.Attributes[LDAPGroupsAttribute], ShouldResemble, []string{"devs"})
+
+		_, err = ls.UserById("nobody")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		users, next, err := ls.ListUsers("", 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Id, ShouldEqual, "bob")
+		So(users[1].Id, ShouldEqual, "dave")
+		users, next, err = ls.ListUsers(next, 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Id, ShouldEqual, "twin1")
+		So(next, ShouldBeEmpty)
+	})
+
+	Convey("The store is read-only", t, func() {
+		ls, err := NewLDAPStore(opt)
+		So(err, ShouldBeNil)
+		_, err = ls.Signin("new@test.com", "password")
+		So(err, ShouldEqual, ErrReadOnly)
+		So(ls.UpdatePassword("dave", "password"), ShouldEqual, ErrReadOnly)
+		So(ls.DeleteUser("dave"), ShouldEqual, ErrReadOnly)
+	})
+
+	Convey("The options are checked", t, func() {
+		_, err := NewLDAPStore(LDAPOptions{URL: "http://localhost", BaseDN: "dc=test"})
+		So(err, ShouldNotBeNil)
+		_, err = NewLDAPStore(LDAPOptions{URL: "ldap://localhost"})
+		So(err, ShouldNotBeNil)
+		_, err = NewLDAPStore(LDAPOptions{URL: "ldaps://localhost", StartTLS: true, BaseDN: "dc=test"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLDAPStoreTLS(t *testing.T) {
+	Convey("The connections are TLS with StartTLS and ldaps://", t, func() {
+		for _, ldaps := range []bool{false, true} {
+			server := newFakeLDAP(t, ldaps)
+			defer server.Close()
+			fakeDirectory(server)
+
+			cert, err := x509.ParseCertificate(server.tlsConfig.Certificates[0].Certificate[0])
+			So(err, ShouldBeNil)
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+
+			opt := LDAPOptions{
+				URL:       "ldap://" + server.Addr(),
+				StartTLS:  true,
+				TLSConfig: &tls.Config{RootCAs: roots},
+				BaseDN:    "ou=people,dc=test",
+			}
+			if ldaps {
+				opt.URL = "ldaps://" + server.Addr()
+				opt.StartTLS = false
+			}
+			ls, err := NewLDAPStore(opt)
+			So(err, ShouldBeNil)
+
+			id, err := ls.Login("ddhhpp@test.com", "password")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "dave")
+
+			// the certificate is checked
+			opt.TLSConfig = nil
+			ls, err = NewLDAPStore(opt)
+			So(err, ShouldBeNil)
+			_, err = ls.Login("ddhhpp@test.com", "password")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrWrongPassword)
+		}
+	})
+}
@@ -0,0 +1,409 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Codes of the violations of the password policy
+const (
+	PasswordTooShort   = "too_short"
+	PasswordTooLong    = "too_long"
+	PasswordInvalid    = "invalid"
+	PasswordCommon     = "common"
+	PasswordRepetitive = "repetitive"
+	PasswordSequential = "sequential"
+	PasswordHasEmail   = "contains_email"
+	PasswordHasName    = "contains_name"
+	PasswordLowEntropy = "low_entropy"
+	PasswordBreached   = "breached"
+)
+
+const (
+	DefaultPasswordMin   = 8
+	DefaultPasswordMax   = 64
+	DefaultNameAttribute = "name"
+)
+
+// Rules of the passwords of the users, after the guidelines of NIST 800-63B: a minimum length,
+// a maximum that allows long passphrases, no composition rules, and no common, repetitive
+// or sequential passwords, or passwords with the email or the name of the user.
+// The length is in characters after the NFKC normalization of the password
+type PasswordPolicy struct {
+	// DefaultPasswordMin if it is not set
+	MinLength int
+	// DefaultPasswordMax if it is not set
+	MaxLength int
+	// Passwords that are rejected, like the most common ones or the name of the service,
+	// compared without case
+	Blocklist []string
+	// Rejects the passwords with more than this number of the same character in a row,
+	// like "aaaa", no limit when it is 0
+	MaxRepeated int
+	// Rejects the passwords with a run of this number of consecutive characters,
+	// like "1234" or "dcba", no limit when it is 0
+	MaxSequential int
+	// Minimum bits of EstimateEntropy, no minimum when it is 0
+	MinEntropy float64
+	// The attribute with the name of the user, DefaultNameAttribute if it is not set
+	NameAttribute string
+	// Rejects the passwords that appear in the known breach corpora, no check when it is nil
+	Breached BreachedPasswordChecker
+	// When the breached passwords can not be checked the passwords are accepted,
+	// otherwise they are rejected with ErrBreachCheckFailed. The errors are logged
+	BreachedFailOpen bool
+	// The logins of the PolicyStore with a wrong password try it again as it was typed, when the normalization
+	// changes it, for the users stored before the policy, and the users that log in so have their password
+	// stored normalized. It hashes those wrong passwords twice, set it to only try the normalized password
+	// when all the users are migrated
+	NormalizedLoginsOnly bool
+}
+
+// A rule of the policy that the password does not follow
+type PolicyViolation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The password does not follow the policy, with all the rules that it breaks
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return "The password does not follow the policy: " + strings.Join(msgs, ", ")
+}
+
+// The NFKC normalization of the password, so the same password typed
+// with other Unicode forms hashes the same
+func NormalizePassword(pass string) string {
+	return norm.NFKC.String(pass)
+}
+
+// Checks the normalized password against the policy, the email and the attributes
+// are the ones of the user, for the context-specific words
+func (p PasswordPolicy) Check(pass, email string, attrs Attributes) error {
+	return p.CheckContext(context.Background(), pass, email, attrs)
+}
+
+// Like Check, the context is for the BreachedPasswordChecker
+func (p PasswordPolicy) CheckContext(ctx context.Context, pass, email string, attrs Attributes) error {
+	var violations []PolicyViolation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{Field: "password", Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !utf8.ValidString(pass) || strings.IndexFunc(pass, unicode.IsControl) >= 0 {
+		add(PasswordInvalid, "it has invalid characters")
+	}
+	length := utf8.RuneCountInString(pass)
+	if min := p.minLength(); length < min {
+		add(PasswordTooShort, "it is shorter than %d characters", min)
+	}
+	if max := p.maxLength(); length > max {
+		add(PasswordTooLong, "it is longer than %d characters", max)
+	}
+
+	lower := strings.ToLower(pass)
+	for _, blocked := range p.Blocklist {
+		if lower == strings.ToLower(NormalizePassword(blocked)) {
+			add(PasswordCommon, "it is a common password")
+			break
+		}
+	}
+	if p.MaxRepeated > 0 && longestRun(pass, 0) > p.MaxRepeated {
+		add(PasswordRepetitive, "it has more than %d repeated characters in a row", p.MaxRepeated)
+	}
+	if p.MaxSequential > 0 && (longestRun(pass, 1) > p.MaxSequential || longestRun(pass, -1) > p.MaxSequential) {
+		add(PasswordSequential, "it has more than %d consecutive characters", p.MaxSequential)
+	}
+
+	if local := emailLocalPart(email); len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		add(PasswordHasEmail, "it contains the email")
+	}
+	if name, ok := attrs.String(p.nameAttribute()); ok {
+		for _, word := range strings.FieldsFunc(strings.ToLower(NormalizePassword(name)), isSeparator) {
+			if utf8.RuneCountInString(word) >= 3 && strings.Contains(lower, word) {
+				add(PasswordHasName, "it contains the name")
+				break
+			}
+		}
+	}
+
+	if p.MinEntropy > 0 && EstimateEntropy(pass) < p.MinEntropy {
+		add(PasswordLowEntropy, "it is too easy to guess")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Breached(ctx, pass)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			log.Printf("ERROR: Checking the breached passwords: %v\n", err)
+			if !p.BreachedFailOpen {
+				return ErrBreachCheckFailed
+			}
+		}
+		if breached {
+			add(PasswordBreached, "it appears in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{violations}
+	}
+	return nil
+}
+
+func (p PasswordPolicy) minLength() int {
+	if p.MinLength == 0 {
+		return DefaultPasswordMin
+	}
+	return p.MinLength
+}
+
+func (p PasswordPolicy) maxLength() int {
+	if p.MaxLength == 0 {
+		return DefaultPasswordMax
+	}
+	return p.MaxLength
+}
+
+func (p PasswordPolicy) nameAttribute() string {
+	if p.NameAttribute == "" {
+		return DefaultNameAttribute
+	}
+	return p.NameAttribute
+}
+
+// Estimates the bits of entropy of the password from the size of the alphabets of its characters:
+// lower case and upper case letters, digits, symbols and the rest of Unicode.
+// The characters that repeat the previous one or follow it in a sequence only add one bit
+func EstimateEntropy(pass string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, c := range pass {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := math.Log2(float64(pool))
+	entropy := 0.0
+	prev := rune(-1)
+	for _, c := range pass {
+		if d := c - prev; prev >= 0 && (d == 0 || d == 1 || d == -1) {
+			entropy++
+		} else {
+			entropy += bits
+		}
+		prev = c
+	}
+	return entropy
+}
+
+// The longest run of characters that differ in step from the previous one,
+// 0 for the repeated characters and 1 or -1 for the sequences
+func longestRun(pass string, step rune) int {
+	longest, run := 0, 0
+	prev := rune(-1)
+	for _, c := range pass {
+		if prev >= 0 && c-prev == step {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = c
+	}
+	return longest
+}
+
+func emailLocalPart(email string) string {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return email[:at]
+	}
+	return email
+}
+
+func isSeparator(c rune) bool {
+	return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+}
+
+// UserRepository that checks the passwords of the signins and the password changes against a policy
+// before they get to another repository, and normalizes them with NormalizePassword before they are hashed.
+// The logins are normalized too, see NormalizedLoginsOnly for the users stored before the policy.
+type PolicyStore struct {
+	repo   ContextUserRepository
+	policy PasswordPolicy
+}
+
+func NewPolicyStore(repo UserRepository, policy PasswordPolicy) *PolicyStore {
+	return &PolicyStore{repo: WithContext(repo), policy: policy}
+}
+
+// The policy store of a repository that only has the context operations
+func NewPolicyStoreContext(repo ContextUserRepository, policy PasswordPolicy) *PolicyStore {
+	return &PolicyStore{repo: repo, policy: policy}
+}
+
+func (ps *PolicyStore) Signin(email, pass string) (string, error) {
+	return ps.SigninContext(context.Background(), email, pass)
+}
+
+func (ps *PolicyStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return ps.SigninWithAttributesContext(ctx, email, pass, nil)
+}
+
+func (ps *PolicyStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return ps.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (ps *PolicyStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	pass = NormalizePassword(pass)
+	err := ps.policy.CheckContext(ctx, pass, email, attrs)
+	if err != nil {
+		return "", err
+	}
+	return ps.repo.SigninWithAttributesContext(ctx, email, pass, attrs)
+}
+
+func (ps *PolicyStore) Login(email, pass string) (string, error) {
+	return ps.LoginContext(context.Background(), email, pass)
+}
+
+func (ps *PolicyStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	normalized := NormalizePassword(pass)
+	userId, err := ps.repo.LoginContext(ctx, email, normalized)
+	if err != ErrWrongPassword || normalized == pass || ps.policy.NormalizedLoginsOnly {
+		return userId, err
+	}
+
+	userId, err = ps.repo.LoginContext(ctx, email, pass)
+	if err != nil {
+		return "", err
+	}
+	err = ps.repo.UpdatePasswordContext(ctx, userId, normalized)
+	if err != nil && err != ErrReadOnly {
+		log.Printf("ERROR: Normalizing the password of the user %s: %v\n", userId, err)
+	}
+	return userId, nil
+}
+
+func (ps *PolicyStore) UserByEmail(email string) (User, error) {
+	return ps.UserByEmailContext(context.Background(), email)
+}
+
+func (ps *PolicyStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	return ps.repo.UserByEmailContext(ctx, email)
+}
+
+func (ps *PolicyStore) UserById(userId string) (User, error) {
+	return ps.UserByIdContext(context.Background(), userId)
+}
+
+func (ps *PolicyStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	return ps.repo.UserByIdContext(ctx, userId)
+}
+
+func (ps *PolicyStore) UpdatePassword(userId, pass string) error {
+	return ps.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+// The password is checked against the email and the name of the user
+func (ps *PolicyStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	user, err := ps.repo.UserByIdContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	pass = NormalizePassword(pass)
+	err = ps.policy.CheckContext(ctx, pass, user.Email, user.Attributes)
+	if err != nil {
+		return err
+	}
+	return ps.repo.UpdatePasswordContext(ctx, userId, pass)
+}
+
+func (ps *PolicyStore) UpdateEmail(userId, email string) error {
+	return ps.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (ps *PolicyStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	return ps.repo.UpdateEmailContext(ctx, userId, email)
+}
+
+func (ps *PolicyStore) DeleteUser(userId string) error {
+	return ps.DeleteUserContext(context.Background(), userId)
+}
+
+func (ps *PolicyStore) DeleteUserContext(ctx context.Context, userId string) error {
+	return ps.repo.DeleteUserContext(ctx, userId)
+}
+
+func (ps *PolicyStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return ps.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (ps *PolicyStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	return ps.repo.UpdateAttributesContext(ctx, userId, attrs)
+}
+
+func (ps *PolicyStore) SetStatus(userId string, status Status, until time.Time) error {
+	return ps.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (ps *PolicyStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	return ps.repo.SetStatusContext(ctx, userId, status, until)
+}
+
+func (ps *PolicyStore) PurgeUsers(now time.Time) ([]string, error) {
+	return ps.PurgeUsersContext(context.Background(), now)
+}
+
+func (ps *PolicyStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	return ps.repo.PurgeUsersContext(ctx, now)
+}
+
+func (ps *PolicyStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return ps.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (ps *PolicyStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	return ps.repo.ListUsersContext(ctx, cursor, limit)
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// The codes of the violations of the error of the policy
+func violationCodes(err error) []string {
+	policyErr, ok := err.(*PolicyError)
+	if !ok {
+		return nil
+	}
+	var codes []string
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	Convey("The passwords are checked against the rules of the policy", t, func() {
+		policy := PasswordPolicy{
+			Blocklist:     []string{"password1", "qwertyuiop"},
+			MaxRepeated:   3,
+			MaxSequential: 3,
+			MinEntropy:    30,
+		}
+		attrs := Attributes{"name": "David Hernandez"}
+
+		So(policy.Check("correct horse battery staple", "ddhhpp@test.com", attrs), ShouldBeNil)
+
+		err := policy.Check("", "ddhhpp@test.com", nil)
+		So(violationCodes(err), ShouldContain, PasswordTooShort)
+		So(err.Error(), ShouldContainSubstring, "it is shorter than 8 characters")
+
+		long := make([]rune, 65)
+		for i := range long {
+			long[i] = rune('a' + i%2*7)
+		}
+		So(violationCodes(policy.Check(string(long), "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordTooLong})
+		So(policy.Check(string(long[:64]), "ddhhpp@test.com", nil), ShouldBeNil)
+
+		So(violationCodes(policy.Check("PassWord1", "ddhhpp@test.com", nil)), ShouldContain, PasswordCommon)
+		So(violationCodes(policy.Check("horse aaaa staple", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordRepetitive})
+		So(violationCodes(policy.Check("horse 1234 staple", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordSequential})
+		So(violationCodes(policy.Check("horse dcba staple", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordSequential})
+		So(policy.Check("horse 123 staple", "ddhhpp@test.com", nil), ShouldBeNil)
+		So(violationCodes(policy.Check("my DDHHPP staple", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordHasEmail})
+		So(violationCodes(policy.Check("horse hernandez staple", "ddhhpp@test.com", attrs)), ShouldResemble, []string{PasswordHasName})
+		So(violationCodes(policy.Check("horse\x00staple", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordInvalid})
+		So(violationCodes(policy.Check("abababab", "ddhhpp@test.com", nil)), ShouldResemble, []string{PasswordLowEntropy})
+
+		Convey("All the violations are reported", func() {
+			err := policy.Check("ddh", "ddhhpp@test.com", Attributes{"name": "ddh"})
+			So(violationCodes(err), ShouldResemble, []string{PasswordTooShort, PasswordHasName, PasswordLowEntropy})
+			for _, v := range err.(*PolicyError).Violations {
+				So(v.Field, ShouldEqual, "password")
+				So(v.Message, ShouldNotBeEmpty)
+			}
+		})
+
+		Convey("The lengths and the name attribute can be changed", func() {
+			policy := PasswordPolicy{MinLength: 4, MaxLength: 6, NameAttribute: "nick"}
+			So(policy.Check("abcd", "", nil), ShouldBeNil)
+			So(violationCodes(policy.Check("abcdefg", "", nil)), ShouldResemble, []string{PasswordTooLong})
+			So(violationCodes(policy.Check("xdhpx", "", Attributes{"nick": "dhp"})), ShouldResemble, []string{PasswordHasName})
+			So(policy.Check("xdhpx", "", Attributes{"name": "dhp"}), ShouldBeNil)
+		})
+	})
+
+	Convey("The entropy of the passwords is estimated from their alphabets", t, func() {
+		So(EstimateEntropy(""), ShouldEqual, 0)
+		So(EstimateEntropy("abcdefgh"), ShouldAlmostEqual, math.Log2(26)+7, 0.001)
+		So(EstimateEntropy("aaaaaaaa"), ShouldAlmostEqual, math.Log2(26)+7, 0.001)
+		So(EstimateEntropy("axbycz"), ShouldAlmostEqual, 6*math.Log2(26), 0.001)
+		So(EstimateEntropy("aX3$"), ShouldAlmostEqual, 4*math.Log2(95), 0.001)
+		So(EstimateEntropy("añ"), ShouldAlmostEqual, 2*math.Log2(126), 0.001)
+	})
+
+	Convey("The passwords are normalized with NFKC", t, func() {
+		So(NormalizePassword("ｐａｓｓ１"), ShouldEqual, "pass1")
+		So(NormalizePassword("ﬁne"), ShouldEqual, "fine")
+		So(NormalizePassword("é"), ShouldEqual, "é")
+	})
+}
+
+func TestPolicyStore(t *testing.T) {
+	Convey("The policy store checks the passwords of the signins and the password changes", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketPolicy"
+		DeleteBucket(t, db, bucket)
+		bs, err := NewBoltStore(db, bucket)
+		So(err, ShouldBeNil)
+
+		ps := NewPolicyStore(bs, PasswordPolicy{MaxRepeated: 3})
+
+		_, err = ps.Signin("ddhhpp@test.com", "")
+		So(violationCodes(err), ShouldResemble, []string{PasswordTooShort})
+		_, err = ps.SigninWithAttributes("ddhhpp@test.com", "david's password", Attributes{"name": "David"})
+		So(violationCodes(err), ShouldResemble, []string{PasswordHasName})
+		_, err = bs.UserByEmail("ddhhpp@test.com")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		// the full width password is stored normalized
+		id, err := ps.SigninWithAttributes("ddhhpp@test.com", "ｃｏｒｒｅｃｔ horse", Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+		_, err = ps.Login("ddhhpp@test.com", "correct horse")
+		So(err, ShouldBeNil)
+		_, err = ps.Login("ddhhpp@test.com", "ｃｏｒｒｅｃｔ horse")
+		So(err, ShouldBeNil)
+		_, err = bs.Login("ddhhpp@test.com", "correct horse")
+		So(err, ShouldBeNil)
+		_, err = ps.Login("ddhhpp@test.com", "other horse")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		err = ps.UpdatePassword(id, "davidddd-ddhhpp")
+		So(violationCodes(err), ShouldResemble, []string{PasswordRepetitive, PasswordHasEmail, PasswordHasName})
+		err = ps.UpdatePassword("unknown", "battery staple")
+		So(err, ShouldEqual, ErrUserNotFound)
+		err = ps.UpdatePassword(id, "battery staple")
+		So(err, ShouldBeNil)
+		_, err = ps.Login("ddhhpp@test.com", "battery staple")
+		So(err, ShouldBeNil)
+
+		Convey("The users stored before the policy log in with the password as it was typed", func() {
+			_, err := bs.Signin("other@test.com", "ｐａｓｓ")
+			So(err, ShouldBeNil)
+
+			strict := NewPolicyStore(bs, PasswordPolicy{MaxRepeated: 3, NormalizedLoginsOnly: true})
+			_, err = strict.Login("other@test.com", "ｐａｓｓ")
+			So(err, ShouldEqual, ErrWrongPassword)
+
+			_, err = ps.Login("other@test.com", "pass")
+			So(err, ShouldEqual, ErrWrongPassword)
+			_, err = ps.Login("other@test.com", "ｐａｓｓ")
+			So(err, ShouldBeNil)
+
+			// the password is stored normalized, so the normalized logins are enough
+			_, err = strict.Login("other@test.com", "ｐａｓｓ")
+			So(err, ShouldBeNil)
+			_, err = bs.Login("other@test.com", "pass")
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// The users are stored in Bolt as a JSON envelope with the version of the record:
+//
+//	{"version":1,"user":{"id":"...","email":"...","password":"<base64>","salt":"<base64>","attributes":{...}}}
+//
+// New fields can be added to the record with omitempty without a new version,
+// when the meaning of a field changes add a new version and upgrade the old one in decodeUser.
+//
+// In the stores with Encryption the email and the attributes are in the "sealed" field, see recordCipher.
+//
+// The records written before the envelope are gob encoded, they are still read,
+// and they are rewritten as JSON when the user is updated or with BoltStore.UpgradeRecords.
+const recordVersion = 1
+
+type recordEnvelope struct {
+	Version int        `json:"version"`
+	User    userRecord `json:"user"`
+}
+
+// The hashed password and the salt are binary, so they are []byte to be base64 encoded
+type userRecord struct {
+	Id       string `json:"id"`
+	Email    string `json:"email"`
+	Password []byte `json:"password"`
+	Salt     []byte `json:"salt"`
+
+	Attributes Attributes `json:"attributes,omitempty"`
+	// the time is in unix seconds
+	Status      string `json:"status,omitempty"`
+	StatusUntil int64  `json:"status_until,omitempty"`
+	TenantId    string `json:"tenant_id,omitempty"`
+
+	Sealed *sealedRecord `json:"sealed,omitempty"`
+}
+
+func encodeUser(user User) ([]byte, error) {
+	return encodeRecord(user, nil)
+}
+
+// Encodes the user, with the email and the attributes encrypted when there is a cipher
+func encodeRecord(user User, c *recordCipher) ([]byte, error) {
+	env := recordEnvelope{
+		Version: recordVersion,
+		User: userRecord{
+			Id:       user.Id,
+			Email:    user.Email,
+			Password: []byte(user.Password),
+			Salt:     []byte(user.Salt),
+
+			Attributes:  user.Attributes,
+			Status:      string(user.Status),
+			StatusUntil: statusUntilUnix(user.StatusUntil),
+			TenantId:    user.TenantId,
+		},
+	}
+	if c != nil {
+		err := c.seal(&env.User, env.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(env)
+}
+
+// Decodes the record of a user, and tells if the record is
+// in an old format and should be written again
+func decodeUser(b []byte) (User, bool, error) {
+	return decodeRecord(b, nil)
+}
+
+// Decodes the record of a user, decrypting it with the cipher
+func decodeRecord(b []byte, c *recordCipher) (User, bool, error) {
+	if len(b) > 0 && b[0] == '{' {
+		var env recordEnvelope
+		err := json.Unmarshal(b, &env)
+		if err == nil && env.Version > 0 {
+			return decodeEnvelope(env, c)
+		}
+	}
+
+	// before the envelope the records were gob encoded
+	user, err := gobDecode(b)
+	return user, true, err
+}
+
+func decodeEnvelope(env recordEnvelope, c *recordCipher) (User, bool, error) {
+	if env.Version > recordVersion {
+		return User{}, false, fmt.Errorf("User record version %d is newer than the supported %d", env.Version, recordVersion)
+	}
+
+	r := env.User
+	// the records sealed with only the id are sealed again
+	legacyAD := false
+	if r.Sealed != nil {
+		legacyAD = r.Sealed.AD < sealedADVersion
+		err := c.open(&r, env.Version)
+		if err != nil {
+			return User{}, false, err
+		}
+	}
+	user := User{
+		Id:       r.Id,
+		Email:    r.Email,
+		Password: string(r.Password),
+		Salt:     string(r.Salt),
+
+		Attributes:  r.Attributes,
+		Status:      Status(r.Status),
+		StatusUntil: statusUntilTime(r.StatusUntil),
+		TenantId:    r.TenantId,
+	}
+	return user, env.Version < recordVersion || legacyAD, nil
+}
+
+func gobDecode(b []byte) (User, error) {
+	reader := bytes.NewReader(b)
+	dec := gob.NewDecoder(reader)
+	var u User
+	err := dec.Decode(&u)
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
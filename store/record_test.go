@@ -0,0 +1,60 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func gobEncode(t *testing.T, user User) []byte {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestEncodeUser(t *testing.T) {
+	Convey("Users are encoded in a versioned JSON envelope", t, func() {
+		user, err := NewUser("1", "ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		b, err := encodeUser(user)
+		So(err, ShouldBeNil)
+
+		var env map[string]interface{}
+		err = json.Unmarshal(b, &env)
+		So(err, ShouldBeNil)
+		So(env["version"], ShouldEqual, recordVersion)
+		So(env["user"].(map[string]interface{})["email"], ShouldEqual, "ddhhpp@test.com")
+
+		// the binary password and salt survive the round trip
+		decoded, old, err := decodeUser(b)
+		So(err, ShouldBeNil)
+		So(old, ShouldBeFalse)
+		So(decoded, ShouldResemble, user)
+	})
+}
+
+func TestDecodeGobUser(t *testing.T) {
+	Convey("Users encoded with gob are decoded and marked to be upgraded", t, func() {
+		user, err := NewUser("1", "ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		decoded, old, err := decodeUser(gobEncode(t, user))
+		So(err, ShouldBeNil)
+		So(old, ShouldBeTrue)
+		So(decoded, ShouldResemble, user)
+	})
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	Convey("Records of a newer version are not decoded", t, func() {
+		_, _, err := decodeUser([]byte(`{"version":1000,"user":{"id":"1"}}`))
+		So(err, ShouldNotBeNil)
+	})
+}
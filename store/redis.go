@@ -1,80 +1,548 @@
 package store
 
-// func (r *RedisRepository) Signin(email, pass string) (string, error) {
-// 	log.Println("INFO: New user Signin", email)
-
-// 	_, err := r.UserByEmail(email)
-// 	if err == nil {
-// 		log.Println("INFO: Duplicated Email: ", email)
-// 		// user is already in the system
-// 		return "", ErrEmailDuplication
-// 	}
-
-// 	id, err := r.client.Incr(usersIdKey)
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	userId := strconv.FormatInt(id, 10)
-
-// 	salt := GenerateRandomKey(32)
-// 	hpass, err := HashPassword(pass, salt)
-
-// 	if err != nil {
-// 		return "", err
-// 	}
-
-// 	data := map[string]string{
-// 		"Email":    email,
-// 		"UserId":   userId,
-// 		"Password": string(hpass),
-// 		"Salt":     string(salt),
-// 	}
-
-// 	err = r.client.HMSet(userKey+userId, data)
-// 	if err != nil {
-// 		return "", err
-// 	}
-
-// 	err = r.SetEmail(email, userId)
-// 	if err != nil {
-// 		return "", err
-// 	}
-
-// 	return userId, nil
-
-// }
-
-// func (r *RedisRepository) Login(email, pass string) (string, error) {
-// 	id, err := r.UserByEmail(email)
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	userId := string(id)
-// 	if userId == "" {
-// 		return "", ErrUserNotFound
-// 	}
-
-// 	data, err := r.client.HMGet(userKey+userId, "Password", "Salt")
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	if string(data[0]) == "" {
-// 		return "", ErrUserNotFound
-// 	}
-// 	passStored := data[0]
-// 	salt := data[1]
-
-// 	hpass, err := HashPassword(pass, salt)
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	passOk := SecureCompare(hpass, passStored)
-// 	if !passOk {
-// 		return "", ErrWrongPassword
-// 	}
-
-// 	r.client.HSet(userKey+userId, "Lastlogin", strconv.FormatInt(time.Now().Unix(), 10))
-// 	log.Println("INFO: User Login", userId, email)
-
-// 	return userId, nil
-// }
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dahernan/auth/crypto"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	usersIdKey = "users:id"
+	usersKey   = "users"
+	userKey    = "user:"
+	emailKey   = "email:"
+
+	// hash fields of the attributes of the user as JSON,
+	// and of the time of the status in unix seconds
+	attributesField  = "Attributes"
+	statusUntilField = "StatusUntil"
+
+	// times an update of a user is tried again when the user changes in between
+	maxWatchRetries = 5
+)
+
+var errUserChanged = errors.New("The user changed while it was updated")
+
+// Redis implementation of the UserRepository, the users are stored as hashes
+// under "user:<id>" and "email:<email>" is the index to find the id of the user.
+// The sorted set "users" has all the ids, to list the users.
+// All the keys are prefixed with the keyPrefix, so several stores can share the same Redis.
+type RedisStore struct {
+	pool      *redis.Pool
+	prefix    string
+	normalize EmailNormalizer
+	schema    AttributeSchema
+	hasher    crypto.Hasher
+}
+
+func NewRedisStore(pool *redis.Pool, keyPrefix string) (*RedisStore, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return &RedisStore{pool: pool, prefix: keyPrefix, normalize: NormalizeEmail}, err
+}
+
+// Changes how the emails are normalized, NormalizeEmail by default
+func (rs *RedisStore) SetEmailNormalizer(normalize EmailNormalizer) {
+	rs.normalize = normalize
+}
+
+// Validates the attributes of the users, any attribute is valid without a schema
+func (rs *RedisStore) SetAttributeSchema(schema AttributeSchema) {
+	rs.schema = schema
+}
+
+// Hashes the new passwords, crypto.DefaultHasher by default
+func (rs *RedisStore) SetHasher(hasher crypto.Hasher) {
+	rs.hasher = hasher
+}
+
+func (rs *RedisStore) UserByEmail(email string) (User, error) {
+	return rs.UserByEmailContext(context.Background(), email)
+}
+
+func (rs *RedisStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	return rs.userByEmail(conn, email)
+}
+
+func (rs *RedisStore) Signin(email, pass string) (string, error) {
+	return rs.SigninContext(context.Background(), email, pass)
+}
+
+func (rs *RedisStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return rs.SigninWithAttributesContext(ctx, email, pass, nil)
+}
+
+func (rs *RedisStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return rs.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (rs *RedisStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	err := validateAttributes(rs.schema, attrs)
+	if err != nil {
+		return "", err
+	}
+	jattrs, err := marshalAttributes(attrs)
+	if err != nil {
+		return "", err
+	}
+
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	// check if the user exists, before spending time hashing the password
+	_, err = rs.userByEmail(conn, email)
+	if err == nil {
+		return "", ErrEmailDuplication
+	}
+	if err != ErrUserNotFound {
+		return "", err
+	}
+
+	email, err = rs.normalize(email)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := redis.Int64(conn.Do("INCR", rs.key(usersIdKey)))
+	if err != nil {
+		return "", err
+	}
+	userId := strconv.FormatInt(id, 10)
+
+	user, err := NewUserWithHasher(rs.hasher, userId, email, pass)
+	if err != nil {
+		return "", err
+	}
+
+	args := redis.Args{}.Add(rs.key(userKey + userId)).AddFlat(&user)
+	if jattrs != "" {
+		args = args.Add(attributesField, jattrs)
+	}
+	_, err = conn.Do("HMSET", args...)
+	if err != nil {
+		return "", err
+	}
+
+	// the email index is written the last, so it always points to a complete user,
+	// SETNX guarantees that only one of two concurrent signins wins the email
+	ok, err := redis.Bool(conn.Do("SETNX", rs.key(emailKey+email), userId))
+	if err == nil && !ok {
+		err = ErrEmailDuplication
+	}
+	if err != nil {
+		undo(conn, "DEL", rs.key(userKey+userId))
+		return "", err
+	}
+
+	_, err = conn.Do("ZADD", rs.key(usersKey), id, userId)
+	if err != nil {
+		return "", err
+	}
+
+	return userId, nil
+}
+
+func (rs *RedisStore) Login(email, pass string) (string, error) {
+	return rs.LoginContext(context.Background(), email, pass)
+}
+
+func (rs *RedisStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	user, err := rs.userByEmail(conn, email)
+	if err == ErrUserNotFound {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = checkPassword(rs.hasher, user, pass)
+	if err != nil {
+		return "", err
+	}
+
+	err = user.CheckStatus(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+func (rs *RedisStore) UserById(userId string) (User, error) {
+	return rs.UserByIdContext(context.Background(), userId)
+}
+
+func (rs *RedisStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	return rs.userById(conn, userId)
+}
+
+func (rs *RedisStore) UpdatePassword(userId, pass string) error {
+	return rs.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (rs *RedisStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	hpass, err := hashPassword(rs.hasher, pass)
+	if err != nil {
+		return err
+	}
+
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	return rs.setUserFields(conn, userId, func(User) (redis.Args, error) {
+		return redis.Args{"Password", hpass, "Salt", ""}, nil
+	})
+}
+
+func (rs *RedisStore) UpdateEmail(userId, email string) error {
+	return rs.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (rs *RedisStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	email, err := rs.normalize(email)
+	if err != nil {
+		return err
+	}
+
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	// the new email is watched, so a signin with it in between is a duplication when it is tried again
+	newKey := rs.key(emailKey + email)
+	return rs.updateUser(conn, userId, []string{newKey}, func(user User) ([]redis.Args, error) {
+		if user.Email == email {
+			return nil, nil
+		}
+		exists, err := redis.Bool(conn.Do("EXISTS", newKey))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrEmailDuplication
+		}
+		return []redis.Args{
+			{"SET", newKey, userId},
+			{"HSET", rs.key(userKey + userId), "Email", email},
+			{"DEL", rs.key(emailKey + user.Email)},
+		}, nil
+	})
+}
+
+func (rs *RedisStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return rs.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (rs *RedisStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	return rs.setUserFields(conn, userId, func(user User) (redis.Args, error) {
+		merged := mergeAttributes(user.Attributes, attrs)
+		err := validateAttributes(rs.schema, merged)
+		if err != nil {
+			return nil, err
+		}
+		jattrs, err := marshalAttributes(merged)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Args{attributesField, jattrs}, nil
+	})
+}
+
+func (rs *RedisStore) SetStatus(userId string, status Status, until time.Time) error {
+	return rs.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (rs *RedisStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	return rs.setUserFields(conn, userId, func(user User) (redis.Args, error) {
+		err := setStatus(&user, status, until)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Args{"Status", string(user.Status), statusUntilField, statusUntilUnix(user.StatusUntil)}, nil
+	})
+}
+
+func (rs *RedisStore) PurgeUsers(now time.Time) ([]string, error) {
+	return rs.PurgeUsersContext(context.Background(), now)
+}
+
+func (rs *RedisStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", rs.key(usersKey), "-inf", "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, id := range ids {
+		user, err := rs.userById(conn, id)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		if !user.purgeable(now) {
+			continue
+		}
+
+		_, err = conn.Do("DEL", rs.key(emailKey+user.Email), rs.key(userKey+id))
+		if err != nil {
+			return purged, err
+		}
+		_, err = conn.Do("ZREM", rs.key(usersKey), id)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, id)
+	}
+	return purged, nil
+}
+
+func (rs *RedisStore) DeleteUser(userId string) error {
+	return rs.DeleteUserContext(context.Background(), userId)
+}
+
+func (rs *RedisStore) DeleteUserContext(ctx context.Context, userId string) error {
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	user, err := rs.userById(conn, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("DEL", rs.key(emailKey+user.Email), rs.key(userKey+userId))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("ZREM", rs.key(usersKey), userId)
+	return err
+}
+
+// Users are listed in the order of the ids, and the cursor is the id of the last user of the page
+func (rs *RedisStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return rs.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (rs *RedisStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	min := "-inf"
+	if cursor != "" {
+		_, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		min = "(" + cursor
+	}
+
+	conn := rs.conn(ctx)
+	defer conn.Close()
+
+	args := redis.Args{}.Add(rs.key(usersKey), min, "+inf")
+	if limit > 0 {
+		// one more to know if there is a next page
+		args = args.Add("LIMIT", 0, limit+1)
+	}
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
+	}
+
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		user, err := rs.userById(conn, id)
+		// deleted after the ids were read
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+	return users, next, nil
+}
+
+// Sets the fields that fields returns for the current user in the hash of the user,
+// in the transaction of updateUser
+func (rs *RedisStore) setUserFields(conn redis.Conn, userId string, fields func(User) (redis.Args, error)) error {
+	key := rs.key(userKey + userId)
+	return rs.updateUser(conn, userId, nil, func(user User) ([]redis.Args, error) {
+		args, err := fields(user)
+		if err != nil {
+			return nil, err
+		}
+		return []redis.Args{append(redis.Args{"HMSET", key}, args...)}, nil
+	})
+}
+
+// Runs the commands that commands returns for the current user in a MULTI that watches the key
+// of the user and the watched keys. A user deleted after it is read is not created again with only
+// the fields of the commands, and the commands are built again when a key changes in between.
+// No commands are run when commands returns none
+func (rs *RedisStore) updateUser(conn redis.Conn, userId string, watched []string, commands func(User) ([]redis.Args, error)) error {
+	keys := append(redis.Args{rs.key(userKey + userId)}, redis.Args{}.AddFlat(watched)...)
+	for i := 0; i < maxWatchRetries; i++ {
+		_, err := conn.Do("WATCH", keys...)
+		if err != nil {
+			return err
+		}
+		user, err := rs.userById(conn, userId)
+		if err != nil {
+			undo(conn, "UNWATCH")
+			return err
+		}
+		cmds, err := commands(user)
+		if err != nil || len(cmds) == 0 {
+			undo(conn, "UNWATCH")
+			return err
+		}
+
+		_, err = conn.Do("MULTI")
+		if err != nil {
+			undo(conn, "DISCARD")
+			return err
+		}
+		for _, cmd := range cmds {
+			_, err = conn.Do(cmd[0].(string), cmd[1:]...)
+			if err != nil {
+				undo(conn, "DISCARD")
+				return err
+			}
+		}
+		// a nil reply when a key changed after the WATCH
+		_, err = redis.Values(conn.Do("EXEC"))
+		if err != redis.ErrNil {
+			return err
+		}
+	}
+	return errUserChanged
+}
+
+func (rs *RedisStore) userByEmail(conn redis.Conn, email string) (User, error) {
+	for _, e := range lookupEmails(rs.normalize, email) {
+		userId, err := redis.String(conn.Do("GET", rs.key(emailKey+e)))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		return rs.userById(conn, userId)
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (rs *RedisStore) userById(conn redis.Conn, userId string) (User, error) {
+	values, err := redis.Values(conn.Do("HGETALL", rs.key(userKey+userId)))
+	if err != nil {
+		return User{}, err
+	}
+	if len(values) == 0 {
+		return User{}, ErrUserNotFound
+	}
+
+	var user User
+	err = redis.ScanStruct(values, &user)
+	if err != nil {
+		return User{}, err
+	}
+
+	// the fields that are not flat
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := redis.String(values[i], nil)
+		switch field {
+		case attributesField:
+			jattrs, _ := redis.String(values[i+1], nil)
+			user.Attributes, err = unmarshalAttributes(jattrs)
+			if err != nil {
+				return User{}, err
+			}
+		case statusUntilField:
+			until, _ := redis.Int64(values[i+1], nil)
+			user.StatusUntil = statusUntilTime(until)
+		}
+	}
+	return user, nil
+}
+
+func (rs *RedisStore) key(k string) string {
+	return rs.prefix + k
+}
+
+// Connection of the pool for the context, like Pool.Get the error
+// getting the connection is returned by the commands
+func (rs *RedisStore) conn(ctx context.Context) redis.Conn {
+	conn, err := rs.pool.GetContext(ctx)
+	if err != nil {
+		return errorConn{err}
+	}
+	return contextConn{conn, ctx}
+}
+
+// Checks the context before every command, and does not wait
+// for the reply after the deadline of the context
+type contextConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+func (c contextConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return c.Conn.Do(cmd, args...)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+// Undoes a write that failed, even if the context is done
+func undo(conn redis.Conn, cmd string, args ...interface{}) {
+	if cc, ok := conn.(contextConn); ok {
+		conn = cc.Conn
+	}
+	conn.Do(cmd, args...)
+}
+
+type errorConn struct{ err error }
+
+func (ec errorConn) Close() error                                   { return nil }
+func (ec errorConn) Err() error                                     { return ec.err }
+func (ec errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, ec.err }
+func (ec errorConn) Send(string, ...interface{}) error              { return ec.err }
+func (ec errorConn) Flush() error                                   { return ec.err }
+func (ec errorConn) Receive() (interface{}, error)                  { return nil, ec.err }
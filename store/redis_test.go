@@ -0,0 +1,541 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// In-process stand-in for a Redis server, it speaks enough RESP
+// to serve the commands used by the RedisStore
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	strings  map[string]string
+	hashes   map[string]map[string]string
+	zsets    map[string]map[string]float64
+	// changes with every write of the key, for WATCH
+	versions map[string]int
+	// runs before the EXEC of a transaction, with the lock held
+	beforeExec func(fr *fakeRedis)
+}
+
+// The WATCH and MULTI of a connection
+type fakeTx struct {
+	watched map[string]int
+	multi   bool
+	queue   [][]string
+}
+
+func NewFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		listener: l,
+		strings:  make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		zsets:    make(map[string]map[string]float64),
+		versions: make(map[string]int),
+	}
+	go fr.serve()
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.listener.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.listener.Close()
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fr.serveConn(conn)
+	}
+}
+
+func (fr *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	tx := &fakeTx{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.command(w, tx, args)
+		w.Flush()
+	}
+}
+
+// The transactions are run here, the rest of the commands with exec
+func (fr *fakeRedis) command(w *bufio.Writer, tx *fakeTx, args []string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "WATCH":
+		if tx.watched == nil {
+			tx.watched = make(map[string]int)
+		}
+		for _, k := range args[1:] {
+			tx.watched[k] = fr.versions[k]
+		}
+		fmt.Fprint(w, "+OK\r\n")
+	case cmd == "UNWATCH":
+		tx.watched = nil
+		fmt.Fprint(w, "+OK\r\n")
+	case cmd == "MULTI":
+		tx.multi = true
+		fmt.Fprint(w, "+OK\r\n")
+	case cmd == "DISCARD":
+		*tx = fakeTx{}
+		fmt.Fprint(w, "+OK\r\n")
+	case cmd == "EXEC":
+		if fr.beforeExec != nil {
+			fr.beforeExec(fr)
+		}
+		watched, queue := tx.watched, tx.queue
+		*tx = fakeTx{}
+		for k, version := range watched {
+			if fr.versions[k] != version {
+				fmt.Fprint(w, "*-1\r\n")
+				return
+			}
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(queue))
+		for _, queued := range queue {
+			fr.exec(w, queued)
+		}
+	case tx.multi:
+		tx.queue = append(tx.queue, args)
+		fmt.Fprint(w, "+QUEUED\r\n")
+	default:
+		fr.exec(w, args)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (fr *fakeRedis) exec(w *bufio.Writer, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "SET", "SETNX", "INCR", "HSET", "HMSET", "ZADD", "ZREM":
+		fr.versions[args[1]]++
+	case "DEL":
+		for _, k := range args[1:] {
+			fr.versions[k]++
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		fmt.Fprint(w, "+PONG\r\n")
+	case "EXISTS":
+		_, ok := fr.strings[args[1]]
+		_, hok := fr.hashes[args[1]]
+		writeBool(w, ok || hok)
+	case "GET":
+		v, ok := fr.strings[args[1]]
+		if !ok {
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		writeBulk(w, v)
+	case "SET":
+		fr.strings[args[1]] = args[2]
+		fmt.Fprint(w, "+OK\r\n")
+	case "SETNX":
+		_, ok := fr.strings[args[1]]
+		if !ok {
+			fr.strings[args[1]] = args[2]
+		}
+		writeBool(w, !ok)
+	case "INCR":
+		n, _ := strconv.ParseInt(fr.strings[args[1]], 10, 64)
+		n++
+		fr.strings[args[1]] = strconv.FormatInt(n, 10)
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "DEL":
+		deleted := 0
+		for _, k := range args[1:] {
+			if _, ok := fr.strings[k]; ok {
+				deleted++
+			}
+			if _, ok := fr.hashes[k]; ok {
+				deleted++
+			}
+			if _, ok := fr.zsets[k]; ok {
+				deleted++
+			}
+			delete(fr.strings, k)
+			delete(fr.hashes, k)
+			delete(fr.zsets, k)
+		}
+		fmt.Fprintf(w, ":%d\r\n", deleted)
+	case "HSET", "HMSET":
+		h, ok := fr.hashes[args[1]]
+		if !ok {
+			h = make(map[string]string)
+			fr.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		fmt.Fprint(w, "+OK\r\n")
+	case "HGETALL":
+		h := fr.hashes[args[1]]
+		fmt.Fprintf(w, "*%d\r\n", len(h)*2)
+		for k, v := range h {
+			writeBulk(w, k)
+			writeBulk(w, v)
+		}
+	case "HGET":
+		v, ok := fr.hashes[args[1]][args[2]]
+		if !ok {
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		writeBulk(w, v)
+	case "ZADD":
+		z, ok := fr.zsets[args[1]]
+		if !ok {
+			z = make(map[string]float64)
+			fr.zsets[args[1]] = z
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := z[args[i+1]]; !ok {
+				added++
+			}
+			z[args[i+1]] = score
+		}
+		fmt.Fprintf(w, ":%d\r\n", added)
+	case "ZREM":
+		removed := 0
+		for _, m := range args[2:] {
+			if _, ok := fr.zsets[args[1]][m]; ok {
+				removed++
+				delete(fr.zsets[args[1]], m)
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", removed)
+	case "ZRANGEBYSCORE":
+		members := fr.zrangeByScore(args[1], args[2], args[3])
+		if len(args) == 7 && strings.ToUpper(args[4]) == "LIMIT" {
+			offset, _ := strconv.Atoi(args[5])
+			count, _ := strconv.Atoi(args[6])
+			if offset > len(members) {
+				offset = len(members)
+			}
+			members = members[offset:]
+			if count >= 0 && count < len(members) {
+				members = members[:count]
+			}
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(members))
+		for _, m := range members {
+			writeBulk(w, m)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func (fr *fakeRedis) zrangeByScore(key, min, max string) []string {
+	z := fr.zsets[key]
+	lower, lowerExclusive := parseScore(min)
+	upper, upperExclusive := parseScore(max)
+
+	var members []string
+	for m, score := range z {
+		if score < lower || (lowerExclusive && score == lower) {
+			continue
+		}
+		if score > upper || (upperExclusive && score == upper) {
+			continue
+		}
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] == z[members[j]] {
+			return members[i] < members[j]
+		}
+		return z[members[i]] < z[members[j]]
+	})
+	return members
+}
+
+func parseScore(s string) (float64, bool) {
+	exclusive := strings.HasPrefix(s, "(")
+	score, _ := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	return score, exclusive
+}
+
+func (fr *fakeRedis) exists(key string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	_, ok := fr.strings[key]
+	_, hok := fr.hashes[key]
+	return ok || hok
+}
+
+func writeBulk(w *bufio.Writer, v string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+}
+
+func writeBool(w *bufio.Writer, b bool) {
+	if b {
+		fmt.Fprint(w, ":1\r\n")
+		return
+	}
+	fmt.Fprint(w, ":0\r\n")
+}
+
+func NewRedisPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 1 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+}
+
+func TestRedisSignIn(t *testing.T) {
+	Convey("SingIn in Redis", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+		So(rs, ShouldNotBeNil)
+
+		id, err := rs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "1")
+
+		id, err = rs.Signin("other@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "2")
+
+	})
+}
+
+func TestRedisGetUserDataByEmail(t *testing.T) {
+	Convey("Gets the user data by the email from Redis", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		id, err := rs.Signin(email, "123456")
+		So(err, ShouldBeNil)
+
+		user, err := rs.UserByEmail(email)
+		So(err, ShouldBeNil)
+
+		So(user.Id, ShouldEqual, id)
+		So(user.Email, ShouldEqual, email)
+		So(user.Password, ShouldStartWith, "$scrypt$")
+		So(user.Salt, ShouldBeEmpty)
+
+		_, err = rs.UserByEmail("no@user.com")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+	})
+}
+
+func TestRedisLogIn(t *testing.T) {
+	Convey("Log in Redis", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+		id, err := rs.Signin(email, pass)
+		So(err, ShouldBeNil)
+
+		loginId, err := rs.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+
+		_, err = rs.Login(email, "xyz")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		_, err = rs.Login("no@user.com", pass)
+		So(err, ShouldEqual, ErrWrongPassword)
+	})
+}
+
+func TestRedisListUsers(t *testing.T) {
+	Convey("Redis: Lists the users by pages", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+
+		for _, email := range []string{"a@test.com", "b@test.com", "c@test.com"} {
+			_, err = rs.Signin(email, "123456")
+			So(err, ShouldBeNil)
+		}
+
+		users, cursor, err := rs.ListUsers("", 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Email, ShouldEqual, "a@test.com")
+		So(users[1].Email, ShouldEqual, "b@test.com")
+		So(cursor, ShouldNotBeEmpty)
+
+		users, cursor, err = rs.ListUsers(cursor, 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].Email, ShouldEqual, "c@test.com")
+		So(cursor, ShouldBeEmpty)
+
+		users, cursor, err = rs.ListUsers("", 0)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 3)
+		So(cursor, ShouldBeEmpty)
+	})
+}
+
+func TestRedisConcurrentDelete(t *testing.T) {
+	Convey("Redis: the updates do not create again a user deleted in between", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+
+		id, err := rs.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		_, err = rs.Signin("other@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		// the user is deleted after it is read, before the EXEC of the update
+		fr.beforeExec = func(fr *fakeRedis) {
+			fr.beforeExec = nil
+			fr.exec(bufio.NewWriter(ioutil.Discard), []string{"DEL", "test:" + userKey + id, "test:" + emailKey + "ddhhpp@test.com"})
+		}
+		err = rs.UpdatePassword(id, "new password")
+		So(err, ShouldEqual, ErrUserNotFound)
+		_, err = rs.UserById(id)
+		So(err, ShouldEqual, ErrUserNotFound)
+
+		// the update is tried again when the user changes in between
+		otherId := "2"
+		fr.beforeExec = func(fr *fakeRedis) {
+			fr.beforeExec = nil
+			fr.exec(bufio.NewWriter(ioutil.Discard), []string{"HSET", "test:" + userKey + otherId, "Status", string(StatusDisabled)})
+		}
+		err = rs.UpdateAttributes(otherId, Attributes{"name": "David"})
+		So(err, ShouldBeNil)
+		user, err := rs.UserById(otherId)
+		So(err, ShouldBeNil)
+		So(user.Status, ShouldEqual, StatusDisabled)
+		So(user.Attributes["name"], ShouldEqual, "David")
+
+		Convey("A change of the email does not create again a user deleted in between", func() {
+			fr.beforeExec = func(fr *fakeRedis) {
+				fr.beforeExec = nil
+				fr.exec(bufio.NewWriter(ioutil.Discard), []string{"DEL", "test:" + userKey + otherId, "test:" + emailKey + "other@test.com"})
+			}
+			err := rs.UpdateEmail(otherId, "new@test.com")
+			So(err, ShouldEqual, ErrUserNotFound)
+			So(fr.exists("test:"+userKey+otherId), ShouldBeFalse)
+			So(fr.exists("test:"+emailKey+"new@test.com"), ShouldBeFalse)
+		})
+
+		Convey("A signin with the new email in between is a duplication", func() {
+			fr.beforeExec = func(fr *fakeRedis) {
+				fr.beforeExec = nil
+				fr.exec(bufio.NewWriter(ioutil.Discard), []string{"SETNX", "test:" + emailKey + "new@test.com", "99"})
+			}
+			err := rs.UpdateEmail(otherId, "new@test.com")
+			So(err, ShouldEqual, ErrEmailDuplication)
+			user, err := rs.UserByEmail("other@test.com")
+			So(err, ShouldBeNil)
+			So(user.Id, ShouldEqual, otherId)
+		})
+
+		Convey("The users deleted while they are listed are skipped", func() {
+			users, _, err := rs.ListUsers("", 0)
+			So(err, ShouldBeNil)
+			So(len(users), ShouldEqual, 1)
+			So(users[0].Id, ShouldEqual, otherId)
+		})
+	})
+}
+
+func TestRedisNormalizedEmails(t *testing.T) {
+	Convey("Redis finds the users by the normalized email", t, func() {
+		fr := NewFakeRedis(t)
+		defer fr.Close()
+
+		rs, err := NewRedisStore(NewRedisPool(fr.Addr()), "test:")
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := rs.Signin("Bob@Example.com", pass)
+		So(err, ShouldBeNil)
+
+		_, err = rs.Signin(" bob@example.COM", pass)
+		So(err, ShouldEqual, ErrEmailDuplication)
+
+		loginId, err := rs.Login("BOB@example.com", pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+	})
+}
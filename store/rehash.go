@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dahernan/auth/crypto"
+)
+
+// The algorithm of the scrypt hashes with a separate salt in the reports
+const LegacyScrypt = "scrypt-legacy"
+
+// How the passwords of the users of a store are hashed
+type PasswordReport struct {
+	Users int
+	// Users with a hash that is weaker than the ones of the hasher of the store,
+	// they are hashed again when they log in
+	Legacy int
+	// Users by the algorithm of their hash, LegacyScrypt for the hashes with a separate salt
+	// and an empty algorithm for the unknown ones
+	Algorithms map[string]int
+	// Users with a peppered hash by the id of the key of the pepper
+	Peppers map[string]int
+}
+
+// The legacy hashes with a salt are always hashed again
+func needsRehash(hasher crypto.Hasher, user User) bool {
+	return user.Salt != "" || hasher.NeedsRehash(user.Password)
+}
+
+// Checks the password and the status of the user, and hashes the password again with the hasher of the store
+// in the same transaction, so the hash that is replaced is the one the password was checked with.
+// Only the logins of the users with a weaker hash take the write transaction, the rest are checked
+// in a read one. The users that can not log in keep their hash
+func (bs *BoltStore) loginAndRehash(ctx context.Context, email, pass string) (string, error) {
+	var userId string
+	err := bs.update(ctx, func(tx *bolt.Tx) error {
+		id := bs.lookupEmail(bs.parent(tx).Bucket(bs.emailBucket), email)
+		if id == nil {
+			return ErrWrongPassword
+		}
+		b := bs.parent(tx).Bucket(bs.bucket)
+		user, err := bs.getUser(b, string(id))
+		if err == ErrUserNotFound {
+			return ErrWrongPassword
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkPassword(bs.hasher, user, pass)
+		if err != nil {
+			return err
+		}
+		err = user.CheckStatus(time.Now())
+		if err != nil {
+			return err
+		}
+		userId = user.Id
+		if !needsRehash(bs.hasher, user) {
+			return nil
+		}
+
+		user.Password, err = hashPassword(bs.hasher, pass)
+		if err != nil {
+			return err
+		}
+		user.Salt = ""
+		return bs.putUser(b, user)
+	})
+	if err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (bs *BoltStore) PasswordReport() (PasswordReport, error) {
+	return bs.PasswordReportContext(context.Background())
+}
+
+// Counts the users by the algorithm of their hash and the ones with a weaker hash than the hasher of the store
+func (bs *BoltStore) PasswordReportContext(ctx context.Context) (PasswordReport, error) {
+	report := PasswordReport{Algorithms: make(map[string]int), Peppers: make(map[string]int)}
+	err := bs.view(ctx, func(tx *bolt.Tx) error {
+		return bs.parent(tx).Bucket(bs.bucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			user, _, err := bs.decodeUser(v)
+			if err != nil {
+				return err
+			}
+
+			report.Users++
+			if needsRehash(bs.hasher, user) {
+				report.Legacy++
+			}
+			if user.Salt != "" {
+				report.Algorithms[LegacyScrypt]++
+			} else {
+				report.Algorithms[crypto.HashAlgorithm(user.Password)]++
+			}
+			if keyId, ok := crypto.PepperKeyId(user.Password); ok {
+				report.Peppers[keyId]++
+			}
+			return nil
+		})
+	})
+	return report, err
+}
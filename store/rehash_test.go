@@ -0,0 +1,189 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dahernan/auth/crypto"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRehashOnLogin(t *testing.T) {
+	Convey("The weak hashes are hashed again when the users log in", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketRehash"
+		DeleteBucket(t, db, bucket)
+		weak, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.ScryptHasher{N: 1024, R: 8, P: 1}})
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := weak.Signin("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = weak.Signin("other@test.com", pass)
+		So(err, ShouldBeNil)
+
+		salt := crypto.GenerateRandomKey(128)
+		legacy, err := crypto.HashPassword(pass, salt)
+		So(err, ShouldBeNil)
+		err = db.Update(func(tx *bolt.Tx) error {
+			err := putUser(tx.Bucket([]byte(bucket)), User{Id: "legacy", Email: "legacy@test.com", Password: string(legacy), Salt: string(salt)})
+			if err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(bucket+".email")).Put([]byte("legacy@test.com"), []byte("legacy"))
+		})
+		So(err, ShouldBeNil)
+
+		report, err := weak.PasswordReport()
+		So(err, ShouldBeNil)
+		So(report.Users, ShouldEqual, 3)
+		So(report.Legacy, ShouldEqual, 1)
+		So(report.Algorithms, ShouldResemble, map[string]int{"scrypt": 2, LegacyScrypt: 1})
+		So(report.Peppers, ShouldBeEmpty)
+
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.Argon2Hasher{Time: 1, Memory: 1024, Threads: 1}})
+		So(err, ShouldBeNil)
+		report, err = bs.PasswordReport()
+		So(err, ShouldBeNil)
+		So(report.Legacy, ShouldEqual, 3)
+
+		loginId, err := bs.Login("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+		_, err = bs.Login("legacy@test.com", pass)
+		So(err, ShouldBeNil)
+
+		user, err := bs.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Password, ShouldStartWith, "$argon2id$")
+		user, err = bs.UserById("legacy")
+		So(err, ShouldBeNil)
+		So(user.Password, ShouldStartWith, "$argon2id$")
+		So(user.Salt, ShouldBeEmpty)
+
+		report, err = bs.PasswordReport()
+		So(err, ShouldBeNil)
+		So(report.Users, ShouldEqual, 3)
+		So(report.Legacy, ShouldEqual, 1)
+		So(report.Algorithms, ShouldResemble, map[string]int{"argon2id": 2, "scrypt": 1})
+
+		// the rehashed users log in with the same password
+		_, err = bs.Login("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = bs.Login("legacy@test.com", "other")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		Convey("A wrong password does not rehash", func() {
+			_, err := bs.Login("other@test.com", "other")
+			So(err, ShouldEqual, ErrWrongPassword)
+			user, err := bs.UserByEmail("other@test.com")
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldStartWith, "$scrypt$")
+		})
+
+		Convey("The users that can not log in are not rehashed", func() {
+			other, err := bs.UserByEmail("other@test.com")
+			So(err, ShouldBeNil)
+			So(DisableUser(bs, other.Id), ShouldBeNil)
+			_, err = bs.Login("other@test.com", pass)
+			So(err, ShouldEqual, ErrAccountDisabled)
+			user, err := bs.UserById(other.Id)
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldEqual, other.Password)
+		})
+
+		Convey("The errors of the rehash are errors of the login", func() {
+			// 3000 is not a power of 2, and the hashes of N=1024 are below it
+			broken, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.ScryptHasher{N: 3000, R: 8, P: 1}})
+			So(err, ShouldBeNil)
+			other, err := bs.UserByEmail("other@test.com")
+			So(err, ShouldBeNil)
+			_, err = broken.Login("other@test.com", pass)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrWrongPassword)
+			user, err := bs.UserById(other.Id)
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldEqual, other.Password)
+		})
+
+		Convey("The stronger hashes are kept", func() {
+			weak, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.ScryptHasher{N: 1024, R: 8, P: 1}})
+			So(err, ShouldBeNil)
+			_, err = weak.Login("other@test.com", pass)
+			So(err, ShouldBeNil)
+			report, err := weak.PasswordReport()
+			So(err, ShouldBeNil)
+			So(report.Legacy, ShouldEqual, 2)
+
+			lower, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.Argon2Hasher{Time: 1, Memory: 512, Threads: 1}})
+			So(err, ShouldBeNil)
+			_, err = lower.Login("ddhhpp@test.com", pass)
+			So(err, ShouldBeNil)
+			user, err := lower.UserById(id)
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldStartWith, "$argon2id$v=19$m=1024,")
+		})
+	})
+}
+
+func TestPepperRotation(t *testing.T) {
+	Convey("The users are peppered again with the new key when they log in", t, func() {
+		db := NewDB(t, "testUsers.db")
+		defer db.Close()
+
+		bucket := "testBucketPepper"
+		DeleteBucket(t, db, bucket)
+
+		key1 := []byte("first pepper key of 32 bytes....")
+		key2 := []byte("second pepper key of 32 bytes...")
+		scrypt := crypto.ScryptHasher{N: 1024, R: 8, P: 1}
+		pepper1, err := crypto.NewPepper("k1", map[string][]byte{"k1": key1})
+		So(err, ShouldBeNil)
+		bs, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.PepperedHasher{Hasher: scrypt, Pepper: pepper1}})
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := bs.Signin("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = bs.Signin("other@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = bs.Login("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		_, err = bs.Login("ddhhpp@test.com", "other")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		// the database alone does not check the passwords
+		plain, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: scrypt})
+		So(err, ShouldBeNil)
+		_, err = plain.Login("ddhhpp@test.com", pass)
+		So(err, ShouldNotBeNil)
+		So(err, ShouldNotEqual, ErrWrongPassword)
+
+		pepper2, err := crypto.NewPepper("k2", map[string][]byte{"k1": key1, "k2": key2})
+		So(err, ShouldBeNil)
+		rotated, err := NewBoltStoreWithOptions(db, bucket, BoltOptions{Hasher: crypto.PepperedHasher{Hasher: scrypt, Pepper: pepper2}})
+		So(err, ShouldBeNil)
+		report, err := rotated.PasswordReport()
+		So(err, ShouldBeNil)
+		So(report.Legacy, ShouldEqual, 2)
+		So(report.Peppers, ShouldResemble, map[string]int{"k1": 2})
+
+		loginId, err := rotated.Login("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+		user, err := rotated.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Password, ShouldStartWith, "$peppered$k=k2$scrypt$")
+
+		report, err = rotated.PasswordReport()
+		So(err, ShouldBeNil)
+		So(report.Legacy, ShouldEqual, 1)
+		So(report.Peppers, ShouldResemble, map[string]int{"k1": 1, "k2": 1})
+		So(report.Algorithms, ShouldResemble, map[string]int{"scrypt": 2})
+
+		_, err = rotated.Login("ddhhpp@test.com", pass)
+		So(err, ShouldBeNil)
+	})
+}
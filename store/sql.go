@@ -0,0 +1,562 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dahernan/auth/crypto"
+)
+
+// SQL dialect, it has the differences between the supported databases
+type Dialect struct {
+	Name string
+	// Placeholder for the n-th (starting at 1) parameter of a statement
+	Placeholder func(n int) string
+	// Column type for an autoincremented primary key
+	Serial string
+	// Column type for binary data
+	Binary string
+}
+
+var (
+	SQLite = Dialect{
+		Name:        "sqlite3",
+		Placeholder: func(n int) string { return "?" },
+		Serial:      "INTEGER PRIMARY KEY AUTOINCREMENT",
+		Binary:      "BLOB",
+	}
+
+	Postgres = Dialect{
+		Name:        "postgres",
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		Serial:      "SERIAL PRIMARY KEY",
+		Binary:      "BYTEA",
+	}
+)
+
+// Schema migrations are applied in order when the store is created,
+// and the version is recorded in the migrations table.
+// Never change a migration that is already released, add a new one.
+type migration struct {
+	version int
+	up      string
+}
+
+var sqlMigrations = []migration{
+	{1, `CREATE TABLE {table} (
+		id {serial},
+		email VARCHAR(255) NOT NULL UNIQUE,
+		password {binary} NOT NULL,
+		salt {binary} NOT NULL
+	)`},
+	// the attributes of the user as JSON
+	{2, `ALTER TABLE {table} ADD COLUMN attributes TEXT`},
+	// the status of the account, and its time in unix seconds
+	{3, `ALTER TABLE {table} ADD COLUMN status VARCHAR(32)`},
+	{4, `ALTER TABLE {table} ADD COLUMN status_until BIGINT`},
+}
+
+const userColumns = "id, email, password, salt, attributes, status, status_until"
+
+// SQL implementation of the UserRepository on top of database/sql.
+// The driver for the dialect has to be imported by the application.
+type SQLStore struct {
+	db        *sql.DB
+	dialect   Dialect
+	table     string
+	normalize EmailNormalizer
+	schema    AttributeSchema
+	hasher    crypto.Hasher
+}
+
+// Creates the store and applies the pending schema migrations.
+// The table name is used as it is in the statements, so it must not come from user input.
+func NewSQLStore(db *sql.DB, dialect Dialect, table string) (*SQLStore, error) {
+	ss := &SQLStore{db: db, dialect: dialect, table: table, normalize: NormalizeEmail}
+	err := ss.migrate()
+	return ss, err
+}
+
+// Changes how the emails are normalized, NormalizeEmail by default
+func (ss *SQLStore) SetEmailNormalizer(normalize EmailNormalizer) {
+	ss.normalize = normalize
+}
+
+// Validates the attributes of the users, any attribute is valid without a schema
+func (ss *SQLStore) SetAttributeSchema(schema AttributeSchema) {
+	ss.schema = schema
+}
+
+// Hashes the new passwords, crypto.DefaultHasher by default
+func (ss *SQLStore) SetHasher(hasher crypto.Hasher) {
+	ss.hasher = hasher
+}
+
+// Returns the last migration applied to the schema
+func (ss *SQLStore) SchemaVersion() (int, error) {
+	var version int
+	err := ss.db.QueryRow(ss.stmt("SELECT COALESCE(MAX(version), 0) FROM {table}_migrations")).Scan(&version)
+	return version, err
+}
+
+func (ss *SQLStore) migrate() error {
+	_, err := ss.db.Exec(ss.stmt(`CREATE TABLE IF NOT EXISTS {table}_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`))
+	if err != nil {
+		return fmt.Errorf("Creating migrations table: %s", err)
+	}
+
+	current, err := ss.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range sqlMigrations {
+		if m.version <= current {
+			continue
+		}
+		err = ss.apply(m)
+		if err != nil {
+			return fmt.Errorf("Applying migration %d: %s", m.version, err)
+		}
+	}
+	return nil
+}
+
+func (ss *SQLStore) apply(m migration) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ss.stmt(m.up))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(ss.stmt("INSERT INTO {table}_migrations (version, applied_at) VALUES (?, ?)"), m.version, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLStore) UserByEmail(email string) (User, error) {
+	return ss.UserByEmailContext(context.Background(), email)
+}
+
+func (ss *SQLStore) UserByEmailContext(ctx context.Context, email string) (User, error) {
+	for _, e := range lookupEmails(ss.normalize, email) {
+		row := ss.db.QueryRowContext(ctx, ss.stmt("SELECT "+userColumns+" FROM {table} WHERE email = ?"), e)
+		user, err := scanUser(row)
+		if err != ErrUserNotFound {
+			return user, err
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (ss *SQLStore) Signin(email, pass string) (string, error) {
+	return ss.SigninContext(context.Background(), email, pass)
+}
+
+func (ss *SQLStore) SigninContext(ctx context.Context, email, pass string) (string, error) {
+	return ss.SigninWithAttributesContext(ctx, email, pass, nil)
+}
+
+func (ss *SQLStore) SigninWithAttributes(email, pass string, attrs Attributes) (string, error) {
+	return ss.SigninWithAttributesContext(context.Background(), email, pass, attrs)
+}
+
+func (ss *SQLStore) SigninWithAttributesContext(ctx context.Context, email, pass string, attrs Attributes) (string, error) {
+	err := validateAttributes(ss.schema, attrs)
+	if err != nil {
+		return "", err
+	}
+	jattrs, err := marshalAttributes(attrs)
+	if err != nil {
+		return "", err
+	}
+
+	// check if the user exists
+	_, err = ss.UserByEmailContext(ctx, email)
+	if err == nil {
+		return "", ErrEmailDuplication
+	}
+	if err != ErrUserNotFound {
+		return "", err
+	}
+
+	email, err = ss.normalize(email)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := NewUserWithHasher(ss.hasher, "", email, pass)
+	if err != nil {
+		return "", err
+	}
+
+	var id int64
+	err = ss.db.QueryRowContext(ctx, ss.stmt("INSERT INTO {table} (email, password, salt, attributes) VALUES (?, ?, ?, ?) RETURNING id"),
+		user.Email, []byte(user.Password), []byte(user.Salt), jattrs).Scan(&id)
+	if err != nil {
+		// the unique constraint has the last word when two signins with the same email race,
+		// the error is driver specific so check if the email is there
+		if _, uerr := ss.UserByEmailContext(ctx, email); uerr == nil {
+			return "", ErrEmailDuplication
+		}
+		return "", err
+	}
+
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (ss *SQLStore) UserById(userId string) (User, error) {
+	return ss.UserByIdContext(context.Background(), userId)
+}
+
+func (ss *SQLStore) UserByIdContext(ctx context.Context, userId string) (User, error) {
+	id, err := parseId(userId)
+	if err != nil {
+		return User{}, err
+	}
+	row := ss.db.QueryRowContext(ctx, ss.stmt("SELECT "+userColumns+" FROM {table} WHERE id = ?"), id)
+	return scanUser(row)
+}
+
+func (ss *SQLStore) UpdatePassword(userId, pass string) error {
+	return ss.UpdatePasswordContext(context.Background(), userId, pass)
+}
+
+func (ss *SQLStore) UpdatePasswordContext(ctx context.Context, userId, pass string) error {
+	id, err := parseId(userId)
+	if err != nil {
+		return err
+	}
+	hpass, err := hashPassword(ss.hasher, pass)
+	if err != nil {
+		return err
+	}
+
+	res, err := ss.db.ExecContext(ctx, ss.stmt("UPDATE {table} SET password = ?, salt = ? WHERE id = ?"),
+		[]byte(hpass), []byte{}, id)
+	return rowAffected(res, err)
+}
+
+func (ss *SQLStore) UpdateEmail(userId, email string) error {
+	return ss.UpdateEmailContext(context.Background(), userId, email)
+}
+
+func (ss *SQLStore) UpdateEmailContext(ctx context.Context, userId, email string) error {
+	id, err := parseId(userId)
+	if err != nil {
+		return err
+	}
+	email, err = ss.normalize(email)
+	if err != nil {
+		return err
+	}
+
+	user, err := ss.UserByEmailContext(ctx, email)
+	if err == nil {
+		if user.Id == userId {
+			return nil
+		}
+		return ErrEmailDuplication
+	}
+	if err != ErrUserNotFound {
+		return err
+	}
+
+	res, err := ss.db.ExecContext(ctx, ss.stmt("UPDATE {table} SET email = ? WHERE id = ?"), email, id)
+	if err != nil {
+		if _, uerr := ss.UserByEmailContext(ctx, email); uerr == nil {
+			return ErrEmailDuplication
+		}
+	}
+	return rowAffected(res, err)
+}
+
+func (ss *SQLStore) UpdateAttributes(userId string, attrs Attributes) error {
+	return ss.UpdateAttributesContext(context.Background(), userId, attrs)
+}
+
+func (ss *SQLStore) UpdateAttributesContext(ctx context.Context, userId string, attrs Attributes) error {
+	id, err := parseId(userId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRowContext(ctx, ss.stmt("SELECT "+userColumns+" FROM {table} WHERE id = ?"), id))
+	if err != nil {
+		return err
+	}
+
+	merged := mergeAttributes(user.Attributes, attrs)
+	err = validateAttributes(ss.schema, merged)
+	if err != nil {
+		return err
+	}
+	jattrs, err := marshalAttributes(merged)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, ss.stmt("UPDATE {table} SET attributes = ? WHERE id = ?"), jattrs, id)
+	err = rowAffected(res, err)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLStore) SetStatus(userId string, status Status, until time.Time) error {
+	return ss.SetStatusContext(context.Background(), userId, status, until)
+}
+
+func (ss *SQLStore) SetStatusContext(ctx context.Context, userId string, status Status, until time.Time) error {
+	id, err := parseId(userId)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	err = setStatus(&user, status, until)
+	if err != nil {
+		return err
+	}
+
+	res, err := ss.db.ExecContext(ctx, ss.stmt("UPDATE {table} SET status = ?, status_until = ? WHERE id = ?"),
+		string(user.Status), statusUntilUnix(user.StatusUntil), id)
+	return rowAffected(res, err)
+}
+
+func (ss *SQLStore) PurgeUsers(now time.Time) ([]string, error) {
+	return ss.PurgeUsersContext(context.Background(), now)
+}
+
+func (ss *SQLStore) PurgeUsersContext(ctx context.Context, now time.Time) ([]string, error) {
+	rows, err := ss.db.QueryContext(ctx, ss.stmt("SELECT id FROM {table} WHERE status = ? AND status_until <= ?"),
+		string(StatusPendingDeletion), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the status is checked again, the user could be restored in the meantime
+	var purged []string
+	for _, id := range ids {
+		res, err := ss.db.ExecContext(ctx, ss.stmt("DELETE FROM {table} WHERE id = ? AND status = ? AND status_until <= ?"),
+			id, string(StatusPendingDeletion), now.Unix())
+		err = rowAffected(res, err)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, strconv.FormatInt(id, 10))
+	}
+	return purged, nil
+}
+
+func (ss *SQLStore) DeleteUser(userId string) error {
+	return ss.DeleteUserContext(context.Background(), userId)
+}
+
+func (ss *SQLStore) DeleteUserContext(ctx context.Context, userId string) error {
+	id, err := parseId(userId)
+	if err != nil {
+		return err
+	}
+
+	res, err := ss.db.ExecContext(ctx, ss.stmt("DELETE FROM {table} WHERE id = ?"), id)
+	return rowAffected(res, err)
+}
+
+// Users are listed in the order of the ids, and the cursor is the id of the last user of the page
+func (ss *SQLStore) ListUsers(cursor string, limit int) ([]User, string, error) {
+	return ss.ListUsersContext(context.Background(), cursor, limit)
+}
+
+func (ss *SQLStore) ListUsersContext(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	var after int64
+	if cursor != "" {
+		var err error
+		after, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	query := "SELECT " + userColumns + " FROM {table} WHERE id > ? ORDER BY id"
+	args := []interface{}{after}
+	if limit > 0 {
+		// one more to know if there is a next page
+		query += " LIMIT ?"
+		args = append(args, limit+1)
+	}
+
+	rows, err := ss.db.QueryContext(ctx, ss.stmt(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+		next = users[limit-1].Id
+	}
+	return users, next, nil
+}
+
+func (ss *SQLStore) Login(email, pass string) (string, error) {
+	return ss.LoginContext(context.Background(), email, pass)
+}
+
+func (ss *SQLStore) LoginContext(ctx context.Context, email, pass string) (string, error) {
+	user, err := ss.UserByEmailContext(ctx, email)
+	if err == ErrUserNotFound {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = checkPassword(ss.hasher, user, pass)
+	if err != nil {
+		return "", err
+	}
+
+	err = user.CheckStatus(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+// Expands the table and the dialect types in the statement,
+// and rebinds the ? placeholders to the ones of the dialect
+func (ss *SQLStore) stmt(statement string) string {
+	statement = strings.NewReplacer(
+		"{table}", ss.table,
+		"{serial}", ss.dialect.Serial,
+		"{binary}", ss.dialect.Binary,
+	).Replace(statement)
+
+	parts := strings.Split(statement, "?")
+	var buf bytes.Buffer
+	for i, part := range parts {
+		if i > 0 {
+			buf.WriteString(ss.dialect.Placeholder(i))
+		}
+		buf.WriteString(part)
+	}
+	return buf.String()
+}
+
+// The ids are numbers in the table, so any other id is an unknown user
+func parseId(userId string) (int64, error) {
+	id, err := strconv.ParseInt(userId, 10, 64)
+	if err != nil {
+		return 0, ErrUserNotFound
+	}
+	return id, nil
+}
+
+// Checks that the statement changed a user
+func rowAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// sql.Row or sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var (
+		id       int64
+		email    string
+		password []byte
+		salt     []byte
+		jattrs   sql.NullString
+		status   sql.NullString
+		until    sql.NullInt64
+	)
+	err := row.Scan(&id, &email, &password, &salt, &jattrs, &status, &until)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	attrs, err := unmarshalAttributes(jattrs.String)
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{
+		Id:          strconv.FormatInt(id, 10),
+		Email:       email,
+		Password:    string(password),
+		Salt:        string(salt),
+		Attributes:  attrs,
+		Status:      Status(status.String),
+		StatusUntil: statusUntilTime(until.Int64),
+	}, nil
+}
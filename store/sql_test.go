@@ -0,0 +1,189 @@
+package store
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func NewSQLiteDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "authsql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(SQLite.Name, filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	Convey("Creating the SQL store applies the migrations once", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+		So(ss, ShouldNotBeNil)
+
+		version, err := ss.SchemaVersion()
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, len(sqlMigrations))
+
+		_, err = ss.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+
+		// a second store over the same schema does not migrate again
+		ss, err = NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		_, err = ss.UserByEmail("ddhhpp@test.com")
+		So(err, ShouldBeNil)
+
+	})
+}
+
+func TestSQLDialectPlaceholders(t *testing.T) {
+	Convey("Statements are rebound to the placeholders of the dialect", t, func() {
+		ss := &SQLStore{dialect: Postgres, table: "users"}
+		So(ss.stmt("SELECT id FROM {table} WHERE email = ? AND id = ?"), ShouldEqual,
+			"SELECT id FROM users WHERE email = $1 AND id = $2")
+
+		ss = &SQLStore{dialect: SQLite, table: "users"}
+		So(ss.stmt("SELECT id FROM {table} WHERE email = ? AND id = ?"), ShouldEqual,
+			"SELECT id FROM users WHERE email = ? AND id = ?")
+
+	})
+}
+
+func TestSQLSignIn(t *testing.T) {
+	Convey("SingIn in SQL", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		id, err := ss.Signin("ddhhpp@test.com", "123456")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, "1")
+
+	})
+}
+
+func TestSQLGetUserDataByEmail(t *testing.T) {
+	Convey("Gets the user data by the email from SQL", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		id, err := ss.Signin(email, "123456")
+		So(err, ShouldBeNil)
+
+		user, err := ss.UserByEmail(email)
+		So(err, ShouldBeNil)
+
+		So(user.Id, ShouldEqual, id)
+		So(user.Email, ShouldEqual, email)
+		So(user.Password, ShouldStartWith, "$scrypt$")
+		So(user.Salt, ShouldBeEmpty)
+
+		_, err = ss.UserByEmail("no@user.com")
+		So(err, ShouldEqual, ErrUserNotFound)
+
+	})
+}
+
+func TestSQLLogIn(t *testing.T) {
+	Convey("Log in SQL", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		email := "ddhhpp@test.com"
+		pass := "123456"
+		id, err := ss.Signin(email, pass)
+		So(err, ShouldBeNil)
+
+		loginId, err := ss.Login(email, pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+
+		_, err = ss.Login(email, "xyz")
+		So(err, ShouldEqual, ErrWrongPassword)
+
+		_, err = ss.Login("no@user.com", pass)
+		So(err, ShouldEqual, ErrWrongPassword)
+	})
+}
+
+func TestSQLListUsers(t *testing.T) {
+	Convey("SQL: Lists the users by pages", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		for _, email := range []string{"a@test.com", "b@test.com", "c@test.com"} {
+			_, err = ss.Signin(email, "123456")
+			So(err, ShouldBeNil)
+		}
+
+		users, cursor, err := ss.ListUsers("", 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Email, ShouldEqual, "a@test.com")
+		So(users[1].Email, ShouldEqual, "b@test.com")
+		So(cursor, ShouldNotBeEmpty)
+
+		users, cursor, err = ss.ListUsers(cursor, 2)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].Email, ShouldEqual, "c@test.com")
+		So(cursor, ShouldBeEmpty)
+
+		_, _, err = ss.ListUsers("xyz", 2)
+		So(err, ShouldEqual, ErrInvalidCursor)
+
+		users, cursor, err = ss.ListUsers("", 0)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 3)
+		So(cursor, ShouldBeEmpty)
+	})
+}
+
+func TestSQLNormalizedEmails(t *testing.T) {
+	Convey("SQL finds the users by the normalized email", t, func() {
+		db, closeDB := NewSQLiteDB(t)
+		defer closeDB()
+
+		ss, err := NewSQLStore(db, SQLite, "users")
+		So(err, ShouldBeNil)
+
+		pass := "123456"
+		id, err := ss.Signin("Bob@Example.com", pass)
+		So(err, ShouldBeNil)
+
+		_, err = ss.Signin(" bob@example.COM", pass)
+		So(err, ShouldEqual, ErrEmailDuplication)
+
+		loginId, err := ss.Login("BOB@example.com", pass)
+		So(err, ShouldBeNil)
+		So(loginId, ShouldEqual, id)
+	})
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrAccountDisabled        = errors.New("The account is disabled")
+	ErrAccountLocked          = errors.New("The account is locked")
+	ErrAccountPendingDeletion = errors.New("The account is pending deletion")
+	ErrNotPendingDeletion     = errors.New("The account is not pending deletion")
+	ErrInvalidStatus          = errors.New("Invalid account status")
+)
+
+// Status of the account of a user, the users stored before the
+// status existed have an empty status, that is the same as active
+type Status string
+
+const (
+	StatusActive   Status = "active"
+	StatusDisabled Status = "disabled"
+	// Locked until the StatusUntil time of the user
+	StatusLocked Status = "locked"
+	// Deleted, it can be restored until the StatusUntil time of the user, then it is purged
+	StatusPendingDeletion Status = "pending-deletion"
+)
+
+// Sets the status to the user, the time is only kept for the statuses that have an end
+func setStatus(user *User, status Status, until time.Time) error {
+	switch status {
+	case StatusActive, StatusDisabled:
+		until = time.Time{}
+	case StatusLocked, StatusPendingDeletion:
+	default:
+		return ErrInvalidStatus
+	}
+	user.Status = status
+	user.StatusUntil = until
+	return nil
+}
+
+// Checks if the user can log in, a lock that is over is the same as active
+func (u User) CheckStatus(now time.Time) error {
+	switch u.Status {
+	case StatusDisabled:
+		return ErrAccountDisabled
+	case StatusLocked:
+		if now.Before(u.StatusUntil) {
+			return ErrAccountLocked
+		}
+	case StatusPendingDeletion:
+		return ErrAccountPendingDeletion
+	}
+	return nil
+}
+
+// The user is pending deletion and the grace period is over
+func (u User) purgeable(now time.Time) bool {
+	return u.Status == StatusPendingDeletion && !now.Before(u.StatusUntil)
+}
+
+// The time of the status as it is stored, 0 when there is no time
+func statusUntilUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func statusUntilTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func EnableUser(repo UserRepository, userId string) error {
+	return repo.SetStatus(userId, StatusActive, time.Time{})
+}
+
+func DisableUser(repo UserRepository, userId string) error {
+	return repo.SetStatus(userId, StatusDisabled, time.Time{})
+}
+
+// The user can not log in until the given time
+func LockUser(repo UserRepository, userId string, until time.Time) error {
+	return repo.SetStatus(userId, StatusLocked, until)
+}
+
+// Deletes the user after the grace period, until then the user can not log in
+// and can be restored with RestoreUser. Purge the users with UserRepository.PurgeUsers
+func ScheduleDeletion(repo UserRepository, userId string, grace time.Duration) error {
+	return repo.SetStatus(userId, StatusPendingDeletion, time.Now().Add(grace))
+}
+
+// Restores the user pending deletion that has not been purged yet
+func RestoreUser(repo UserRepository, userId string) error {
+	user, err := repo.UserById(userId)
+	if err != nil {
+		return err
+	}
+	if user.Status != StatusPendingDeletion {
+		return ErrNotPendingDeletion
+	}
+	return repo.SetStatus(userId, StatusActive, time.Time{})
+}
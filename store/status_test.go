@@ -0,0 +1,42 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckStatus(t *testing.T) {
+	Convey("Checks if the user can log in by the status", t, func() {
+		now := time.Now()
+
+		So(User{}.CheckStatus(now), ShouldBeNil)
+		So(User{Status: StatusActive}.CheckStatus(now), ShouldBeNil)
+		So(User{Status: StatusDisabled}.CheckStatus(now), ShouldEqual, ErrAccountDisabled)
+		So(User{Status: StatusLocked, StatusUntil: now.Add(time.Second)}.CheckStatus(now), ShouldEqual, ErrAccountLocked)
+		So(User{Status: StatusLocked, StatusUntil: now}.CheckStatus(now), ShouldBeNil)
+		So(User{Status: StatusPendingDeletion, StatusUntil: now.Add(time.Hour)}.CheckStatus(now), ShouldEqual, ErrAccountPendingDeletion)
+	})
+}
+
+func TestStatusRecord(t *testing.T) {
+	Convey("The status is kept in the Bolt record", t, func() {
+		until := time.Unix(1500000000, 0)
+		user := User{Id: "1", Email: "ddhhpp@test.com", Status: StatusLocked, StatusUntil: until}
+
+		b, err := encodeUser(user)
+		So(err, ShouldBeNil)
+
+		decoded, old, err := decodeUser(b)
+		So(err, ShouldBeNil)
+		So(old, ShouldBeFalse)
+		So(decoded.Status, ShouldEqual, StatusLocked)
+		So(decoded.StatusUntil.Equal(until), ShouldBeTrue)
+
+		// the records of the active users have no status
+		b, err = encodeUser(User{Id: "1", Email: "ddhhpp@test.com"})
+		So(err, ShouldBeNil)
+		So(string(b), ShouldNotContainSubstring, "status")
+	})
+}
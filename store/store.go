@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"time"
 
 	"github.com/dahernan/auth/crypto"
 )
@@ -10,32 +11,103 @@ var (
 	ErrEmailDuplication = errors.New("The email is already in the store")
 	ErrUserNotFound     = errors.New("User not found")
 	ErrWrongPassword    = errors.New("email or password is incorrent")
+	ErrInvalidCursor    = errors.New("Invalid cursor to list the users")
+	// The users of the read-only stores are managed outside of them
+	ErrReadOnly = errors.New("The store is read-only")
 )
 
 type User struct {
-	Id       string
-	Email    string
+	Id    string
+	Email string
+	// PHC string of the hash of the password, crypto.VerifyPassword checks it
 	Password string
-	Salt     string
+	// Only the users stored before the PHC hashes have a salt, their password is the scrypt hash of crypto.HashPassword
+	Salt string
+	// the RedisStore keeps them apart as JSON
+	Attributes Attributes `redis:"-"`
+	Status     Status
+	// The end of the lock, or when the user pending deletion is purged
+	StatusUntil time.Time `redis:"-"`
+	// Empty when the store is not for a tenant
+	TenantId string
 }
 
 type UserRepository interface {
 	Signin(email, pass string) (string, error)
+	// Signin of a user with profile attributes, they are checked against the schema of the store
+	SigninWithAttributes(email, pass string, attrs Attributes) (string, error)
 	Login(email, pass string) (string, error)
 	UserByEmail(email string) (User, error)
+	UserById(userId string) (User, error)
+	UpdatePassword(userId, pass string) error
+	UpdateEmail(userId, email string) error
+	DeleteUser(userId string) error
+	// Merges the attributes given with the ones of the user, a nil value removes the attribute.
+	// The attributes are read with UserById or UserByEmail
+	UpdateAttributes(userId string, attrs Attributes) error
+	// Changes the status of the account, until is the time for the locked and the pending deletion statuses.
+	// EnableUser, DisableUser, LockUser, ScheduleDeletion and RestoreUser are shortcuts
+	SetStatus(userId string, status Status, until time.Time) error
+	// Deletes the users pending deletion whose grace period is over at the given time,
+	// returns their ids
+	PurgeUsers(now time.Time) ([]string, error)
+	// Lists up to limit users after the cursor, an empty cursor starts from the beginning
+	// and a limit of 0 lists all the users.
+	// Returns the cursor of the next page, that is empty when there are no more users.
+	ListUsers(cursor string, limit int) ([]User, string, error)
 }
 
+// The user with the password hashed with crypto.DefaultHasher
 func NewUser(userId, email, pass string) (User, error) {
-	salt := crypto.GenerateRandomKey(128)
-	hpass, err := crypto.HashPassword(pass, salt)
+	return NewUserWithHasher(nil, userId, email, pass)
+}
 
+// The user with the password hashed with the hasher, crypto.DefaultHasher when it is nil
+func NewUserWithHasher(hasher crypto.Hasher, userId, email, pass string) (User, error) {
+	hpass, err := hashPassword(hasher, pass)
 	if err != nil {
 		return User{}, err
 	}
 	return User{
 		Id:       userId,
 		Email:    email,
-		Password: string(hpass),
-		Salt:     string(salt),
+		Password: hpass,
 	}, nil
 }
+
+// The PHC hash of the password with a new random salt
+func hashPassword(hasher crypto.Hasher, pass string) (string, error) {
+	if hasher == nil {
+		hasher = crypto.DefaultHasher
+	}
+	return hasher.Hash(pass)
+}
+
+// Checks the password given against the hashed password of the user, a PHC hash
+// or the scrypt hash and salt of the users stored before the PHC hashes.
+// The peppered hashes are checked with the hasher of the store, a crypto.PepperedHasher
+func checkPassword(hasher crypto.Hasher, user User, pass string) error {
+	if user.Salt != "" {
+		return checkLegacyPassword(user, pass)
+	}
+	err := crypto.VerifyPassword(user.Password, pass)
+	if err == crypto.ErrPepperedHash && hasher != nil {
+		err = hasher.Verify(user.Password, pass)
+	}
+	if err == crypto.ErrPasswordMismatch {
+		return ErrWrongPassword
+	}
+	return err
+}
+
+func checkLegacyPassword(user User, pass string) error {
+	hpass, err := crypto.HashPassword(pass, []byte(user.Salt))
+	if err != nil {
+		return err
+	}
+	passOk := crypto.SecureCompare(hpass, []byte(user.Password))
+	if !passOk {
+		return ErrWrongPassword
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+// Conformance tests for the implementations of store.UserRepository.
+//
+// A backend proves that it behaves like the stores of this package with one call
+// from its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) (store.UserRepository, func()) {
+//			repo := NewMyStore(...)
+//			return repo, func() { repo.Close() }
+//		})
+//	}
+//
+// Every case is a subtest that gets a new empty repository from the factory, and calls the cleanup function at the end.
+// The package only uses the testing package, so the backends do not get other test dependencies.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dahernan/auth/store"
+)
+
+// Creates an empty repository for a case, and the function to clean it up after the case
+type Factory func(t *testing.T) (store.UserRepository, func())
+
+const (
+	email = "ddhhpp@test.com"
+	pass  = "123456"
+	// an id that no store generates
+	unknownId = "does-not-exist"
+)
+
+// A case of the conformance tests, with the repository of the case
+type conformanceCase struct {
+	name string
+	run  func(t *testing.T, repo store.UserRepository)
+}
+
+func Run(t *testing.T, factory Factory) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			repo, cleanup := factory(t)
+			defer cleanup()
+			c.run(t, repo)
+		})
+	}
+}
+
+func noError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func isError(t *testing.T, err, want error) {
+	t.Helper()
+	if err != want {
+		t.Fatalf("got the error %v, want %v", err, want)
+	}
+}
+
+func equal(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+func signin(t *testing.T, repo store.UserRepository, email string) string {
+	t.Helper()
+	id, err := repo.Signin(email, pass)
+	noError(t, err)
+	return id
+}
+
+func login(t *testing.T, repo store.UserRepository, email, pass, id string) {
+	t.Helper()
+	loginId, err := repo.Login(email, pass)
+	noError(t, err)
+	equal(t, loginId, id)
+}
+
+var cases = []conformanceCase{
+	{"Signin returns the id of the new user", func(t *testing.T, repo store.UserRepository) {
+		id, err := repo.Signin(email, pass)
+		noError(t, err)
+		if id == "" {
+			t.Fatal("the id is empty")
+		}
+
+		user, err := repo.UserById(id)
+		noError(t, err)
+		equal(t, user.Id, id)
+		equal(t, user.Email, email)
+		if user.Password == "" || user.Password == pass {
+			t.Fatalf("the password is not hashed: %q", user.Password)
+		}
+	}},
+
+	{"Signin gives different ids to different users", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+		other := signin(t, repo, "other@test.com")
+		if other == id {
+			t.Fatalf("the two users have the id %q", id)
+		}
+	}},
+
+	{"Signin with a duplicate email returns ErrEmailDuplication", func(t *testing.T, repo store.UserRepository) {
+		signin(t, repo, email)
+
+		_, err := repo.Signin(email, "other")
+		isError(t, err, store.ErrEmailDuplication)
+
+		_, err = repo.Signin("DDHHPP@Test.com", pass)
+		isError(t, err, store.ErrEmailDuplication)
+	}},
+
+	{"Signin with an invalid email returns ErrInvalidEmail", func(t *testing.T, repo store.UserRepository) {
+		_, err := repo.Signin("not an email", pass)
+		isError(t, err, store.ErrInvalidEmail)
+	}},
+
+	{"Concurrent signins with the same email, only one wins", func(t *testing.T, repo store.UserRepository) {
+		signins := 8
+		errs := make(chan error, signins)
+		ids := make(chan string, signins)
+
+		var wg sync.WaitGroup
+		for i := 0; i < signins; i++ {
+			wg.Add(1)
+			go func(pass string) {
+				defer wg.Done()
+				id, err := repo.Signin(email, pass)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids <- id
+			}(fmt.Sprintf("pass%d", i))
+		}
+		wg.Wait()
+		close(errs)
+		close(ids)
+
+		equal(t, len(ids), 1)
+		for err := range errs {
+			isError(t, err, store.ErrEmailDuplication)
+		}
+
+		id := <-ids
+		user, err := repo.UserByEmail(email)
+		noError(t, err)
+		equal(t, user.Id, id)
+	}},
+
+	{"Login returns the id of the user", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		login(t, repo, email, pass, id)
+		login(t, repo, " DDHHPP@test.com", pass, id)
+	}},
+
+	{"Login with a wrong password returns ErrWrongPassword", func(t *testing.T, repo store.UserRepository) {
+		signin(t, repo, email)
+
+		_, err := repo.Login(email, "xyz")
+		isError(t, err, store.ErrWrongPassword)
+
+		_, err = repo.Login(email, "")
+		isError(t, err, store.ErrWrongPassword)
+	}},
+
+	{"Login of an unknown user returns ErrWrongPassword", func(t *testing.T, repo store.UserRepository) {
+		_, err := repo.Login("no@user.com", pass)
+		isError(t, err, store.ErrWrongPassword)
+
+		_, err = repo.Login("not an email", pass)
+		isError(t, err, store.ErrWrongPassword)
+	}},
+
+	{"Lookups of unknown users return ErrUserNotFound", func(t *testing.T, repo store.UserRepository) {
+		_, err := repo.UserByEmail("no@user.com")
+		isError(t, err, store.ErrUserNotFound)
+
+		_, err = repo.UserById(unknownId)
+		isError(t, err, store.ErrUserNotFound)
+
+		isError(t, repo.UpdatePassword(unknownId, pass), store.ErrUserNotFound)
+		isError(t, repo.UpdateEmail(unknownId, email), store.ErrUserNotFound)
+		isError(t, repo.DeleteUser(unknownId), store.ErrUserNotFound)
+		isError(t, repo.UpdateAttributes(unknownId, store.Attributes{"name": "David"}), store.ErrUserNotFound)
+	}},
+
+	{"SigninWithAttributes stores the attributes of the user", func(t *testing.T, repo store.UserRepository) {
+		id, err := repo.SigninWithAttributes(email, pass, store.Attributes{
+			"name":     "David",
+			"age":      33,
+			"verified": true,
+		})
+		noError(t, err)
+
+		user, err := repo.UserById(id)
+		noError(t, err)
+		name, _ := user.Attributes.String("name")
+		equal(t, name, "David")
+		age, _ := user.Attributes.Int("age")
+		equal(t, age, int64(33))
+		verified, _ := user.Attributes.Bool("verified")
+		equal(t, verified, true)
+
+		user, err = repo.UserByEmail(email)
+		noError(t, err)
+		equal(t, len(user.Attributes), 3)
+	}},
+
+	{"SigninWithAttributes only accepts strings, numbers and booleans", func(t *testing.T, repo store.UserRepository) {
+		_, err := repo.SigninWithAttributes(email, pass, store.Attributes{
+			"address": map[string]interface{}{"city": "London"},
+		})
+		if _, ok := err.(*store.AttributeError); !ok {
+			t.Fatalf("got the error %v, want an AttributeError", err)
+		}
+
+		_, err = repo.UserByEmail(email)
+		isError(t, err, store.ErrUserNotFound)
+	}},
+
+	{"UpdateAttributes merges the attributes, and nil removes them", func(t *testing.T, repo store.UserRepository) {
+		id, err := repo.SigninWithAttributes(email, pass, store.Attributes{"name": "David", "locale": "en"})
+		noError(t, err)
+
+		noError(t, repo.UpdateAttributes(id, store.Attributes{"locale": "es", "age": 33}))
+
+		user, err := repo.UserById(id)
+		noError(t, err)
+		equal(t, user.Attributes, store.Attributes{"name": "David", "locale": "es", "age": float64(33)})
+
+		noError(t, repo.UpdateAttributes(id, store.Attributes{"name": nil}))
+
+		user, err = repo.UserById(id)
+		noError(t, err)
+		if _, ok := user.Attributes["name"]; ok {
+			t.Fatal("the attribute name is not removed")
+		}
+		equal(t, len(user.Attributes), 2)
+
+		// the password is not touched
+		login(t, repo, email, pass, id)
+	}},
+
+	{"UpdatePassword changes the password to log in", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		noError(t, repo.UpdatePassword(id, "abcdef"))
+
+		_, err := repo.Login(email, pass)
+		isError(t, err, store.ErrWrongPassword)
+
+		login(t, repo, email, "abcdef", id)
+	}},
+
+	{"UpdateEmail changes the email and keeps the id", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+		signin(t, repo, "taken@test.com")
+
+		isError(t, repo.UpdateEmail(id, "taken@test.com"), store.ErrEmailDuplication)
+		noError(t, repo.UpdateEmail(id, "new@test.com"))
+
+		_, err := repo.UserByEmail(email)
+		isError(t, err, store.ErrUserNotFound)
+
+		user, err := repo.UserByEmail("new@test.com")
+		noError(t, err)
+		equal(t, user.Id, id)
+
+		login(t, repo, "new@test.com", pass, id)
+
+		// the old email is free
+		signin(t, repo, email)
+	}},
+
+	{"DeleteUser removes the user and frees the email", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		noError(t, repo.DeleteUser(id))
+
+		_, err := repo.UserById(id)
+		isError(t, err, store.ErrUserNotFound)
+
+		_, err = repo.Login(email, pass)
+		isError(t, err, store.ErrWrongPassword)
+
+		signin(t, repo, email)
+	}},
+
+	{"Login checks the status of the account", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		noError(t, store.DisableUser(repo, id))
+		_, err := repo.Login(email, pass)
+		isError(t, err, store.ErrAccountDisabled)
+
+		// the status is not told without the right password
+		_, err = repo.Login(email, "xyz")
+		isError(t, err, store.ErrWrongPassword)
+
+		noError(t, store.LockUser(repo, id, time.Now().Add(time.Hour)))
+		_, err = repo.Login(email, pass)
+		isError(t, err, store.ErrAccountLocked)
+
+		user, err := repo.UserById(id)
+		noError(t, err)
+		equal(t, user.Status, store.StatusLocked)
+		if !user.StatusUntil.After(time.Now()) {
+			t.Fatalf("the lock ends at %v", user.StatusUntil)
+		}
+
+		// the lock is over
+		noError(t, store.LockUser(repo, id, time.Now().Add(-time.Minute)))
+		login(t, repo, email, pass, id)
+
+		noError(t, store.ScheduleDeletion(repo, id, time.Hour))
+		_, err = repo.Login(email, pass)
+		isError(t, err, store.ErrAccountPendingDeletion)
+
+		noError(t, store.EnableUser(repo, id))
+		login(t, repo, email, pass, id)
+	}},
+
+	{"SetStatus errors", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		isError(t, repo.SetStatus(id, store.Status("frozen"), time.Time{}), store.ErrInvalidStatus)
+		isError(t, repo.SetStatus(unknownId, store.StatusDisabled, time.Time{}), store.ErrUserNotFound)
+		isError(t, store.RestoreUser(repo, id), store.ErrNotPendingDeletion)
+	}},
+
+	{"The users pending deletion are restored or purged after the grace period", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+		restored := signin(t, repo, "restored@test.com")
+		later := signin(t, repo, "later@test.com")
+		active := signin(t, repo, "active@test.com")
+
+		noError(t, store.ScheduleDeletion(repo, id, 0))
+		noError(t, store.ScheduleDeletion(repo, restored, 0))
+		noError(t, store.ScheduleDeletion(repo, later, time.Hour))
+
+		// the email is still taken until the user is purged
+		_, err := repo.Signin(email, pass)
+		isError(t, err, store.ErrEmailDuplication)
+
+		noError(t, store.RestoreUser(repo, restored))
+		login(t, repo, "restored@test.com", pass, restored)
+
+		purged, err := repo.PurgeUsers(time.Now())
+		noError(t, err)
+		equal(t, purged, []string{id})
+
+		_, err = repo.UserById(id)
+		isError(t, err, store.ErrUserNotFound)
+		isError(t, store.RestoreUser(repo, id), store.ErrUserNotFound)
+
+		for _, userId := range []string{restored, later, active} {
+			_, err = repo.UserById(userId)
+			noError(t, err)
+		}
+
+		purged, err = repo.PurgeUsers(time.Now().Add(2 * time.Hour))
+		noError(t, err)
+		equal(t, purged, []string{later})
+
+		signin(t, repo, email)
+	}},
+
+	{"ListUsers lists all the users by pages", func(t *testing.T, repo store.UserRepository) {
+		emails := []string{"a@test.com", "b@test.com", "c@test.com", "d@test.com", "e@test.com"}
+		for _, e := range emails {
+			signin(t, repo, e)
+		}
+
+		seen := make(map[string]bool)
+		cursor := ""
+		pages := 0
+		for {
+			users, next, err := repo.ListUsers(cursor, 2)
+			noError(t, err)
+			if len(users) > 2 {
+				t.Fatalf("the page has %d users, the limit is 2", len(users))
+			}
+			for _, user := range users {
+				if seen[user.Email] {
+					t.Fatalf("the user %s is listed twice", user.Email)
+				}
+				seen[user.Email] = true
+			}
+			pages++
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		equal(t, pages, 3)
+		for _, e := range emails {
+			if !seen[e] {
+				t.Fatalf("the user %s is not listed", e)
+			}
+		}
+
+		users, next, err := repo.ListUsers("", 0)
+		noError(t, err)
+		equal(t, len(users), len(emails))
+		equal(t, next, "")
+	}},
+
+	{"The operations with a cancelled context fail without changes", func(t *testing.T, repo store.UserRepository) {
+		id := signin(t, repo, email)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ctxRepo := store.WithContext(repo)
+
+		_, err := ctxRepo.SigninContext(ctx, "other@test.com", pass)
+		isError(t, err, context.Canceled)
+		_, err = repo.UserByEmail("other@test.com")
+		isError(t, err, store.ErrUserNotFound)
+
+		_, err = ctxRepo.LoginContext(ctx, email, pass)
+		isError(t, err, context.Canceled)
+
+		isError(t, ctxRepo.UpdateEmailContext(ctx, id, "new@test.com"), context.Canceled)
+		isError(t, ctxRepo.DeleteUserContext(ctx, id), context.Canceled)
+
+		user, err := repo.UserById(id)
+		noError(t, err)
+		equal(t, user.Email, email)
+
+		loginId, err := ctxRepo.LoginContext(context.Background(), email, pass)
+		noError(t, err)
+		equal(t, loginId, id)
+	}},
+
+	{"ListUsers of an empty repository", func(t *testing.T, repo store.UserRepository) {
+		users, next, err := repo.ListUsers("", 10)
+		noError(t, err)
+		equal(t, len(users), 0)
+		equal(t, next, "")
+	}},
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrTenantNotFound = errors.New("Tenant not found")
+	ErrTenantExists   = errors.New("The tenant already exists")
+	ErrInvalidTenant  = errors.New("Invalid tenant id")
+)
+
+// Repositories of users isolated by tenant, the same email can be a user in several tenants
+type TenantRepository interface {
+	// The repository of the users of the tenant, ErrTenantNotFound if the tenant does not exist
+	ForTenant(tenantId string) (UserRepository, error)
+}
+
+// Bolt stores of the tenants. Every tenant has its own buckets
+// nested in the bucket of the tenant, in the tenants bucket:
+//
+//	<tenantsBucket>/<tenantId>/users
+//	<tenantsBucket>/<tenantId>/users.email
+//
+// The tenants are created with CreateTenant, they are not created
+// when they are requested, so a request can not create tenants.
+type TenantBoltStore struct {
+	db     *bolt.DB
+	bucket []byte
+	opt    BoltOptions
+	policy *PasswordPolicy
+
+	mu     sync.Mutex
+	stores map[string]*BoltStore
+}
+
+func NewTenantBoltStore(db *bolt.DB, tenantsBucket string, opt BoltOptions) (*TenantBoltStore, error) {
+	// the options are checked now, so the stores of the tenants can be created
+	_, err := newRecordCipher(opt.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TenantBoltStore{
+		db:     db,
+		bucket: []byte(tenantsBucket),
+		opt:    opt,
+		stores: make(map[string]*BoltStore),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucket)
+		if err != nil {
+			return fmt.Errorf("Creating bucket: %s", err)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func (ts *TenantBoltStore) CreateTenant(tenantId string) (*BoltStore, error) {
+	if tenantId == "" {
+		return nil, ErrInvalidTenant
+	}
+
+	bs, err := ts.newStore(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	err = ts.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(ts.bucket).CreateBucket([]byte(tenantId))
+		if err == bolt.ErrBucketExists {
+			return ErrTenantExists
+		}
+		if err != nil {
+			return err
+		}
+		return bs.createBuckets(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	ts.stores[tenantId] = bs
+	ts.mu.Unlock()
+	return bs, nil
+}
+
+// The store of the users of the tenant
+func (ts *TenantBoltStore) Tenant(tenantId string) (*BoltStore, error) {
+	ts.mu.Lock()
+	bs, ok := ts.stores[tenantId]
+	ts.mu.Unlock()
+	if ok {
+		return bs, nil
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		if tenantId == "" || tx.Bucket(ts.bucket).Bucket([]byte(tenantId)) == nil {
+			return ErrTenantNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err = ts.newStore(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	ts.mu.Lock()
+	ts.stores[tenantId] = bs
+	ts.mu.Unlock()
+	return bs, nil
+}
+
+// The passwords of the users of all the tenants are checked against the policy, ForTenant returns
+// the stores of the tenants in a PolicyStore. Set it before the store is used
+func (ts *TenantBoltStore) SetPasswordPolicy(policy PasswordPolicy) {
+	ts.policy = &policy
+}
+
+func (ts *TenantBoltStore) ForTenant(tenantId string) (UserRepository, error) {
+	bs, err := ts.Tenant(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	if ts.policy != nil {
+		return NewPolicyStore(bs, *ts.policy), nil
+	}
+	return bs, nil
+}
+
+func (ts *TenantBoltStore) Tenants() ([]string, error) {
+	var tenants []string
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ts.bucket).ForEach(func(k, v []byte) error {
+			// the tenants are buckets, they have no value
+			if v == nil {
+				tenants = append(tenants, string(k))
+			}
+			return nil
+		})
+	})
+	return tenants, err
+}
+
+// Deletes the tenant and all its users
+func (ts *TenantBoltStore) DeleteTenant(tenantId string) error {
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(ts.bucket).DeleteBucket([]byte(tenantId))
+		if err == bolt.ErrBucketNotFound {
+			return ErrTenantNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	delete(ts.stores, tenantId)
+	ts.mu.Unlock()
+	return nil
+}
+
+func (ts *TenantBoltStore) newStore(tenantId string) (*BoltStore, error) {
+	bs, err := newBoltStore(ts.db, "users", ts.opt)
+	if err != nil {
+		return nil, err
+	}
+	bs.tenantsBucket = ts.bucket
+	bs.tenant = tenantId
+	if bs.cipher != nil {
+		bs.cipher.tenant = tenantId
+	}
+	return bs, nil
+}
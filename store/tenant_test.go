@@ -0,0 +1,131 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTenantBoltStore(t *testing.T) {
+	Convey("The users of the tenants are isolated", t, func() {
+		db := NewDB(t, "testTenants.db")
+		defer db.Close()
+		DeleteBucket(t, db, "tenants")
+
+		ts, err := NewTenantBoltStore(db, "tenants", BoltOptions{})
+		So(err, ShouldBeNil)
+
+		acme, err := ts.CreateTenant("acme")
+		So(err, ShouldBeNil)
+		So(acme.TenantId(), ShouldEqual, "acme")
+		globex, err := ts.CreateTenant("globex")
+		So(err, ShouldBeNil)
+
+		_, err = ts.CreateTenant("acme")
+		So(err, ShouldEqual, ErrTenantExists)
+		_, err = ts.CreateTenant("")
+		So(err, ShouldEqual, ErrInvalidTenant)
+
+		tenants, err := ts.Tenants()
+		So(err, ShouldBeNil)
+		So(tenants, ShouldResemble, []string{"acme", "globex"})
+
+		Convey("The same email is a different user in every tenant", func() {
+			acmeId, err := acme.Signin("ddhhpp@test.com", "acme-pass")
+			So(err, ShouldBeNil)
+			globexId, err := globex.Signin("ddhhpp@test.com", "globex-pass")
+			So(err, ShouldBeNil)
+			So(acmeId, ShouldNotEqual, globexId)
+
+			_, err = acme.Login("ddhhpp@test.com", "globex-pass")
+			So(err, ShouldEqual, ErrWrongPassword)
+			_, err = globex.Login("ddhhpp@test.com", "globex-pass")
+			So(err, ShouldBeNil)
+
+			_, err = acme.UserById(globexId)
+			So(err, ShouldEqual, ErrUserNotFound)
+
+			user, err := acme.UserById(acmeId)
+			So(err, ShouldBeNil)
+			So(user.TenantId, ShouldEqual, "acme")
+
+			Convey("The store of a tenant is found again", func() {
+				repo, err := ts.ForTenant("acme")
+				So(err, ShouldBeNil)
+				user, err := repo.UserByEmail("ddhhpp@test.com")
+				So(err, ShouldBeNil)
+				So(user.Id, ShouldEqual, acmeId)
+
+				other, err := NewTenantBoltStore(db, "tenants", BoltOptions{})
+				So(err, ShouldBeNil)
+				bs, err := other.Tenant("acme")
+				So(err, ShouldBeNil)
+				user, err = bs.UserById(acmeId)
+				So(err, ShouldBeNil)
+				So(user.TenantId, ShouldEqual, "acme")
+			})
+
+			Convey("The users of a deleted tenant are deleted", func() {
+				So(ts.DeleteTenant("acme"), ShouldBeNil)
+				So(ts.DeleteTenant("acme"), ShouldEqual, ErrTenantNotFound)
+
+				_, err := ts.ForTenant("acme")
+				So(err, ShouldEqual, ErrTenantNotFound)
+
+				// the stores that were in use do not find the tenant
+				_, err = acme.UserById(acmeId)
+				So(err, ShouldEqual, ErrTenantNotFound)
+
+				_, err = globex.UserById(globexId)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("The stores of the tenants check the password policy", func() {
+			ts.SetPasswordPolicy(PasswordPolicy{MinLength: 10})
+			repo, err := ts.ForTenant("acme")
+			So(err, ShouldBeNil)
+			_, err = repo.Signin("ddhhpp@test.com", "acme-pass")
+			So(err, ShouldHaveSameTypeAs, &PolicyError{})
+			_, err = repo.Signin("ddhhpp@test.com", "acme-password")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("An unknown tenant is not found", func() {
+			_, err := ts.Tenant("initech")
+			So(err, ShouldEqual, ErrTenantNotFound)
+			_, err = ts.ForTenant("")
+			So(err, ShouldEqual, ErrTenantNotFound)
+		})
+	})
+
+	Convey("The encrypted records of a tenant can not be moved to another tenant", t, func() {
+		db := NewDB(t, "testTenants.db")
+		defer db.Close()
+		DeleteBucket(t, db, "tenants")
+
+		ts, err := NewTenantBoltStore(db, "tenants", BoltOptions{Encryption: encryption(t, "old")})
+		So(err, ShouldBeNil)
+		acme, err := ts.CreateTenant("acme")
+		So(err, ShouldBeNil)
+		globex, err := ts.CreateTenant("globex")
+		So(err, ShouldBeNil)
+
+		id, err := acme.SigninWithAttributes("ddhhpp@test.com", "acme-pass", Attributes{"name": "Secret Name"})
+		So(err, ShouldBeNil)
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			tenants := tx.Bucket([]byte("tenants"))
+			v := tenants.Bucket([]byte("acme")).Bucket([]byte("users")).Get([]byte(id))
+			return tenants.Bucket([]byte("globex")).Bucket([]byte("users")).Put([]byte(id), v)
+		})
+		So(err, ShouldBeNil)
+
+		_, err = globex.UserById(id)
+		So(err, ShouldEqual, ErrDecryption)
+		user, err := acme.UserById(id)
+		So(err, ShouldBeNil)
+		So(user.Attributes["name"], ShouldEqual, "Secret Name")
+	})
+}